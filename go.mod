@@ -4,10 +4,13 @@ go 1.13
 
 require (
 	github.com/Venafi/vcert v0.0.0-20200807171114-64f717ca1aa4
+	github.com/armon/go-metrics v0.3.3
 	github.com/hashicorp/go-hclog v0.14.1
+	github.com/hashicorp/go-uuid v1.0.1
 	github.com/hashicorp/vault/api v1.0.4
 	github.com/hashicorp/vault/sdk v0.1.13
 	github.com/onsi/ginkgo v1.14.0
 	github.com/onsi/gomega v1.10.1
 	github.com/rendon/testcli v0.0.0-20161027181003-6283090d169f
+	golang.org/x/crypto v0.0.0-20190605123033-f99c8df09eb5
 )
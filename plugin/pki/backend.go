@@ -2,9 +2,12 @@ package pki
 
 import (
 	"context"
+	"github.com/armon/go-metrics"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/hashicorp/vault/sdk/framework"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Factory creates a new backend implementing the logical.Backend interface
@@ -25,6 +28,10 @@ func Backend(conf *logical.BackendConfig) *backend {
 		PathsSpecial: &logical.Paths{
 			SealWrapStorage: []string{
 				"roles/",
+				CredentialsRootPath,
+				pendingPath,
+				framework.WALPrefix,
+				idempotencyPath,
 			},
 		},
 
@@ -33,26 +40,57 @@ func Backend(conf *logical.BackendConfig) *backend {
 			pathRoles(&b),
 			pathCredentialsList(&b),
 			pathCredentials(&b),
+			pathCredentialsTest(&b),
 			pathVenafiCertEnroll(&b),
 			pathVenafiCertSign(&b),
+			pathVenafiCertSignVerbatim(&b),
+			pathVenafiCertPickupList(&b),
+			pathVenafiCertPickup(&b),
+			pathVenafiOrphansList(&b),
+			pathVenafiOrphans(&b),
 			pathVenafiCertRead(&b),
 			pathVenafiCertRevoke(&b),
 			pathVenafiFetchListCerts(&b),
+			pathVenafiHistory(&b),
+			pathVenafiMetrics(&b),
+			pathVenafiHealth(&b),
+			pathConfig(&b),
 		},
 
 		Secrets: []*framework.Secret{
 			secretCerts(&b),
 		},
 
+		WALRollback:       b.walRollback,
+		WALRollbackMinAge: walRollbackMinAge,
+		PeriodicFunc:      b.periodicFunc,
+
 		BackendType: logical.TypeLogical,
 	}
 	b.storage = conf.StorageView
+	b.metrics, b.metricsSink = newMetrics()
 	return &b
 }
 
 type backend struct {
 	*framework.Backend
 	storage logical.Storage
+
+	idempotencyLock   sync.Mutex
+	idempotencyPruned time.Time
+	rateLimitLock     sync.Mutex
+	publicKeysLock    sync.Mutex
+
+	circuitLock sync.Mutex
+	circuits    map[string]*circuitBreaker
+
+	healthLock sync.Mutex
+	health     map[string]*secretHealth
+
+	metrics       *metrics.Metrics
+	metricsSink   *cumulativeSink
+	metricsLock   sync.Mutex
+	expiryScanned time.Time
 }
 
 const (
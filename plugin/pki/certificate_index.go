@@ -0,0 +1,213 @@
+package pki
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/Venafi/vcert/pkg/certificate"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	fingerprintsPath = "fingerprints/"
+
+	warningTextCertificateReused = "valid certificate %s issued earlier for the same request is returned"
+)
+
+// certificateFingerprint describes the subject and the key parameters of a certificate, so the stored
+// certificate can be found for the same request
+type certificateFingerprint struct {
+	Role           string   `json:"role"`
+	CommonName     string   `json:"common_name"`
+	DNSNames       []string `json:"dns_names"`
+	IPAddresses    []string `json:"ip_addresses"`
+	EmailAddresses []string `json:"email_addresses"`
+	Key            string   `json:"key"`
+}
+
+// fingerprintIndexEntry points from the fingerprint to the stored certificate
+type fingerprintIndexEntry struct {
+	Path     string    `json:"path"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+func newCertificateFingerprint(roleName string, commonName string, dnsNames []string, ips []net.IP, emails []string,
+	key string) *certificateFingerprint {
+
+	ipStrings := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		ipStrings = append(ipStrings, ip.String())
+	}
+	return &certificateFingerprint{
+		Role:           roleName,
+		CommonName:     commonName,
+		DNSNames:       normalizeNames(dnsNames),
+		IPAddresses:    normalizeNames(ipStrings),
+		EmailAddresses: normalizeNames(emails),
+		Key:            key,
+	}
+}
+
+// normalizeNames returns sorted names without duplicates
+func normalizeNames(names []string) []string {
+	set := make(map[string]struct{})
+	for _, name := range names {
+		set[strings.ToLower(name)] = struct{}{}
+	}
+	result := make([]string, 0, len(set))
+	for name := range set {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func requestFingerprintOf(roleName string, certReq *certificate.Request) *certificateFingerprint {
+	var key string
+	if certReq.KeyType == certificate.KeyTypeECDSA {
+		key = "ec-" + certReq.KeyCurve.String()
+	} else {
+		keyLength := certReq.KeyLength
+		if keyLength == 0 {
+			keyLength = 2048
+		}
+		key = "rsa-" + strconv.Itoa(keyLength)
+	}
+	return newCertificateFingerprint(roleName, certReq.Subject.CommonName, certReq.DNSNames, certReq.IPAddresses,
+		certReq.EmailAddresses, key)
+}
+
+func certificateFingerprintOf(roleName string, cert *x509.Certificate) *certificateFingerprint {
+	var key string
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		key = "rsa-" + strconv.Itoa(pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		key = "ec-" + strings.Replace(pub.Curve.Params().Name, "-", "", 1)
+	default:
+		key = "unknown"
+	}
+	return newCertificateFingerprint(roleName, cert.Subject.CommonName, cert.DNSNames, cert.IPAddresses,
+		cert.EmailAddresses, key)
+}
+
+func (f *certificateFingerprint) indexPath() (string, error) {
+	raw, err := json.Marshal(f)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(raw)
+	return fingerprintsPath + hex.EncodeToString(hash[:]), nil
+}
+
+// indexCertificate records the stored certificate under its fingerprint. Only certificates stored with
+// an unencrypted private key are indexed since only they can be reused.
+func (b *backend) indexCertificate(ctx context.Context, s logical.Storage, roleName string, certPath string,
+	cert *x509.Certificate, privateKey string) error {
+
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil || x509.IsEncryptedPEMBlock(block) {
+		return nil
+	}
+
+	path, err := certificateFingerprintOf(roleName, cert).indexPath()
+	if err != nil {
+		return err
+	}
+	entry, err := logical.StorageEntryJSON(path, &fingerprintIndexEntry{
+		Path:     certPath,
+		NotAfter: cert.NotAfter,
+	})
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// unindexCertificate removes the fingerprint of the certificate if it still points to the stored certificate
+func (b *backend) unindexCertificate(ctx context.Context, s logical.Storage, roleName string, certPath string,
+	cert *x509.Certificate) error {
+
+	path, err := certificateFingerprintOf(roleName, cert).indexPath()
+	if err != nil {
+		return err
+	}
+	entry, err := s.Get(ctx, path)
+	if err != nil || entry == nil {
+		return err
+	}
+	var index fingerprintIndexEntry
+	if err := entry.DecodeJSON(&index); err != nil {
+		return err
+	}
+	if index.Path != certPath {
+		return nil
+	}
+	return s.Delete(ctx, path)
+}
+
+// findReusableCertificate looks up a stored certificate with the private key for the same request which is valid for
+// at least the role min_remaining_lifetime
+func (b *backend) findReusableCertificate(ctx context.Context, s logical.Storage, roleName string, role *roleEntry,
+	certReq *certificate.Request) (*VenafiCert, *x509.Certificate, error) {
+
+	fingerprint := requestFingerprintOf(roleName, certReq)
+	path, err := fingerprint.indexPath()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entry, err := s.Get(ctx, path)
+	if err != nil || entry == nil {
+		return nil, nil, err
+	}
+	var index fingerprintIndexEntry
+	if err := entry.DecodeJSON(&index); err != nil {
+		return nil, nil, err
+	}
+	if time.Until(index.NotAfter) <= role.MinRemainingLifetime {
+		return nil, nil, nil
+	}
+
+	entry, err = s.Get(ctx, index.Path)
+	if err != nil || entry == nil {
+		return nil, nil, err
+	}
+	var cert VenafiCert
+	if err := entry.DecodeJSON(&cert); err != nil {
+		return nil, nil, err
+	}
+	if cert.PrivateKey == "" || !strings.EqualFold(cert.CATemplate, certReq.CADN) {
+		return nil, nil, nil
+	}
+
+	// the stored certificate may have been replaced by another one, e.g. when certificates are stored by CN
+	block, _ := pem.Decode([]byte(cert.Certificate))
+	if block == nil {
+		return nil, nil, fmt.Errorf("can't decode certificate stored in %s", index.Path)
+	}
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	storedPath, err := certificateFingerprintOf(roleName, parsed).indexPath()
+	if err != nil {
+		return nil, nil, err
+	}
+	if storedPath != path || time.Until(parsed.NotAfter) <= role.MinRemainingLifetime {
+		return nil, nil, nil
+	}
+
+	return &cert, parsed, nil
+}
@@ -0,0 +1,107 @@
+package pki
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestReuseIfValid(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	createFakeRole(t, b, storage, "reuse", map[string]interface{}{
+		"store_by":               "cn",
+		"store_pkey":             true,
+		"reuse_if_valid":         true,
+		"min_remaining_lifetime": "720h",
+	})
+
+	issue := func(data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "issue/reuse",
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil || resp.IsError() {
+			t.Fatalf("failed to issue certificate: err: %v resp: %#v", err, resp)
+		}
+		return resp
+	}
+
+	first := issue(map[string]interface{}{
+		"common_name": "reuse.example.com",
+		"alt_names":   "www.reuse.example.com,reuse.example.com",
+	})
+	reused := issue(map[string]interface{}{
+		"common_name": "reuse.example.com",
+		"alt_names":   "reuse.example.com,www.reuse.example.com",
+	})
+	if reused.Data["serial_number"] != first.Data["serial_number"] || reused.Data["private_key"] != first.Data["private_key"] {
+		t.Fatal("valid certificate should be reused for the same request")
+	}
+
+	other := issue(map[string]interface{}{
+		"common_name": "reuse.example.com",
+	})
+	if other.Data["serial_number"] == first.Data["serial_number"] {
+		t.Fatal("certificate with different SANs should not be reused")
+	}
+
+	// the previous certificate stored under the same CN is replaced, so the index entry is stale now
+	again := issue(map[string]interface{}{
+		"common_name": "reuse.example.com",
+		"alt_names":   "www.reuse.example.com",
+	})
+	if again.Data["serial_number"] == first.Data["serial_number"] {
+		t.Fatal("replaced certificate should not be reused")
+	}
+
+	encrypted := issue(map[string]interface{}{
+		"common_name":  "reuse.example.com",
+		"key_password": "password",
+	})
+	if encrypted.Data["serial_number"] == other.Data["serial_number"] {
+		t.Fatal("certificate should not be reused when key_password is set")
+	}
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/reuse",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"venafi_secret":          "reuse",
+			"store_by":               "cn",
+			"store_pkey":             true,
+			"reuse_if_valid":         true,
+			"min_remaining_lifetime": "2400h",
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("failed to update role: err: %v resp: %#v", err, resp)
+	}
+	again = issue(map[string]interface{}{
+		"common_name": "reuse.example.com",
+		"alt_names":   "www.reuse.example.com",
+	})
+	last := issue(map[string]interface{}{
+		"common_name": "reuse.example.com",
+		"alt_names":   "www.reuse.example.com",
+	})
+	if again.Data["serial_number"] == last.Data["serial_number"] {
+		t.Fatal("certificate with less than min_remaining_lifetime should not be reused")
+	}
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/reuse",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"venafi_secret":  "reuse",
+			"reuse_if_valid": true,
+		},
+	})
+	if err != nil || resp == nil || !resp.IsError() || resp.Data["error"] != errorTextReuseRequiresStorePKey {
+		t.Fatalf("reuse_if_valid without store_pkey should be rejected, got err: %v resp: %#v", err, resp)
+	}
+}
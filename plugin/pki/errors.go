@@ -0,0 +1,155 @@
+package pki
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Venafi/vcert/pkg/endpoint"
+	"github.com/Venafi/vcert/pkg/verror"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+)
+
+// error codes in the response data of failed issue, sign and pickup requests
+const (
+	errorCodeInvalidRequest      = "invalid_request"
+	errorCodePolicyViolation     = "policy_violation"
+	errorCodeAuthFailed          = "venafi_auth_failed"
+	errorCodeZoneNotFound        = "zone_not_found"
+	errorCodePendingApproval     = "pending_approval"
+	errorCodeUpstreamUnavailable = "venafi_unavailable"
+	errorCodeTimeout             = "timeout"
+	errorCodeRateLimited         = "rate_limited"
+	errorCodeRequestInProgress   = "request_in_progress"
+)
+
+// errVenafiUnavailable is wrapped by the errors of requests refused by an open circuit breaker
+var errVenafiUnavailable = errors.New("Venafi endpoint unavailable")
+
+// venafiError is a failed Venafi request classified by its cause
+type venafiError struct {
+	code   string
+	status int
+	err    error
+
+	// pickupID is set when the request was saved for pickup
+	pickupID string
+}
+
+var _ logical.HTTPCodedError = (*venafiError)(nil)
+
+func (e *venafiError) Error() string {
+	return e.err.Error()
+}
+
+func (e *venafiError) Unwrap() error {
+	return e.err
+}
+
+// Code is the HTTP status of the error
+func (e *venafiError) Code() int {
+	return e.status
+}
+
+// classifyVenafiError maps the error of a Venafi call to an error code and an HTTP status
+func classifyVenafiError(err error) *venafiError {
+	var classified *venafiError
+	if errors.As(err, &classified) {
+		return classified
+	}
+
+	var pendingErr endpoint.ErrCertificatePending
+	var timeoutErr endpoint.ErrRetrieveCertificateTimeout
+	status := ""
+	if match := statusCodeRegex.FindStringSubmatch(err.Error()); match != nil {
+		status = match[1]
+	}
+
+	switch {
+	case errors.As(err, &pendingErr):
+		return &venafiError{code: errorCodePendingApproval, status: http.StatusConflict, err: err}
+	case errors.As(err, &timeoutErr) || errors.Is(err, context.DeadlineExceeded):
+		return &venafiError{code: errorCodeTimeout, status: http.StatusGatewayTimeout, err: err}
+	case errors.Is(err, verror.AuthError) || status == "401" || status == "403":
+		return &venafiError{code: errorCodeAuthFailed, status: http.StatusForbidden, err: err}
+	case errors.Is(err, verror.ZoneNotFoundError):
+		return &venafiError{code: errorCodeZoneNotFound, status: http.StatusNotFound, err: err}
+	case errors.Is(err, errVenafiUnavailable) || isConnectionError(err) || isTransientVenafiError(err):
+		return &venafiError{code: errorCodeUpstreamUnavailable, status: http.StatusServiceUnavailable, err: err}
+	case errors.Is(err, verror.PolicyValidationError):
+		return &venafiError{code: errorCodePolicyViolation, status: http.StatusBadRequest, err: err}
+	}
+	return &venafiError{code: errorCodeInvalidRequest, status: http.StatusBadRequest, err: err}
+}
+
+// venafiErrorResponse is the response to a failed request. It's sent with the HTTP status of the error class and has
+// the message, the error code and the pickup ID of a request saved for pickup in the data, so clients can tell the
+// failures apart.
+func venafiErrorResponse(req *logical.Request, err error) (*logical.Response, error) {
+	// the request is forwarded to the primary, which can write the tokens of the venafi secret
+	if errors.Is(err, logical.ErrReadOnly) {
+		return nil, err
+	}
+	classified := classifyVenafiError(err)
+	resp := logical.ErrorResponse(classified.Error())
+	resp.Data["error_code"] = classified.code
+	if classified.pickupID != "" {
+		resp.Data["pickup_id"] = classified.pickupID
+	}
+	return logical.RespondWithStatusCode(resp, req, classified.status)
+}
+
+// invalidRequest classifies the refusal of the request parameters as an invalid request
+func invalidRequest(err error) error {
+	return &venafiError{code: errorCodeInvalidRequest, status: http.StatusBadRequest, err: err}
+}
+
+// venafiErrorf is a venafi error of the code with the formatted message
+func venafiErrorf(code string, status int, format string, args ...interface{}) *venafiError {
+	return &venafiError{code: code, status: status, err: fmt.Errorf(format, args...)}
+}
+
+// policyViolation classifies the refusal of the request by the role restrictions as a policy violation
+func policyViolation(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &venafiError{code: errorCodePolicyViolation, status: http.StatusBadRequest, err: err}
+}
+
+// savedForPickup sets the pickup ID of the request the error is returned for
+func (e *venafiError) savedForPickup(pickupID string) *venafiError {
+	e.pickupID = pickupID
+	return e
+}
+
+// failedResponseData is the data of the failed request response, including the ones made by venafiErrorResponse.
+// It's nil if the request didn't fail.
+func failedResponseData(resp *logical.Response) map[string]interface{} {
+	if resp == nil {
+		return nil
+	}
+	if resp.IsError() {
+		return resp.Data
+	}
+	status, ok := resp.Data[logical.HTTPStatusCode].(int)
+	if !ok || status < http.StatusBadRequest {
+		return nil
+	}
+
+	var body logical.HTTPResponse
+	raw, _ := resp.Data[logical.HTTPRawBody].(string)
+	if err := json.Unmarshal([]byte(raw), &body); err != nil || body.Data == nil {
+		return map[string]interface{}{"error": fmt.Sprintf("request failed with status %d", status)}
+	}
+	return body.Data
+}
+
+// failedResponseError is the error message of the failed request
+func failedResponseError(resp *logical.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprint(failedResponseData(resp)["error"])
+}
@@ -0,0 +1,107 @@
+package pki
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/Venafi/vcert/pkg/endpoint"
+	"github.com/Venafi/vcert/pkg/verror"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestClassifyVenafiError(t *testing.T) {
+	cases := []struct {
+		err    error
+		code   string
+		status int
+	}{
+		{errors.New("Invalid chain option"), errorCodeInvalidRequest, http.StatusBadRequest},
+		{errors.New("common name test.example.com is not allowed in this policy: [.*.venafi.com]"), errorCodeInvalidRequest, http.StatusBadRequest},
+		{policyViolation(errors.New("name test.example.org is not allowed by allowed_domains of the role")), errorCodePolicyViolation, http.StatusBadRequest},
+		{fmt.Errorf("%w: key size", verror.PolicyValidationError), errorCodePolicyViolation, http.StatusBadRequest},
+		{fmt.Errorf("%w: wrong password", verror.AuthError), errorCodeAuthFailed, http.StatusForbidden},
+		{errors.New("unexpected status code on TPP Authorize. Status: 401 Unauthorized"), errorCodeAuthFailed, http.StatusForbidden},
+		{verror.ZoneNotFoundError, errorCodeZoneNotFound, http.StatusNotFound},
+		{endpoint.ErrCertificatePending{CertificateID: "id", Status: "WaitingForApproval"}, errorCodePendingApproval, http.StatusConflict},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, errorCodeUpstreamUnavailable, http.StatusServiceUnavailable},
+		{fmt.Errorf(errorTextCircuitOpen, errVenafiUnavailable, 5, "secret", "timeout", "now"), errorCodeUpstreamUnavailable, http.StatusServiceUnavailable},
+		{endpoint.ErrRetrieveCertificateTimeout{CertificateID: "id"}, errorCodeTimeout, http.StatusGatewayTimeout},
+		{context.DeadlineExceeded, errorCodeTimeout, http.StatusGatewayTimeout},
+	}
+	for _, c := range cases {
+		classified := classifyVenafiError(c.err)
+		if classified.code != c.code || classified.Code() != c.status {
+			t.Errorf("expected %s (%d) for error %v, got %s (%d)", c.code, c.status, c.err, classified.code, classified.Code())
+		}
+	}
+}
+
+func TestVenafiErrorResponse(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	createFakeRole(t, b, storage, "errors", map[string]interface{}{"allowed_domains": "example.com,venafi.com", "allow_subdomains": true})
+
+	issue := func(data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "issue/errors",
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	checkFailed := func(resp *logical.Response, status int, code string) map[string]interface{} {
+		t.Helper()
+		data := failedResponseData(resp)
+		if resp.Data[logical.HTTPStatusCode] != status || data == nil || data["error_code"] != code || data["error"] == "" {
+			t.Fatalf("expected status %d with error code %s, got %#v", status, code, resp.Data)
+		}
+		return data
+	}
+
+	// refused by allowed_domains of the role
+	checkFailed(issue(map[string]interface{}{"common_name": "test.example.org"}), http.StatusBadRequest,
+		errorCodePolicyViolation)
+
+	// the fake connector refuses certificates for venafi.com
+	checkFailed(issue(map[string]interface{}{"common_name": "test.venafi.com"}), http.StatusBadRequest,
+		errorCodeInvalidRequest)
+
+	// parameters refused before Venafi is called are classified too
+	checkFailed(issue(map[string]interface{}{"common_name": "test.example.com", "object_name": "name"}),
+		http.StatusBadRequest, errorCodePolicyViolation)
+
+	// the pickup ID of the request saved for pickup is in the data
+	req := &logical.Request{Storage: storage}
+	pending := &pendingRequest{ID: "id", Role: "errors", PickupID: `\VED\Policy\test`}
+	resp, err := b.suspendIssuance(context.Background(), req, pending, "",
+		endpoint.ErrRetrieveCertificateTimeout{CertificateID: pending.PickupID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := checkFailed(resp, http.StatusGatewayTimeout, errorCodeTimeout); data["pickup_id"] != "id" {
+		t.Fatalf("expected pickup ID in the data, got %#v", data)
+	}
+}
+
+// codedErrorResponse turns the failed response made by venafiErrorResponse, and the coded error, into an error
+// response, other errors fail the test
+func codedErrorResponse(t *testing.T, resp *logical.Response, err error) *logical.Response {
+	t.Helper()
+	if err != nil {
+		if _, ok := err.(logical.HTTPCodedError); !ok {
+			t.Fatal(err)
+		}
+		return logical.ErrorResponse(err.Error())
+	}
+	if data := failedResponseData(resp); data != nil && !resp.IsError() {
+		return logical.ErrorResponse(fmt.Sprint(data["error"]))
+	}
+	return resp
+}
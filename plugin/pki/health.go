@@ -0,0 +1,258 @@
+package pki
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const vcertModulePath = "github.com/Venafi/vcert"
+
+// pluginVersion is set at build time with -ldflags "-X github.com/Venafi/vault-pki-backend-venafi/plugin/pki.pluginVersion=<version>".
+// Without it the version of the main module is reported.
+var pluginVersion = ""
+
+// secretHealth is the cached result of calls to the Venafi endpoint of a venafi secret
+type secretHealth struct {
+	lastSuccess   time.Time
+	lastError     string
+	lastErrorTime time.Time
+	pinged        time.Time
+	pingLatency   time.Duration
+	pingError     string
+}
+
+func pathVenafiHealth(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "health$",
+		Fields: map[string]*framework.FieldSchema{
+			"probe": {
+				Type:        framework.TypeBool,
+				Description: "Ping the Venafi endpoint of every venafi secret instead of reporting cached results only",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathVenafiHealthRead,
+		},
+
+		HelpSynopsis:    pathVenafiHealthHelpSyn,
+		HelpDescription: pathVenafiHealthHelpDesc,
+	}
+}
+
+// versions returns the version of the plugin and of the vcert library it's built with
+func versions() (string, string) {
+	plugin, vcertVersion := pluginVersion, "unknown"
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		if plugin == "" {
+			plugin = "unknown"
+		}
+		return plugin, vcertVersion
+	}
+
+	if plugin == "" {
+		plugin = info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == vcertModulePath {
+			vcertVersion = dep.Version
+			if dep.Replace != nil {
+				vcertVersion = dep.Replace.Version
+			}
+		}
+	}
+	return plugin, vcertVersion
+}
+
+// recordSecretHealth remembers the result of the call to the Venafi endpoint of the secret
+func (b *backend) recordSecretHealth(secretName string, err error) {
+	b.healthLock.Lock()
+	defer b.healthLock.Unlock()
+
+	health := b.secretHealthLocked(secretName)
+	if err != nil {
+		health.lastError = err.Error()
+		health.lastErrorTime = time.Now()
+	} else {
+		health.lastSuccess = time.Now()
+	}
+}
+
+func (b *backend) recordPing(secretName string, latency time.Duration, err error) {
+	b.healthLock.Lock()
+	defer b.healthLock.Unlock()
+
+	health := b.secretHealthLocked(secretName)
+	health.pinged = time.Now()
+	health.pingLatency = latency
+	health.pingError = ""
+	if err != nil {
+		health.pingError = err.Error()
+	}
+}
+
+func (b *backend) secretHealthLocked(secretName string) *secretHealth {
+	if b.health == nil {
+		b.health = make(map[string]*secretHealth)
+	}
+	health, ok := b.health[secretName]
+	if !ok {
+		health = &secretHealth{}
+		b.health[secretName] = health
+	}
+	return health
+}
+
+// forgetSecretHealth drops the cached results, e.g. when the venafi secret is changed
+func (b *backend) forgetSecretHealth(secretName string) {
+	b.healthLock.Lock()
+	defer b.healthLock.Unlock()
+	delete(b.health, secretName)
+}
+
+// pingVenafiSecret measures the latency of Ping to the Venafi endpoint of the secret. Credentials are not used.
+func (b *backend) pingVenafiSecret(secretName string, venafiSecret *venafiSecretEntry) {
+	cfg, err := b.getConnectionConfig(venafiSecret)
+	if err != nil {
+		b.recordPing(secretName, 0, err)
+		return
+	}
+	cl, err := newConnector(cfg)
+	if err != nil {
+		b.recordPing(secretName, 0, err)
+		return
+	}
+
+	started := time.Now()
+	err = cl.Ping()
+	b.recordPing(secretName, time.Since(started), err)
+}
+
+// trustBundleExpiry is the earliest expiration of the certificates in the trust bundle of the secret
+func trustBundleExpiry(venafiSecret *venafiSecretEntry) (time.Time, error) {
+	bundle, err := venafiSecret.getTrustBundlePEM()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var expiry time.Time
+	rest := []byte(bundle)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+			expiry = cert.NotAfter
+		}
+	}
+	return expiry, nil
+}
+
+func formatHealthTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (b *backend) secretHealthData(secretName string, venafiSecret *venafiSecretEntry) map[string]interface{} {
+	data := map[string]interface{}{
+		"connector":       connectorLabel(venafiSecret.connectorType()),
+		"circuit_breaker": b.circuitStatus(secretName),
+		"token_expiry":    formatHealthTime(venafiSecret.AccessTokenExpires),
+	}
+
+	expiry, err := trustBundleExpiry(venafiSecret)
+	if err != nil {
+		data["trust_bundle_error"] = err.Error()
+	}
+	data["trust_bundle_expiry"] = formatHealthTime(expiry)
+
+	b.healthLock.Lock()
+	defer b.healthLock.Unlock()
+	health, ok := b.health[secretName]
+	if !ok {
+		health = &secretHealth{}
+	}
+	data["last_success"] = formatHealthTime(health.lastSuccess)
+	data["last_error"] = health.lastError
+	data["last_error_time"] = formatHealthTime(health.lastErrorTime)
+	data["pinged"] = formatHealthTime(health.pinged)
+	if !health.pinged.IsZero() {
+		data["ping_latency_ms"] = health.pingLatency.Milliseconds()
+		data["ping_error"] = health.pingError
+	}
+	return data
+}
+
+func (b *backend) pathVenafiHealthRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, CredentialsRootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	venafiSecrets := make(map[string]*venafiSecretEntry)
+	for _, name := range names {
+		venafiSecret, err := b.getVenafiSecret(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if venafiSecret != nil {
+			venafiSecrets[name] = venafiSecret
+		}
+	}
+
+	if data.Get("probe").(bool) {
+		var wg sync.WaitGroup
+		for name, venafiSecret := range venafiSecrets {
+			wg.Add(1)
+			go func(name string, venafiSecret *venafiSecretEntry) {
+				defer wg.Done()
+				b.pingVenafiSecret(name, venafiSecret)
+			}(name, venafiSecret)
+		}
+		wg.Wait()
+	}
+
+	secrets := make(map[string]interface{})
+	for name, venafiSecret := range venafiSecrets {
+		secrets[name] = b.secretHealthData(name, venafiSecret)
+	}
+
+	plugin, vcertVersion := versions()
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"plugin_version": plugin,
+			"vcert_version":  vcertVersion,
+			"secrets":        secrets,
+		},
+	}, nil
+}
+
+const pathVenafiHealthHelpSyn = `
+Report the status of the Venafi connections.
+`
+
+const pathVenafiHealthHelpDesc = `
+For every venafi secret reports the connector type, the time of the last successful call and the last
+error, the expiry of the access token (if it was obtained by the plugin) and of the trust bundle, the
+state of the circuit breaker and the latency of the last ping.
+
+Results of the calls made by issue, sign and pickup requests are cached. Read with probe=true to ping
+every Venafi endpoint now. The versions of the plugin and of the vcert library are reported as well.
+`
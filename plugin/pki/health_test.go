@@ -0,0 +1,103 @@
+package pki
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Venafi/vcert/pkg/venafi/tpp"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestHealth(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+	createFakeRole(t, b, storage, "fake", nil)
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "issue/fake",
+		Storage:   storage,
+		Data:      map[string]interface{}{"common_name": "health.example.com"},
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to issue certificate: err: %v resp: %#v", err, resp)
+	}
+
+	// nothing listens on the port, so the ping fails fast
+	bundlePEM, _ := generateSelfSignedPair(t, "tpp-ca.venafi.example")
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      CredentialsRootPath + "tpp",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"url":          "https://127.0.0.1:1",
+			"zone":         "devops\\vcert",
+			"access_token": "foo123bar==",
+			"trust_bundle": bundlePEM,
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("failed to write venafi secret: err: %v resp: %#v", err, resp)
+	}
+	tokenExpires := time.Now().Add(time.Hour).Truncate(time.Second)
+	err = storeVenafiSecretAccessData(b, ctx, &logical.Request{Storage: storage}, "tpp", tpp.OauthRefreshAccessTokenResponse{
+		Access_token:  "new-token",
+		Refresh_token: "new-refresh-token",
+		Expires:       int(tokenExpires.Unix()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readHealth := func(probe bool) map[string]interface{} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "health",
+			Storage:   storage,
+			Data:      map[string]interface{}{"probe": probe},
+		})
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("failed to read health: err: %v resp: %#v", err, resp)
+		}
+		if resp.Data["plugin_version"] == "" || resp.Data["vcert_version"] == "" {
+			t.Fatalf("expected versions, got %#v", resp.Data)
+		}
+		return resp.Data["secrets"].(map[string]interface{})
+	}
+
+	secrets := readHealth(false)
+	fake := secrets["fake"].(map[string]interface{})
+	if fake["connector"] != "fake" || fake["last_success"] == nil || fake["last_error"] != "" {
+		t.Fatalf("unexpected health of fake secret %#v", fake)
+	}
+	if fake["circuit_breaker"].(map[string]interface{})["state"] != circuitClosed {
+		t.Fatalf("expected closed circuit breaker, got %#v", fake["circuit_breaker"])
+	}
+	if _, ok := fake["ping_latency_ms"]; ok {
+		t.Fatal("ping should not be reported before probe")
+	}
+
+	tppHealth := secrets["tpp"].(map[string]interface{})
+	if tppHealth["connector"] != "tpp" || tppHealth["last_success"] != nil {
+		t.Fatalf("unexpected health of tpp secret %#v", tppHealth)
+	}
+	if tppHealth["token_expiry"] != tokenExpires.UTC().Format(time.RFC3339) || tppHealth["trust_bundle_expiry"] == nil {
+		t.Fatalf("expected token and trust bundle expiry, got %#v", tppHealth)
+	}
+
+	secrets = readHealth(true)
+	fake = secrets["fake"].(map[string]interface{})
+	if fake["ping_error"] != "" || fake["pinged"] == nil {
+		t.Fatalf("ping of fake secret should succeed, got %#v", fake)
+	}
+	tppHealth = secrets["tpp"].(map[string]interface{})
+	if tppHealth["ping_error"] == "" || tppHealth["pinged"] == nil {
+		t.Fatalf("ping of unreachable endpoint should fail, got %#v", tppHealth)
+	}
+
+	// ping results are cached
+	if readHealth(false)["tpp"].(map[string]interface{})["ping_error"] != tppHealth["ping_error"] {
+		t.Fatal("ping result should be cached")
+	}
+}
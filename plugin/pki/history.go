@@ -0,0 +1,434 @@
+package pki
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Events are kept under history/<day>/<unix nanoseconds>-<id>, so time range queries and pruning
+// only read the days they need.
+const (
+	historyPath      = "history/"
+	historyDayLayout = "2006-01-02"
+
+	historyEventIssued  = "issued"
+	historyEventSigned  = "signed"
+	historyEventRenewed = "renewed"
+	historyEventRevoked = "revoked"
+	historyEventDeleted = "deleted"
+
+	historyOutcomeSuccess = "success"
+	historyOutcomeFailure = "failure"
+
+	// defaultHistoryLimit and maxHistoryLimit are the number of events returned by a history query
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+var historyEvents = []string{historyEventIssued, historyEventSigned, historyEventRenewed, historyEventRevoked,
+	historyEventDeleted}
+
+// historyEvent is an entry of the append-only certificate history
+type historyEvent struct {
+	ID             string    `json:"id"`
+	Time           time.Time `json:"time"`
+	Event          string    `json:"event"`
+	Role           string    `json:"role"`
+	VenafiSecret   string    `json:"venafi_secret"`
+	SerialNumber   string    `json:"serial_number"`
+	CommonName     string    `json:"common_name"`
+	Requester      string    `json:"requester"`
+	EntityID       string    `json:"entity_id"`
+	Outcome        string    `json:"outcome"`
+	Error          string    `json:"error"`
+	PreviousSerial string    `json:"previous_serial_number"`
+	Certificate    string    `json:"certificate"`
+}
+
+// historyFilter selects events of the history query
+type historyFilter struct {
+	serialNumber string
+	commonName   string
+	role         string
+	event        string
+	start        time.Time
+	end          time.Time
+
+	// limit is the maximum number of returned events, 0 returns all of them
+	limit int
+	// after is the continuation token of the previous query, only events after it are returned
+	after string
+}
+
+func pathVenafiHistory(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "history/?$",
+		Fields: map[string]*framework.FieldSchema{
+			"serial_number": {
+				Type:        framework.TypeString,
+				Description: "Only return events of the certificate with this serial number",
+			},
+			"common_name": {
+				Type:        framework.TypeString,
+				Description: "Only return events of certificates with this common name",
+			},
+			"role": {
+				Type:        framework.TypeString,
+				Description: "Only return events of this role",
+			},
+			"event": {
+				Type:        framework.TypeString,
+				Description: fmt.Sprintf("Only return events of this type, one of %s", strings.Join(historyEvents, ", ")),
+			},
+			"start": {
+				Type:        framework.TypeString,
+				Description: "Only return events at or after this time, in RFC3339 format",
+			},
+			"end": {
+				Type:        framework.TypeString,
+				Description: "Only return events before this time, in RFC3339 format",
+			},
+			"limit": {
+				Type:        framework.TypeInt,
+				Default:     defaultHistoryLimit,
+				Description: fmt.Sprintf("Maximum number of returned events, up to %d", maxHistoryLimit),
+			},
+			"after": {
+				Type:        framework.TypeString,
+				Description: "Continuation token returned as next by the previous query, only later events are returned",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathVenafiHistoryRead,
+		},
+
+		HelpSynopsis:    pathVenafiHistoryHelpSyn,
+		HelpDescription: pathVenafiHistoryHelpDesc,
+	}
+}
+
+// recordHistory appends the event to the history. History is not allowed to fail the operation, so errors are logged only.
+func (b *backend) recordHistory(ctx context.Context, req *logical.Request, event *historyEvent) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		b.Logger().Warn("Can't record certificate history: " + err.Error())
+		return
+	}
+
+	event.ID = id
+	event.Time = time.Now().UTC()
+	event.Requester = req.DisplayName
+	event.EntityID = req.EntityID
+	if event.Outcome == "" {
+		event.Outcome = historyOutcomeSuccess
+	}
+
+	entry, err := logical.StorageEntryJSON(historyKey(event.Time, id), event)
+	if err == nil {
+		err = req.Storage.Put(ctx, entry)
+	}
+	if err != nil {
+		b.Logger().Warn(fmt.Sprintf("Can't record %s event of %s in certificate history: %s", event.Event,
+			event.CommonName, err))
+	}
+	b.countCertificateEvent(ctx, req.Storage, event)
+}
+
+func historyKey(t time.Time, id string) string {
+	return fmt.Sprintf("%s%s/%020d-%s", historyPath, t.Format(historyDayLayout), t.UnixNano(), id)
+}
+
+// historyKeyTime is the time of the event encoded in the key of the day bucket
+func historyKeyTime(key string) (time.Time, error) {
+	nanos, err := strconv.ParseInt(strings.SplitN(key, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed history key %s", key)
+	}
+	return time.Unix(0, nanos).UTC(), nil
+}
+
+// historyDays lists the day buckets in order
+func historyDays(ctx context.Context, s logical.Storage) ([]string, error) {
+	days, err := s.List(ctx, historyPath)
+	if err != nil {
+		return nil, err
+	}
+	for i := range days {
+		days[i] = strings.TrimSuffix(days[i], "/")
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// queryHistory returns the events matching the filter in order. When the limit of the filter is reached, the
+// continuation token of the next query is returned as well.
+func (b *backend) queryHistory(ctx context.Context, s logical.Storage, filter *historyFilter) ([]*historyEvent, string,
+	error) {
+
+	days, err := historyDays(ctx, s)
+	if err != nil {
+		return nil, "", err
+	}
+
+	events := []*historyEvent{}
+	for _, day := range days {
+		if filter.after != "" && day < strings.SplitN(filter.after, "/", 2)[0] {
+			continue
+		}
+		if !filter.start.IsZero() && day < filter.start.Format(historyDayLayout) {
+			continue
+		}
+		if !filter.end.IsZero() && day > filter.end.Format(historyDayLayout) {
+			continue
+		}
+
+		keys, err := s.List(ctx, historyPath+day+"/")
+		if err != nil {
+			return nil, "", err
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if filter.after != "" && day+"/"+key <= filter.after {
+				continue
+			}
+			t, err := historyKeyTime(key)
+			if err != nil {
+				b.Logger().Warn(err.Error())
+				continue
+			}
+			if (!filter.start.IsZero() && t.Before(filter.start)) || (!filter.end.IsZero() && !t.Before(filter.end)) {
+				continue
+			}
+
+			entry, err := s.Get(ctx, historyPath+day+"/"+key)
+			if err != nil {
+				return nil, "", err
+			}
+			if entry == nil {
+				continue
+			}
+			var event historyEvent
+			if err := entry.DecodeJSON(&event); err != nil {
+				return nil, "", err
+			}
+			if !filter.matches(&event) {
+				continue
+			}
+			events = append(events, &event)
+			if filter.limit > 0 && len(events) == filter.limit {
+				return events, day + "/" + key, nil
+			}
+		}
+	}
+	return events, "", nil
+}
+
+func (f *historyFilter) matches(event *historyEvent) bool {
+	if f.serialNumber != "" && normalizeSerial(f.serialNumber) != normalizeSerial(event.SerialNumber) &&
+		normalizeSerial(f.serialNumber) != normalizeSerial(event.PreviousSerial) {
+		return false
+	}
+	if f.commonName != "" && !strings.EqualFold(f.commonName, event.CommonName) {
+		return false
+	}
+	if f.role != "" && f.role != event.Role {
+		return false
+	}
+	if f.event != "" && f.event != event.Event {
+		return false
+	}
+	return true
+}
+
+// pruneHistory deletes the events older than the history_retention of the mount
+func (b *backend) pruneHistory(ctx context.Context, s logical.Storage) error {
+	config, err := b.getMountConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().UTC().Add(-config.HistoryRetention)
+	days, err := historyDays(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	pruned := 0
+	for _, day := range days {
+		if day > cutoff.Format(historyDayLayout) {
+			break
+		}
+		keys, err := s.List(ctx, historyPath+day+"/")
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			t, err := historyKeyTime(key)
+			if err == nil && !t.Before(cutoff) {
+				continue
+			}
+			if err := s.Delete(ctx, historyPath+day+"/"+key); err != nil {
+				return err
+			}
+			pruned++
+		}
+	}
+
+	if pruned > 0 {
+		b.Logger().Debug(fmt.Sprintf("Pruned %d certificate history events older than %s", pruned,
+			cutoff.Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// describeStoredCertificate fills the serial number and the common name of the event from the certificate stored
+// under certs/<uid>. It returns false if there is no such certificate.
+func (b *backend) describeStoredCertificate(ctx context.Context, s logical.Storage, uid string, event *historyEvent) bool {
+	event.CommonName = uid
+	entry, err := s.Get(ctx, "certs/"+uid)
+	if err != nil {
+		b.Logger().Warn(fmt.Sprintf("Can't read certificate %s: %s", uid, err))
+		return false
+	}
+	if entry == nil {
+		return false
+	}
+
+	var cert VenafiCert
+	if err := entry.DecodeJSON(&cert); err != nil {
+		b.Logger().Warn(fmt.Sprintf("Can't decode certificate %s: %s", uid, err))
+		return true
+	}
+	event.SerialNumber = cert.SerialNumber
+	event.Certificate = cert.Certificate
+	if block, _ := pem.Decode([]byte(cert.Certificate)); block != nil {
+		if parsed, err := x509.ParseCertificate(block.Bytes); err == nil {
+			event.CommonName = parsed.Subject.CommonName
+		}
+	}
+	return true
+}
+
+// periodicFunc is run by Vault every minute
+func (b *backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	if b.System().ReplicationState().HasState(consts.ReplicationPerformanceStandby | consts.ReplicationPerformanceSecondary) {
+		return nil
+	}
+	if err := b.updateExpiryMetrics(ctx, req.Storage); err != nil {
+		b.Logger().Warn("Can't update certificate expiry metrics: " + err.Error())
+	}
+	if err := b.pruneIdempotencyRecords(ctx, req.Storage); err != nil {
+		b.Logger().Warn("Can't prune idempotency records: " + err.Error())
+	}
+	return b.pruneHistory(ctx, req.Storage)
+}
+
+func (e *historyEvent) ToResponseData() map[string]interface{} {
+	data := map[string]interface{}{
+		"id":            e.ID,
+		"time":          e.Time.Format(time.RFC3339Nano),
+		"event":         e.Event,
+		"role":          e.Role,
+		"venafi_secret": e.VenafiSecret,
+		"serial_number": e.SerialNumber,
+		"common_name":   e.CommonName,
+		"requester":     e.Requester,
+		"entity_id":     e.EntityID,
+		"outcome":       e.Outcome,
+	}
+	if e.Error != "" {
+		data["error"] = e.Error
+	}
+	if e.PreviousSerial != "" {
+		data["previous_serial_number"] = e.PreviousSerial
+	}
+	if e.Certificate != "" {
+		data["certificate"] = e.Certificate
+	}
+	return data
+}
+
+func parseHistoryTime(data *framework.FieldData, field string) (time.Time, error) {
+	value := data.Get(field).(string)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q must be in RFC3339 format: %s", field, err)
+	}
+	return t.UTC(), nil
+}
+
+func (b *backend) pathVenafiHistoryRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	filter := &historyFilter{
+		serialNumber: data.Get("serial_number").(string),
+		commonName:   data.Get("common_name").(string),
+		role:         data.Get("role").(string),
+		event:        data.Get("event").(string),
+		limit:        data.Get("limit").(int),
+		after:        data.Get("after").(string),
+	}
+	if filter.limit <= 0 || filter.limit > maxHistoryLimit {
+		return logical.ErrorResponse(fmt.Sprintf(errorTextInvalidHistoryLimit, maxHistoryLimit)), nil
+	}
+	if filter.event != "" && !sliceContains(historyEvents, filter.event) {
+		return logical.ErrorResponse(fmt.Sprintf("unknown event %s, must be one of %s", filter.event,
+			strings.Join(historyEvents, ", "))), nil
+	}
+
+	var err error
+	if filter.start, err = parseHistoryTime(data, "start"); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if filter.end, err = parseHistoryTime(data, "end"); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	events, next, err := b.queryHistory(ctx, req.Storage, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	respEvents := make([]map[string]interface{}, 0, len(events))
+	for _, event := range events {
+		respEvents = append(respEvents, event.ToResponseData())
+	}
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"events": respEvents,
+		},
+	}
+	if next != "" {
+		resp.Data["next"] = next
+	}
+	return resp, nil
+}
+
+const errorTextInvalidHistoryLimit = `"limit" must be between 1 and %d`
+
+const pathVenafiHistoryHelpSyn = `
+Query the certificate history.
+`
+
+const pathVenafiHistoryHelpDesc = `
+Issued, signed, renewed, revoked and deleted certificates are recorded in the history, as well as
+failed issue and sign requests. The events have the time, role, venafi secret, serial number,
+common name, the requester and the outcome. Certificates replaced under certs/<common name> remain
+available in the history.
+
+Events can be filtered by serial_number, common_name, role, event and a time range with start and end
+in RFC3339 format. At most limit events are returned, 100 by default. When there may be more events,
+the response has the next token, which is passed as after to get the following events. Events are kept
+for history_retention of the config path. Issue and sign requests refused by the rate limits of the
+role are not recorded.
+`
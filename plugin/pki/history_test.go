@@ -0,0 +1,179 @@
+package pki
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestCertificateHistory(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	createFakeRole(t, b, storage, "history", map[string]interface{}{"store_by": "cn"})
+	ctx := context.Background()
+
+	issue := func(commonName string) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation:   logical.UpdateOperation,
+			Path:        "issue/history",
+			Storage:     storage,
+			DisplayName: "token-tester",
+			Data:        map[string]interface{}{"common_name": commonName},
+		})
+		return codedErrorResponse(t, resp, err)
+	}
+
+	query := func(filter map[string]interface{}) []map[string]interface{} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "history",
+			Storage:   storage,
+			Data:      filter,
+		})
+		if err != nil || resp.IsError() {
+			t.Fatalf("failed to query history: err: %v resp: %#v", err, resp)
+		}
+		return resp.Data["events"].([]map[string]interface{})
+	}
+
+	started := time.Now().UTC()
+	first := issue("history.example.com").Data["serial_number"].(string)
+	second := issue("history.example.com").Data["serial_number"].(string)
+	if !issue("history.venafi.com").IsError() {
+		t.Fatal("fake connector should refuse venafi.com certificates")
+	}
+
+	events := query(map[string]interface{}{"serial_number": first})
+	if len(events) != 2 || events[0]["event"] != historyEventIssued || events[1]["event"] != historyEventRenewed {
+		t.Fatalf("expected issued and renewed events of the first certificate, got %#v", events)
+	}
+	renewed := events[1]
+	if renewed["serial_number"] != second || renewed["previous_serial_number"] != first ||
+		renewed["requester"] != "token-tester" || renewed["venafi_secret"] != "history" || renewed["certificate"] == "" {
+		t.Fatalf("unexpected renewed event %#v", renewed)
+	}
+
+	events = query(map[string]interface{}{"common_name": "history.venafi.com"})
+	if len(events) != 1 || events[0]["outcome"] != historyOutcomeFailure || events[0]["error"] == nil {
+		t.Fatalf("expected failed issuance event, got %#v", events)
+	}
+
+	// the fake connector doesn't support revocation, so the failure is recorded
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "revoke/history",
+		Storage:   storage,
+		Data:      map[string]interface{}{"certificate_uid": "history.example.com"},
+	})
+	if !codedErrorResponse(t, resp, err).IsError() {
+		t.Fatal("revocation should fail in fake mode")
+	}
+	_, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "cert/history.example.com",
+		Storage:   storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events = query(map[string]interface{}{"serial_number": second})
+	if len(events) != 3 || events[1]["event"] != historyEventRevoked || events[2]["event"] != historyEventDeleted {
+		t.Fatalf("expected renewed, revoked and deleted events, got %#v", events)
+	}
+	if events[1]["venafi_secret"] != "history" || events[1]["outcome"] != historyOutcomeFailure {
+		t.Fatalf("failed revoked event should have the venafi secret of the role, got %#v", events[1])
+	}
+	if len(query(map[string]interface{}{"event": historyEventDeleted, "common_name": "HISTORY.example.com"})) != 1 {
+		t.Fatal("common name filter should be case insensitive")
+	}
+	if len(query(map[string]interface{}{"start": started.Add(-time.Second).Format(time.RFC3339)})) != 5 {
+		t.Fatal("all events should be in the time range")
+	}
+	if len(query(map[string]interface{}{"end": started.Add(-time.Second).Format(time.RFC3339)})) != 0 {
+		t.Fatal("no events should be before the start of the test")
+	}
+
+	// events older than the retention are pruned
+	old := &historyEvent{ID: "old", Time: time.Now().UTC().Add(-48 * time.Hour), Event: historyEventIssued}
+	entry, err := logical.StorageEntryJSON(historyKey(old.Time, old.ID), old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data:      map[string]interface{}{"history_retention": "24h"},
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to write config: err: %v resp: %#v", err, resp)
+	}
+	if len(query(nil)) != 6 {
+		t.Fatal("old event should be stored")
+	}
+	if err := b.periodicFunc(ctx, &logical.Request{Storage: storage}); err != nil {
+		t.Fatal(err)
+	}
+	if len(query(nil)) != 5 {
+		t.Fatal("old event should be pruned")
+	}
+
+	// the events are returned in pages
+	var paged []map[string]interface{}
+	after := ""
+	for page := 0; page < 5; page++ {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "history",
+			Storage:   storage,
+			Data:      map[string]interface{}{"limit": 2, "after": after},
+		})
+		if err != nil || resp.IsError() {
+			t.Fatalf("failed to query history: err: %v resp: %#v", err, resp)
+		}
+		paged = append(paged, resp.Data["events"].([]map[string]interface{})...)
+		next, ok := resp.Data["next"].(string)
+		if !ok {
+			break
+		}
+		after = next
+	}
+	all := query(nil)
+	if len(paged) != len(all) {
+		t.Fatalf("expected %d events in pages, got %d", len(all), len(paged))
+	}
+	for i := range all {
+		if paged[i]["id"] != all[i]["id"] {
+			t.Fatalf("pages should return the events in order, got %v at %d, expected %v", paged[i]["id"], i, all[i]["id"])
+		}
+	}
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "history",
+		Storage:   storage,
+		Data:      map[string]interface{}{"limit": maxHistoryLimit + 1},
+	})
+	if err != nil || !resp.IsError() {
+		t.Fatalf("limit above the maximum should be refused: err: %v resp: %#v", err, resp)
+	}
+
+	// requests refused by the rate limits are not recorded
+	createFakeRole(t, b, storage, "limited", map[string]interface{}{"max_issuances_per_minute": 1})
+	for i := 0; i < 3; i++ {
+		_, _ = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "issue/limited",
+			Storage:   storage,
+			Data:      map[string]interface{}{"common_name": "limited.example.com"},
+		})
+	}
+	events = query(map[string]interface{}{"role": "limited"})
+	if len(events) != 1 || events[0]["outcome"] != historyOutcomeSuccess {
+		t.Fatalf("only the issued certificate should be recorded, got %#v", events)
+	}
+}
@@ -0,0 +1,355 @@
+package pki
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	idempotencyPath            = "idempotency/"
+	defaultIdempotencyWindow   = 24 * time.Hour
+	idempotencyStatusRunning   = "in_progress"
+	idempotencyStatusPending   = "pending"
+	idempotencyStatusCompleted = "completed"
+
+	errorTextIdempotencyMismatch = "idempotency key %q was already used with different parameters"
+	errorTextIdempotencyRunning  = "request with idempotency key %q is in progress"
+	warningTextIdempotentReplay  = "result of the previous request with the same idempotency key is returned"
+	warningTextPrivateKeyDropped = "the private key is kept only by roles with store_pkey, it was returned to the first request only"
+
+	// idempotencyPruneInterval is how often the idempotency records are checked for expiration
+	idempotencyPruneInterval = time.Hour
+)
+
+// idempotencyRecord keeps the outcome of a request made with an idempotency key
+type idempotencyRecord struct {
+	Fingerprint string                 `json:"fingerprint"`
+	Status      string                 `json:"status"`
+	PickupID    string                 `json:"pickup_id,omitempty"`
+	Response    map[string]interface{} `json:"response,omitempty"`
+	Created     time.Time              `json:"created"`
+
+	// PrivateKeyDropped is set when the private key was removed from the saved response
+	PrivateKeyDropped bool `json:"private_key_dropped,omitempty"`
+
+	// Secret is the lease of the saved response, a replay gets a lease of the same certificate
+	Secret    *idempotentSecret `json:"secret,omitempty"`
+	Completed time.Time         `json:"completed,omitempty"`
+}
+
+// idempotentSecret is the lease of the response saved in an idempotency record
+type idempotentSecret struct {
+	InternalData map[string]interface{} `json:"internal_data"`
+	TTL          time.Duration          `json:"ttl"`
+}
+
+// idempotentRequest is the idempotency state of the current request
+type idempotentRequest struct {
+	path   string
+	record *idempotencyRecord
+
+	// pickupID is set when the certificate was requested but the request failed and was saved for pickup
+	pickupID string
+}
+
+// idempotencyRecordPath is the record of the idempotency key used by the requester, so the response of a request is
+// never returned to another client using the same key
+func idempotencyRecordPath(roleName string, requester string, key string) string {
+	hash := sha256.Sum256([]byte(requester + "\x00" + key))
+	return idempotencyPath + roleName + "/" + hex.EncodeToString(hash[:])
+}
+
+// idempotencyRequester identifies the client of the request by its entity, or by its token if it has no entity
+func idempotencyRequester(req *logical.Request) string {
+	if req.EntityID != "" {
+		return "entity:" + req.EntityID
+	}
+	return "accessor:" + req.ClientTokenAccessor
+}
+
+// requestFingerprint is a hash of all request parameters except the idempotency key
+func requestFingerprint(data *framework.FieldData) (string, error) {
+	params := make(map[string]interface{})
+	for name := range data.Schema {
+		if name == "idempotency_key" {
+			continue
+		}
+		params[name] = data.Get(name)
+	}
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(raw)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func (b *backend) getIdempotencyRecord(ctx context.Context, s logical.Storage, path string) (*idempotencyRecord, error) {
+	entry, err := s.Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var record idempotencyRecord
+	if err := entry.DecodeJSON(&record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (b *backend) putIdempotencyRecord(ctx context.Context, s logical.Storage, path string, record *idempotencyRecord) error {
+	entry, err := logical.StorageEntryJSON(path, record)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// startIdempotentRequest checks if a request with the same idempotency key was already made within the role window.
+// If so, the response of the previous request is returned. Otherwise the request is recorded as in progress.
+func (b *backend) startIdempotentRequest(ctx context.Context, req *logical.Request, data *framework.FieldData, roleName string,
+	role *roleEntry) (*idempotentRequest, *logical.Response, error) {
+
+	key, ok := data.GetOk("idempotency_key")
+	if !ok || key.(string) == "" {
+		return nil, nil, nil
+	}
+
+	fingerprint, err := requestFingerprint(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	idem := &idempotentRequest{
+		path: idempotencyRecordPath(roleName, idempotencyRequester(req), key.(string)),
+	}
+
+	b.idempotencyLock.Lock()
+	defer b.idempotencyLock.Unlock()
+
+	record, err := b.getIdempotencyRecord(ctx, req.Storage, idem.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	window := role.IdempotencyWindow
+	if window == 0 {
+		window = defaultIdempotencyWindow
+	}
+
+	if record != nil && time.Since(record.Created) < window {
+		if record.Fingerprint != fingerprint {
+			resp, err := venafiErrorResponse(req, invalidRequest(fmt.Errorf(errorTextIdempotencyMismatch, key)))
+			return nil, resp, err
+		}
+
+		switch record.Status {
+		case idempotencyStatusCompleted:
+			return nil, b.replayIdempotentResponse(record), nil
+		case idempotencyStatusPending:
+			pending, err := b.getPendingRequest(ctx, req.Storage, roleName, record.PickupID)
+			if err != nil {
+				return nil, nil, err
+			}
+			if pending != nil {
+				resp := pending.toResponse(statusPending)
+				resp.AddWarning(warningTextIdempotentReplay)
+				return nil, resp, nil
+			}
+		case idempotencyStatusRunning:
+			// the request may have been interrupted, so it's retried when it's older than the server timeout
+			if time.Since(record.Created) < role.ServerTimeout+time.Minute {
+				resp, err := venafiErrorResponse(req, venafiErrorf(errorCodeRequestInProgress, http.StatusConflict,
+					errorTextIdempotencyRunning, key))
+				return nil, resp, err
+			}
+		}
+	}
+
+	idem.record = &idempotencyRecord{
+		Fingerprint: fingerprint,
+		Status:      idempotencyStatusRunning,
+		Created:     time.Now().UTC(),
+	}
+	err = b.putIdempotencyRecord(ctx, req.Storage, idem.path, idem.record)
+	if err != nil {
+		return nil, nil, err
+	}
+	return idem, nil, nil
+}
+
+// replayIdempotentResponse is the saved response of a completed request. If the first response had a lease, the
+// replay gets a new lease of the same certificate which expires together with the first one.
+func (b *backend) replayIdempotentResponse(record *idempotencyRecord) *logical.Response {
+	resp := &logical.Response{Data: record.Response}
+	if record.Secret != nil {
+		ttl := record.Secret.TTL - time.Since(record.Completed)
+		if ttl > 0 {
+			resp = b.Secret(SecretCertsType).Response(record.Response, record.Secret.InternalData)
+			resp.Secret.TTL = ttl
+		}
+	}
+	resp.AddWarning(warningTextIdempotentReplay)
+	if record.PrivateKeyDropped {
+		resp.AddWarning(warningTextPrivateKeyDropped)
+	}
+	return resp
+}
+
+// savedForPickup records that the failed request was saved for pickup, so a retry with the same idempotency key gets
+// it instead of requesting another certificate
+func (idem *idempotentRequest) savedForPickup(pickupID string) {
+	if idem != nil {
+		idem.pickupID = pickupID
+	}
+}
+
+// finishIdempotentRequest saves the response for the next requests with the same idempotency key.
+// Failed requests are forgotten so they can be retried, unless they were saved for pickup.
+func (b *backend) finishIdempotentRequest(ctx context.Context, s logical.Storage, idem *idempotentRequest, role *roleEntry,
+	resp *logical.Response, respErr error) {
+
+	if idem == nil {
+		return
+	}
+
+	var err error
+	failed := respErr != nil || resp == nil || failedResponseData(resp) != nil
+	switch {
+	case failed && idem.pickupID != "":
+		// the certificate is still requested in Venafi, a retry must not request another one
+		idem.record.Status = idempotencyStatusPending
+		idem.record.PickupID = idem.pickupID
+		err = b.putIdempotencyRecord(ctx, s, idem.path, idem.record)
+	case failed:
+		err = s.Delete(ctx, idem.path)
+	case resp.Data["status"] == statusPending:
+		idem.record.Status = idempotencyStatusPending
+		idem.record.PickupID = resp.Data["pickup_id"].(string)
+		err = b.putIdempotencyRecord(ctx, s, idem.path, idem.record)
+	default:
+		idem.record.complete(role, resp)
+		err = b.putIdempotencyRecord(ctx, s, idem.path, idem.record)
+	}
+	if err != nil {
+		b.Logger().Warn(fmt.Sprintf("Can't save idempotency record %s: %s", idem.path, err))
+	}
+}
+
+// completeIdempotencyRecord saves the response of a picked up certificate to the idempotency record of the
+// asynchronous request.
+func (b *backend) completeIdempotencyRecord(ctx context.Context, s logical.Storage, path string, role *roleEntry,
+	resp *logical.Response) {
+
+	record, err := b.getIdempotencyRecord(ctx, s, path)
+	if err == nil && record != nil {
+		record.complete(role, resp)
+		err = b.putIdempotencyRecord(ctx, s, path, record)
+	}
+	if err != nil {
+		b.Logger().Warn(fmt.Sprintf("Can't save idempotency record %s: %s", path, err))
+	}
+}
+
+// complete saves the response and its lease in the record
+func (record *idempotencyRecord) complete(role *roleEntry, resp *logical.Response) {
+	record.Status = idempotencyStatusCompleted
+	record.Response, record.PrivateKeyDropped = idempotentResponseData(role, resp.Data)
+	record.Completed = time.Now().UTC()
+	record.Secret = nil
+	if resp.Secret != nil {
+		record.Secret = &idempotentSecret{
+			InternalData: resp.Secret.InternalData,
+			TTL:          resp.Secret.TTL,
+		}
+	}
+}
+
+// idempotentResponseData is the response saved in the idempotency record. The private key is kept only by roles which
+// store it with the certificate, otherwise it's removed, also from the PEM bundle of the PKI compatible response.
+func idempotentResponseData(role *roleEntry, data map[string]interface{}) (map[string]interface{}, bool) {
+	if role.StorePrivateKey && !role.NoStore {
+		return data, false
+	}
+	_, hasKey := data["private_key"]
+	if !hasKey {
+		return data, false
+	}
+
+	saved := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		saved[k] = v
+	}
+	delete(saved, "private_key")
+	if certificate, ok := saved["certificate"].(string); ok && strings.Contains(certificate, "PRIVATE KEY") {
+		var blocks []string
+		rest := []byte(certificate)
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if !strings.Contains(block.Type, "PRIVATE KEY") {
+				blocks = append(blocks, strings.TrimSpace(string(pem.EncodeToMemory(block))))
+			}
+		}
+		saved["certificate"] = strings.Join(blocks, "\n")
+	}
+	return saved, true
+}
+
+// pruneIdempotencyRecords deletes the records older than the idempotency window of their role. The records are checked
+// at most once in idempotencyPruneInterval.
+func (b *backend) pruneIdempotencyRecords(ctx context.Context, s logical.Storage) error {
+	if time.Since(b.idempotencyPruned) < idempotencyPruneInterval {
+		return nil
+	}
+
+	roles, err := s.List(ctx, idempotencyPath)
+	if err != nil {
+		return err
+	}
+	for _, roleDir := range roles {
+		roleName := strings.TrimSuffix(roleDir, "/")
+		window := defaultIdempotencyWindow
+		role, err := b.getRole(ctx, s, roleName)
+		if err != nil {
+			return err
+		}
+		if role != nil && role.IdempotencyWindow > 0 {
+			window = role.IdempotencyWindow
+		}
+
+		keys, err := s.List(ctx, idempotencyPath+roleDir)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			path := idempotencyPath + roleDir + key
+			b.idempotencyLock.Lock()
+			record, err := b.getIdempotencyRecord(ctx, s, path)
+			if err == nil && record != nil && time.Since(record.Created) >= window {
+				err = s.Delete(ctx, path)
+			}
+			b.idempotencyLock.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	b.idempotencyPruned = time.Now()
+	return nil
+}
@@ -0,0 +1,286 @@
+package pki
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Venafi/vcert/pkg/endpoint"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestIdempotentIssuance(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	createFakeRole(t, b, storage, "idempotent", map[string]interface{}{
+		"store_by":   "serial",
+		"store_pkey": true,
+	})
+
+	issue := func(data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "issue/idempotent",
+			Storage:   storage,
+			Data:      data,
+		})
+		return codedErrorResponse(t, resp, err)
+	}
+
+	first := issue(map[string]interface{}{
+		"common_name":     "idempotent.example.com",
+		"idempotency_key": "deploy-1",
+	})
+	if first.IsError() {
+		t.Fatalf("failed to issue certificate: %#v", first.Data)
+	}
+
+	retry := issue(map[string]interface{}{
+		"common_name":     "idempotent.example.com",
+		"idempotency_key": "deploy-1",
+	})
+	if retry.IsError() {
+		t.Fatalf("failed to retry request: %#v", retry.Data)
+	}
+	if retry.Data["serial_number"] != first.Data["serial_number"] || retry.Data["private_key"] != first.Data["private_key"] {
+		t.Fatal("retry should return the certificate of the first request")
+	}
+	if len(retry.Warnings) != 1 || retry.Warnings[0] != warningTextIdempotentReplay {
+		t.Fatalf("expected replay warning, got %v", retry.Warnings)
+	}
+
+	certs, err := storage.List(context.Background(), "certs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 {
+		t.Fatalf("expected one issued certificate, got %d", len(certs))
+	}
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "issue/idempotent",
+		Storage:   storage,
+		EntityID:  "other-entity",
+		Data: map[string]interface{}{
+			"common_name":     "idempotent.example.com",
+			"idempotency_key": "deploy-1",
+		},
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to issue certificate: err: %v resp: %#v", err, resp)
+	}
+	if resp.Data["serial_number"] == first.Data["serial_number"] {
+		t.Fatal("the response of the first request should not be returned to another requester")
+	}
+
+	mismatch := issue(map[string]interface{}{
+		"common_name":     "other.example.com",
+		"idempotency_key": "deploy-1",
+	})
+	if !mismatch.IsError() || !strings.Contains(mismatch.Data["error"].(string), "different parameters") {
+		t.Fatalf("request with different parameters should be rejected, got %#v", mismatch.Data)
+	}
+
+	other := issue(map[string]interface{}{
+		"common_name":     "idempotent.example.com",
+		"idempotency_key": "deploy-2",
+	})
+	if other.IsError() || other.Data["serial_number"] == first.Data["serial_number"] {
+		t.Fatalf("request with another key should issue a new certificate, got %#v", other.Data)
+	}
+
+	pending := issue(map[string]interface{}{
+		"common_name":     "async.example.com",
+		"idempotency_key": "deploy-3",
+		"async":           true,
+	})
+	if pending.IsError() {
+		t.Fatalf("failed to issue certificate: %#v", pending.Data)
+	}
+	retry = issue(map[string]interface{}{
+		"common_name":     "async.example.com",
+		"idempotency_key": "deploy-3",
+		"async":           true,
+	})
+	if retry.IsError() || retry.Data["pickup_id"] != pending.Data["pickup_id"] {
+		t.Fatalf("retry should return the pending request, got %#v", retry.Data)
+	}
+
+	picked, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "pickup/idempotent/" + pending.Data["pickup_id"].(string),
+		Storage:   storage,
+	})
+	if err != nil || picked.IsError() {
+		t.Fatalf("failed to pick up certificate: err: %v resp: %#v", err, picked)
+	}
+	retry = issue(map[string]interface{}{
+		"common_name":     "async.example.com",
+		"idempotency_key": "deploy-3",
+		"async":           true,
+	})
+	if retry.IsError() || retry.Data["serial_number"] != picked.Data["serial_number"] {
+		t.Fatalf("retry should return the picked up certificate, got %#v", retry.Data)
+	}
+}
+
+func TestIdempotentTimeout(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+	role := &roleEntry{VenafiSecret: "secret"}
+	pending := &pendingRequest{ID: "id", Role: "role", PickupID: `\VED\Policy\test`, PrivateKey: "key"}
+
+	req := &logical.Request{Storage: storage}
+	resp, err := b.suspendIssuance(ctx, req, pending, "", endpoint.ErrRetrieveCertificateTimeout{CertificateID: pending.PickupID})
+	if err != nil || failedResponseData(resp)["pickup_id"] != "id" {
+		t.Fatalf("timed out request should return error with pickup ID, got err: %v resp: %#v", err, resp)
+	}
+
+	// the request is saved for pickup, so a retry with the same key returns it instead of requesting another one
+	idem := &idempotentRequest{
+		path:     idempotencyRecordPath("role", "accessor:", "deploy-1"),
+		record:   &idempotencyRecord{Status: idempotencyStatusRunning},
+		pickupID: pending.ID,
+	}
+	b.finishIdempotentRequest(ctx, storage, idem, role, resp, err)
+	record, err := b.getIdempotencyRecord(ctx, storage, idem.path)
+	if err != nil || record == nil || record.Status != idempotencyStatusPending || record.PickupID != "id" {
+		t.Fatalf("expected pending idempotency record with the pickup ID, got %#v", record)
+	}
+}
+
+func TestIdempotentNoStore(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	createFakeRole(t, b, storage, "nostore", map[string]interface{}{
+		"no_store": true,
+	})
+
+	issue := func() *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "issue/nostore",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"common_name":     "nostore.example.com",
+				"idempotency_key": "deploy-1",
+			},
+		})
+		if err != nil || resp.IsError() {
+			t.Fatalf("failed to issue certificate: err: %v resp: %#v", err, resp)
+		}
+		return resp
+	}
+
+	first := issue()
+	if first.Data["private_key"] == "" {
+		t.Fatal("the first response should have the private key")
+	}
+	record, err := b.getIdempotencyRecord(context.Background(), storage, idempotencyRecordPath("nostore", "accessor:", "deploy-1"))
+	if err != nil || record == nil {
+		t.Fatalf("failed to read idempotency record: %v", err)
+	}
+	if _, ok := record.Response["private_key"]; ok {
+		t.Fatal("the private key should not be kept in the idempotency record of a no_store role")
+	}
+
+	retry := issue()
+	if retry.Data["serial_number"] != first.Data["serial_number"] {
+		t.Fatal("retry should return the certificate of the first request")
+	}
+	if _, ok := retry.Data["private_key"]; ok || len(retry.Warnings) != 2 || retry.Warnings[1] != warningTextPrivateKeyDropped {
+		t.Fatalf("retry should warn that the private key is not kept, got %v", retry.Warnings)
+	}
+
+	createFakeRole(t, b, storage, "nopkey", map[string]interface{}{})
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "issue/nopkey",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"common_name":     "nopkey.example.com",
+			"idempotency_key": "deploy-1",
+		},
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to issue certificate: err: %v resp: %#v", err, resp)
+	}
+	record, err = b.getIdempotencyRecord(context.Background(), storage, idempotencyRecordPath("nopkey", "accessor:", "deploy-1"))
+	if err != nil || record == nil {
+		t.Fatalf("failed to read idempotency record: %v", err)
+	}
+	if _, ok := record.Response["private_key"]; ok || !record.PrivateKeyDropped {
+		t.Fatal("the private key should not be kept in the idempotency record of a role without store_pkey")
+	}
+}
+
+func TestPruneIdempotencyRecords(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+
+	expired := idempotencyRecordPath("prune", "accessor:", "old")
+	recent := idempotencyRecordPath("prune", "accessor:", "new")
+	err := b.putIdempotencyRecord(ctx, storage, expired, &idempotencyRecord{
+		Status:  idempotencyStatusCompleted,
+		Created: time.Now().Add(-defaultIdempotencyWindow - time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.putIdempotencyRecord(ctx, storage, recent, &idempotencyRecord{
+		Status:  idempotencyStatusCompleted,
+		Created: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.pruneIdempotencyRecords(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+	if record, _ := b.getIdempotencyRecord(ctx, storage, expired); record != nil {
+		t.Fatal("the expired record should be deleted")
+	}
+	if record, _ := b.getIdempotencyRecord(ctx, storage, recent); record == nil {
+		t.Fatal("the record within the idempotency window should be kept")
+	}
+}
+
+func TestIdempotentLease(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	createFakeRole(t, b, storage, "lease", map[string]interface{}{
+		"generate_lease": true,
+		"ttl":            "1h",
+	})
+
+	issue := func() *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "issue/lease",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"common_name":     "lease.example.com",
+				"idempotency_key": "deploy-1",
+			},
+		})
+		if err != nil || resp.IsError() {
+			t.Fatalf("failed to issue certificate: err: %v resp: %#v", err, resp)
+		}
+		return resp
+	}
+
+	first := issue()
+	if first.Secret == nil {
+		t.Fatal("the first response should have a lease")
+	}
+	retry := issue()
+	if retry.Data["serial_number"] != first.Data["serial_number"] {
+		t.Fatal("retry should return the certificate of the first request")
+	}
+	if retry.Secret == nil || retry.Secret.InternalData["serial_number"] != first.Secret.InternalData["serial_number"] {
+		t.Fatalf("retry should return a lease of the first certificate, got %#v", retry.Secret)
+	}
+	if retry.Secret.TTL <= 0 || retry.Secret.TTL > first.Secret.TTL {
+		t.Fatalf("lease of the retry should not outlive the first lease, got %s", retry.Secret.TTL)
+	}
+}
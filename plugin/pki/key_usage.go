@@ -0,0 +1,258 @@
+package pki
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"strings"
+)
+
+var (
+	oidExtensionRequest          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 14}
+	oidExtensionKeyUsage         = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtensionExtendedKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
+	oidExtensionBasicConstraints = asn1.ObjectIdentifier{2, 5, 29, 19}
+	oidExtensionCertPolicies     = asn1.ObjectIdentifier{2, 5, 29, 32}
+)
+
+// keyUsages are the names of key usages accepted by key_usage of the role, as in the PKI secrets engine
+var keyUsages = map[string]x509.KeyUsage{
+	"digitalsignature":  x509.KeyUsageDigitalSignature,
+	"contentcommitment": x509.KeyUsageContentCommitment,
+	"keyencipherment":   x509.KeyUsageKeyEncipherment,
+	"dataencipherment":  x509.KeyUsageDataEncipherment,
+	"keyagreement":      x509.KeyUsageKeyAgreement,
+	"certsign":          x509.KeyUsageCertSign,
+	"crlsign":           x509.KeyUsageCRLSign,
+	"encipheronly":      x509.KeyUsageEncipherOnly,
+	"decipheronly":      x509.KeyUsageDecipherOnly,
+}
+
+// extKeyUsages are the names of extended key usages accepted by ext_key_usage of the role
+var extKeyUsages = map[string]struct {
+	usage x509.ExtKeyUsage
+	oid   asn1.ObjectIdentifier
+}{
+	"any":                        {x509.ExtKeyUsageAny, asn1.ObjectIdentifier{2, 5, 29, 37, 0}},
+	"serverauth":                 {x509.ExtKeyUsageServerAuth, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1}},
+	"clientauth":                 {x509.ExtKeyUsageClientAuth, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 2}},
+	"codesigning":                {x509.ExtKeyUsageCodeSigning, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 3}},
+	"emailprotection":            {x509.ExtKeyUsageEmailProtection, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 4}},
+	"ipsecendsystem":             {x509.ExtKeyUsageIPSECEndSystem, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 5}},
+	"ipsectunnel":                {x509.ExtKeyUsageIPSECTunnel, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 6}},
+	"ipsecuser":                  {x509.ExtKeyUsageIPSECUser, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 7}},
+	"timestamping":               {x509.ExtKeyUsageTimeStamping, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 8}},
+	"ocspsigning":                {x509.ExtKeyUsageOCSPSigning, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 9}},
+	"microsoftservergatedcrypto": {x509.ExtKeyUsageMicrosoftServerGatedCrypto, asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 10, 3, 3}},
+	"netscapeservergatedcrypto":  {x509.ExtKeyUsageNetscapeServerGatedCrypto, asn1.ObjectIdentifier{2, 16, 840, 1, 113730, 4, 1}},
+}
+
+func normalizeUsageName(name string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(name, "KeyUsage"), "ExtKeyUsage"))
+}
+
+func parseKeyUsage(names []string) (x509.KeyUsage, error) {
+	var usage x509.KeyUsage
+	for _, name := range names {
+		u, ok := keyUsages[normalizeUsageName(name)]
+		if !ok {
+			return 0, fmt.Errorf(errorTextInvalidKeyUsage, name)
+		}
+		usage |= u
+	}
+	return usage, nil
+}
+
+func parseOID(value string) (asn1.ObjectIdentifier, error) {
+	var oid asn1.ObjectIdentifier
+	for _, part := range strings.Split(value, ".") {
+		var n int
+		if _, err := fmt.Sscanf(part, "%d", &n); err != nil || fmt.Sprint(n) != part {
+			return nil, fmt.Errorf(errorTextInvalidOID, value)
+		}
+		oid = append(oid, n)
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf(errorTextInvalidOID, value)
+	}
+	return oid, nil
+}
+
+func parseOIDs(values []string) ([]asn1.ObjectIdentifier, error) {
+	oids := make([]asn1.ObjectIdentifier, 0, len(values))
+	for _, v := range values {
+		oid, err := parseOID(v)
+		if err != nil {
+			return nil, err
+		}
+		oids = append(oids, oid)
+	}
+	return oids, nil
+}
+
+// extKeyUsageOIDs returns the OIDs of ext_key_usage and ext_key_usage_oids of the role
+func extKeyUsageOIDs(role *roleEntry) ([]asn1.ObjectIdentifier, error) {
+	var oids []asn1.ObjectIdentifier
+	for _, name := range role.ExtKeyUsage {
+		eku, ok := extKeyUsages[normalizeUsageName(name)]
+		if !ok {
+			return nil, fmt.Errorf(errorTextInvalidExtKeyUsage, name)
+		}
+		oids = append(oids, eku.oid)
+	}
+	custom, err := parseOIDs(role.ExtKeyUsageOIDs)
+	if err != nil {
+		return nil, err
+	}
+	return append(oids, custom...), nil
+}
+
+func reverseBits(b byte) byte {
+	var r byte
+	for i := 0; i < 8; i++ {
+		r = r<<1 | b&1
+		b >>= 1
+	}
+	return r
+}
+
+// marshalKeyUsage encodes the key usage as the BIT STRING of the extension, bit 0 is digitalSignature
+func marshalKeyUsage(usage x509.KeyUsage) ([]byte, error) {
+	bytes := []byte{reverseBits(byte(usage)), reverseBits(byte(usage >> 8))}
+	if bytes[1] == 0 {
+		bytes = bytes[:1]
+	}
+	bitLength := len(bytes) * 8
+	for i := bitLength - 1; i >= 0 && bytes[i/8]&(0x80>>uint(i%8)) == 0; i-- {
+		bitLength--
+	}
+	return asn1.Marshal(asn1.BitString{Bytes: bytes, BitLength: bitLength})
+}
+
+// usageExtensions are the extensions requested in locally generated CSRs according to the key usage profile of the
+// role: key usage, extended key usage, basic constraints and certificate policies
+func usageExtensions(role *roleEntry) ([]pkix.Extension, error) {
+	var extensions []pkix.Extension
+
+	usage, err := parseKeyUsage(role.KeyUsage)
+	if err != nil {
+		return nil, err
+	}
+	if usage != 0 {
+		value, err := marshalKeyUsage(usage)
+		if err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, pkix.Extension{Id: oidExtensionKeyUsage, Value: value})
+	}
+
+	ekuOIDs, err := extKeyUsageOIDs(role)
+	if err != nil {
+		return nil, err
+	}
+	if len(ekuOIDs) > 0 {
+		value, err := asn1.Marshal(ekuOIDs)
+		if err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, pkix.Extension{Id: oidExtensionExtendedKeyUsage, Value: value})
+	}
+
+	if role.BasicConstraintsValidForNonCA {
+		// CA:FALSE is the default, so the sequence is empty
+		value, err := asn1.Marshal(struct {
+			IsCA bool `asn1:"optional"`
+		}{})
+		if err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, pkix.Extension{Id: oidExtensionBasicConstraints, Value: value})
+	}
+
+	policies, err := parseOIDs(role.PolicyIdentifiers)
+	if err != nil {
+		return nil, err
+	}
+	if len(policies) > 0 {
+		type policyInformation struct {
+			Policy asn1.ObjectIdentifier
+		}
+		infos := make([]policyInformation, 0, len(policies))
+		for _, policy := range policies {
+			infos = append(infos, policyInformation{Policy: policy})
+		}
+		value, err := asn1.Marshal(infos)
+		if err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, pkix.Extension{Id: oidExtensionCertPolicies, Value: value})
+	}
+	return extensions, nil
+}
+
+// extensionRequest is the CSR attribute requesting the extensions, vcert builds the CSR from the attributes of the
+// request. The SAN extension is added to it when the CSR is created. The attribute can't mark extensions critical,
+// the criticality is up to the CA.
+func extensionRequest(extensions []pkix.Extension) pkix.AttributeTypeAndValueSET {
+	values := make([]pkix.AttributeTypeAndValue, 0, len(extensions))
+	for _, ext := range extensions {
+		values = append(values, pkix.AttributeTypeAndValue{Type: ext.Id, Value: ext.Value})
+	}
+	return pkix.AttributeTypeAndValueSET{Type: oidExtensionRequest, Value: [][]pkix.AttributeTypeAndValue{values}}
+}
+
+func containsOID(oids []asn1.ObjectIdentifier, oid asn1.ObjectIdentifier) bool {
+	for _, o := range oids {
+		if o.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// missingUsages lists the usages of the role profile which the issued certificate doesn't have
+func missingUsages(role *roleEntry, cert *x509.Certificate) []string {
+	var missing []string
+
+	usage, _ := parseKeyUsage(role.KeyUsage)
+	for _, name := range role.KeyUsage {
+		u := keyUsages[normalizeUsageName(name)]
+		if usage&u != 0 && cert.KeyUsage&u == 0 {
+			missing = append(missing, name)
+		}
+	}
+
+	issued := append([]asn1.ObjectIdentifier{}, cert.UnknownExtKeyUsage...)
+	for _, u := range cert.ExtKeyUsage {
+		for _, eku := range extKeyUsages {
+			if eku.usage == u {
+				issued = append(issued, eku.oid)
+			}
+		}
+	}
+	for _, name := range role.ExtKeyUsage {
+		if eku, ok := extKeyUsages[normalizeUsageName(name)]; ok && !containsOID(issued, eku.oid) {
+			missing = append(missing, name)
+		}
+	}
+	for _, value := range role.ExtKeyUsageOIDs {
+		if oid, err := parseOID(value); err == nil && !containsOID(issued, oid) {
+			missing = append(missing, value)
+		}
+	}
+
+	for _, value := range role.PolicyIdentifiers {
+		if oid, err := parseOID(value); err == nil && !containsOID(cert.PolicyIdentifiers, oid) {
+			missing = append(missing, "policy "+value)
+		}
+	}
+	return missing
+}
+
+const (
+	errorTextInvalidKeyUsage    = "invalid key usage %q"
+	errorTextInvalidExtKeyUsage = "invalid extended key usage %q"
+	errorTextInvalidOID         = "invalid OID %q"
+	warningTextUsagesDropped    = "the certificate is issued without the requested usages: %s"
+)
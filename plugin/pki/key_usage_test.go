@@ -0,0 +1,76 @@
+package pki
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestKeyUsageProfile(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+	createFakeRole(t, b, storage, "client", map[string]interface{}{
+		"key_usage":                          "DigitalSignature,KeyAgreement",
+		"ext_key_usage":                      "ClientAuth",
+		"ext_key_usage_oids":                 "1.3.6.1.4.1.311.20.2.2",
+		"basic_constraints_valid_for_non_ca": true,
+		"policy_identifiers":                 "1.2.3.4.5",
+	})
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/invalid",
+		Storage:   storage,
+		Data:      map[string]interface{}{"venafi_secret": "client", "ext_key_usage": "ServerAuth,Teleport"},
+	})
+	if err != nil || !resp.IsError() {
+		t.Fatalf("unknown extended key usage should be refused: err: %v resp: %#v", err, resp)
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "issue/client",
+		Storage:   storage,
+		Data:      map[string]interface{}{"common_name": "client.example.com"},
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to issue certificate: err: %v resp: %#v", err, resp)
+	}
+	for _, warning := range resp.Warnings {
+		if warning != "Read access to this endpoint should be controlled via ACLs as it will return the connection private key as it is." {
+			t.Fatalf("unexpected warning %q", warning)
+		}
+	}
+
+	// the fake CA copies the extensions of the CSR
+	cert := parsePEMCertificate(t, resp.Data["certificate"].(string))
+	if cert.KeyUsage != x509.KeyUsageDigitalSignature|x509.KeyUsageKeyAgreement {
+		t.Fatalf("unexpected key usage %b", cert.KeyUsage)
+	}
+	if !reflect.DeepEqual(cert.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}) ||
+		len(cert.UnknownExtKeyUsage) != 1 || cert.UnknownExtKeyUsage[0].String() != "1.3.6.1.4.1.311.20.2.2" {
+		t.Fatalf("unexpected extended key usage %v %v", cert.ExtKeyUsage, cert.UnknownExtKeyUsage)
+	}
+	if !cert.BasicConstraintsValid || cert.IsCA {
+		t.Fatal("expected basic constraints with CA:FALSE")
+	}
+	if len(cert.PolicyIdentifiers) != 1 || !cert.PolicyIdentifiers[0].Equal(asn1.ObjectIdentifier{1, 2, 3, 4, 5}) {
+		t.Fatalf("unexpected policies %v", cert.PolicyIdentifiers)
+	}
+
+	role, err := b.getRole(ctx, storage, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the self-signed certificate has the ClientAuth usage only
+	selfSigned, _ := generateSelfSignedPair(t, "client.example.com")
+	missing := missingUsages(role, parsePEMCertificate(t, selfSigned))
+	expected := []string{"DigitalSignature", "KeyAgreement", "1.3.6.1.4.1.311.20.2.2", "policy 1.2.3.4.5"}
+	if !reflect.DeepEqual(missing, expected) {
+		t.Fatalf("expected missing usages %v, got %v", expected, missing)
+	}
+}
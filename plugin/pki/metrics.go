@@ -0,0 +1,333 @@
+package pki
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/Venafi/vcert/pkg/endpoint"
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricsServiceName = "venafi_pki"
+
+	metricOutcomeSuccess = "success"
+	metricOutcomeFailure = "failure"
+	metricOutcomePending = "pending"
+)
+
+// expiryMetricsInterval is how often the stored certificates are scanned for the expiry gauges
+var expiryMetricsInterval = 5 * time.Minute
+
+// expiryBuckets group the stored certificates by the time left until they expire
+var expiryBuckets = []struct {
+	name string
+	left time.Duration
+}{
+	{"expired", 0},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+	{"90d", 90 * 24 * time.Hour},
+}
+
+const expiryBucketLater = "later"
+
+func newMetrics() (*metrics.Metrics, *cumulativeSink) {
+	sink := newCumulativeSink()
+	config := metrics.DefaultConfig(metricsServiceName)
+	config.EnableHostname = false
+	config.EnableRuntimeMetrics = false
+	m, _ := metrics.New(config, sink)
+	return m, sink
+}
+
+// cumulativeSink keeps the metrics in memory for the metrics path, the plugin process has no access to the telemetry
+// of Vault. Unlike metrics.InmemSink it doesn't reset them every interval, counters and samples accumulate since the
+// plugin was started and gauges keep the last value.
+type cumulativeSink struct {
+	lock     sync.Mutex
+	started  time.Time
+	gauges   map[string]metrics.GaugeValue
+	counters map[string]metrics.SampledValue
+	samples  map[string]metrics.SampledValue
+}
+
+func newCumulativeSink() *cumulativeSink {
+	return &cumulativeSink{
+		started:  time.Now(),
+		gauges:   make(map[string]metrics.GaugeValue),
+		counters: make(map[string]metrics.SampledValue),
+		samples:  make(map[string]metrics.SampledValue),
+	}
+}
+
+func (s *cumulativeSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *cumulativeSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	name, hash := flattenMetricKey(key, labels)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.gauges[hash] = metrics.GaugeValue{Name: name, Hash: hash, Value: val, Labels: labels,
+		DisplayLabels: displayLabels(labels)}
+}
+
+// EmitKey is not used by the plugin
+func (s *cumulativeSink) EmitKey(key []string, val float32) {}
+
+func (s *cumulativeSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *cumulativeSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.ingest(s.counters, key, val, labels)
+}
+
+func (s *cumulativeSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *cumulativeSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.ingest(s.samples, key, val, labels)
+}
+
+func (s *cumulativeSink) ingest(values map[string]metrics.SampledValue, key []string, val float32,
+	labels []metrics.Label) {
+
+	name, hash := flattenMetricKey(key, labels)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	value, ok := values[hash]
+	if !ok {
+		value = metrics.SampledValue{Name: name, Hash: hash, AggregateSample: &metrics.AggregateSample{},
+			Labels: labels, DisplayLabels: displayLabels(labels)}
+		values[hash] = value
+	}
+	// the rate is per second since the plugin was started
+	value.Ingest(float64(val), math.Max(time.Since(s.started).Seconds(), 1))
+}
+
+// summary is a copy of the metrics in the format of the sys/metrics endpoint of Vault
+func (s *cumulativeSink) summary() metrics.MetricsSummary {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	summary := metrics.MetricsSummary{
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Gauges:    make([]metrics.GaugeValue, 0, len(s.gauges)),
+		Points:    []metrics.PointValue{},
+		Counters:  sampledValues(s.counters),
+		Samples:   sampledValues(s.samples),
+	}
+	for _, gauge := range s.gauges {
+		summary.Gauges = append(summary.Gauges, gauge)
+	}
+	sort.Slice(summary.Gauges, func(i, j int) bool { return summary.Gauges[i].Hash < summary.Gauges[j].Hash })
+	return summary
+}
+
+func sampledValues(values map[string]metrics.SampledValue) []metrics.SampledValue {
+	result := make([]metrics.SampledValue, 0, len(values))
+	for _, value := range values {
+		aggregate := *value.AggregateSample
+		value.AggregateSample = &aggregate
+		value.Mean = aggregate.Mean()
+		value.Stddev = aggregate.Stddev()
+		result = append(result, value)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Hash < result[j].Hash })
+	return result
+}
+
+// flattenMetricKey returns the name of the metric and the name with the labels, which identifies the metric
+func flattenMetricKey(key []string, labels []metrics.Label) (string, string) {
+	name := strings.Replace(strings.Join(key, "."), " ", "_", -1)
+	hash := name
+	for _, label := range labels {
+		hash += fmt.Sprintf(";%s=%s", label.Name, label.Value)
+	}
+	return name, hash
+}
+
+func displayLabels(labels []metrics.Label) map[string]string {
+	display := make(map[string]string, len(labels))
+	for _, label := range labels {
+		display[label.Name] = label.Value
+	}
+	return display
+}
+
+func pathVenafiMetrics(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "metrics$",
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathVenafiMetricsRead,
+		},
+
+		HelpSynopsis:    pathVenafiMetricsHelpSyn,
+		HelpDescription: pathVenafiMetricsHelpDesc,
+	}
+}
+
+// connectorLabel is the short name of the connector type used in the metric labels
+func connectorLabel(t endpoint.ConnectorType) string {
+	switch t {
+	case endpoint.ConnectorTypeFake:
+		return "fake"
+	case endpoint.ConnectorTypeCloud:
+		return "cloud"
+	case endpoint.ConnectorTypeTPP:
+		return "tpp"
+	}
+	return "undefined"
+}
+
+func metricOutcome(err error) string {
+	if err != nil {
+		return metricOutcomeFailure
+	}
+	return metricOutcomeSuccess
+}
+
+func metricLabels(role string, connector string, outcome string) []metrics.Label {
+	return []metrics.Label{
+		{Name: "role", Value: role},
+		{Name: "connector", Value: connector},
+		{Name: "outcome", Value: outcome},
+	}
+}
+
+// measureVenafiCall records the time spent in the call to Venafi, including retries
+func (b *backend) measureVenafiCall(operation string, role string, cl endpoint.Connector, started time.Time, outcome string) {
+	b.metrics.MeasureSinceWithLabels([]string{"venafi", operation}, started,
+		metricLabels(role, connectorLabel(cl.GetType()), outcome))
+}
+
+// countCertificateEvent counts the event of the certificate history, e.g. cert.issued or cert.revoked
+func (b *backend) countCertificateEvent(ctx context.Context, s logical.Storage, event *historyEvent) {
+	connector := endpoint.ConnectorTypeUndefined
+	if event.VenafiSecret != "" {
+		secret, err := b.getVenafiSecret(ctx, s, event.VenafiSecret)
+		if err == nil && secret != nil {
+			connector = secret.connectorType()
+		}
+	}
+	b.metrics.IncrCounterWithLabels([]string{"cert", event.Event}, 1,
+		metricLabels(event.Role, connectorLabel(connector), event.Outcome))
+}
+
+func (b *backend) countTokenRefresh(role string, err error) {
+	b.metrics.IncrCounterWithLabels([]string{"venafi", "token_refresh"}, 1,
+		metricLabels(role, connectorLabel(endpoint.ConnectorTypeTPP), metricOutcome(err)))
+}
+
+// updateExpiryMetrics sets the gauges of stored certificates by expiry bucket. The storage is scanned at most once in
+// expiryMetricsInterval.
+func (b *backend) updateExpiryMetrics(ctx context.Context, s logical.Storage) error {
+	b.metricsLock.Lock()
+	defer b.metricsLock.Unlock()
+
+	if time.Since(b.expiryScanned) < expiryMetricsInterval {
+		return nil
+	}
+
+	keys, err := s.List(ctx, "certs/")
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	now := time.Now()
+	for _, key := range keys {
+		entry, err := s.Get(ctx, "certs/"+key)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			continue
+		}
+		var cert VenafiCert
+		if err := entry.DecodeJSON(&cert); err != nil {
+			b.Logger().Warn(fmt.Sprintf("Can't decode certificate %s: %s", key, err))
+			continue
+		}
+		block, _ := pem.Decode([]byte(cert.Certificate))
+		if block == nil {
+			continue
+		}
+		parsed, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			b.Logger().Warn(fmt.Sprintf("Can't parse certificate %s: %s", key, err))
+			continue
+		}
+		counts[expiryBucket(parsed.NotAfter.Sub(now))]++
+	}
+
+	for _, bucket := range expiryBuckets {
+		b.metrics.SetGaugeWithLabels([]string{"certs", "expiry"}, float32(counts[bucket.name]),
+			[]metrics.Label{{Name: "bucket", Value: bucket.name}})
+	}
+	b.metrics.SetGaugeWithLabels([]string{"certs", "expiry"}, float32(counts[expiryBucketLater]),
+		[]metrics.Label{{Name: "bucket", Value: expiryBucketLater}})
+	b.expiryScanned = time.Now()
+	return nil
+}
+
+func expiryBucket(left time.Duration) string {
+	for _, bucket := range expiryBuckets {
+		if left <= bucket.left {
+			return bucket.name
+		}
+	}
+	return expiryBucketLater
+}
+
+func (b *backend) pathVenafiMetricsRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := b.updateExpiryMetrics(ctx, req.Storage); err != nil {
+		return nil, err
+	}
+
+	// the summary is returned as JSON, like the sys/metrics endpoint of Vault
+	raw, err := json.Marshal(b.metricsSink.summary())
+	if err != nil {
+		return nil, err
+	}
+	var respData map[string]interface{}
+	if err := json.Unmarshal(raw, &respData); err != nil {
+		return nil, err
+	}
+	return &logical.Response{
+		Data: respData,
+	}, nil
+}
+
+const pathVenafiMetricsHelpSyn = `
+Read the metrics of the plugin.
+`
+
+const pathVenafiMetricsHelpDesc = `
+Returns a JSON snapshot of the metrics since the plugin was started:
+
+cert.<event>             - counters of issued, signed, renewed, revoked and deleted certificates
+venafi.generate_request,
+venafi.request_certificate,
+venafi.retrieve_certificate - time spent in the calls to Venafi, in milliseconds
+venafi.token_refresh     - counter of access token refreshes
+certs.expiry             - stored certificates by time left until expiry: expired, 7d, 30d, 90d and later,
+                           the storage is scanned at most every 5 minutes
+
+Metrics are labelled by role, connector type (tpp, cloud or fake) and outcome.
+`
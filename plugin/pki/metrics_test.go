@@ -0,0 +1,105 @@
+package pki
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestMetrics(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	createFakeRole(t, b, storage, "metrics", map[string]interface{}{"store_by": "serial"})
+	ctx := context.Background()
+
+	for _, commonName := range []string{"metrics.example.com", "metrics.venafi.com"} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "issue/metrics",
+			Storage:   storage,
+			Data:      map[string]interface{}{"common_name": commonName},
+		})
+		codedErrorResponse(t, resp, err)
+	}
+
+	var resp *logical.Response
+	read := func() {
+		var err error
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "metrics",
+			Storage:   storage,
+		})
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("failed to read metrics: err: %v resp: %#v", err, resp)
+		}
+	}
+	read()
+
+	find := func(kind string, name string, labels map[string]interface{}) map[string]interface{} {
+		values, _ := resp.Data[kind].([]interface{})
+		for _, v := range values {
+			value := v.(map[string]interface{})
+			if value["Name"] != name {
+				continue
+			}
+			matches := true
+			for k, l := range labels {
+				if value["Labels"].(map[string]interface{})[k] != l {
+					matches = false
+				}
+			}
+			if matches {
+				return value
+			}
+		}
+		t.Fatalf("metric %s %v not found in %s: %#v", name, labels, kind, resp.Data[kind])
+		return nil
+	}
+
+	issued := find("Counters", "venafi_pki.cert.issued", map[string]interface{}{
+		"role": "metrics", "connector": "fake", "outcome": historyOutcomeSuccess,
+	})
+	if issued["Count"] != float64(1) {
+		t.Fatalf("expected one issued certificate, got %#v", issued)
+	}
+	find("Counters", "venafi_pki.cert.issued", map[string]interface{}{"outcome": historyOutcomeFailure})
+	find("Samples", "venafi_pki.venafi.generate_request", map[string]interface{}{"outcome": metricOutcomeSuccess})
+	find("Samples", "venafi_pki.venafi.request_certificate", map[string]interface{}{"outcome": metricOutcomeFailure})
+	find("Samples", "venafi_pki.venafi.retrieve_certificate", map[string]interface{}{"outcome": metricOutcomeSuccess})
+
+	// the fake connector issues certificates valid for 90 days
+	expiring := find("Gauges", "venafi_pki.certs.expiry", map[string]interface{}{"bucket": "90d"})
+	if expiring["Value"] != float64(1) {
+		t.Fatalf("expected one certificate expiring within 90 days, got %#v", expiring)
+	}
+	expired := find("Gauges", "venafi_pki.certs.expiry", map[string]interface{}{"bucket": "expired"})
+	if expired["Value"] != float64(0) {
+		t.Fatalf("expected no expired certificates, got %#v", expired)
+	}
+
+	// counters accumulate, the expiry gauges are updated by the next scan of the storage
+	issuedResp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "issue/metrics",
+		Storage:   storage,
+		Data:      map[string]interface{}{"common_name": "metrics.example.com"},
+	})
+	if err != nil || issuedResp.IsError() {
+		t.Fatalf("failed to issue certificate: err: %v resp: %#v", err, issuedResp)
+	}
+	read()
+	issued = find("Counters", "venafi_pki.cert.issued", map[string]interface{}{"outcome": historyOutcomeSuccess})
+	if issued["Count"] != float64(2) {
+		t.Fatalf("expected two issued certificates, got %#v", issued)
+	}
+	if find("Gauges", "venafi_pki.certs.expiry", map[string]interface{}{"bucket": "90d"})["Value"] != float64(1) {
+		t.Fatal("the storage should not be scanned again within the expiry metrics interval")
+	}
+	b.expiryScanned = time.Now().Add(-expiryMetricsInterval)
+	read()
+	if find("Gauges", "venafi_pki.certs.expiry", map[string]interface{}{"bucket": "90d"})["Value"] != float64(2) {
+		t.Fatal("expected two certificates expiring within 90 days after the next scan")
+	}
+}
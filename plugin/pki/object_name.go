@@ -0,0 +1,83 @@
+package pki
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	objectNameRole            = "{{role}}"
+	objectNameCommonName      = "{{common_name}}"
+	objectNameRequestIDPrefix = "{{request_id_prefix}}"
+	objectNameEntityName      = "{{entity_name}}"
+	objectNameTimestamp       = "{{timestamp}}"
+
+	// requestIDPrefixLength is the length of the prefix of the plugin request ID, which is also the pickup ID
+	requestIDPrefixLength = 8
+)
+
+// objectNameValues are the values of the object name template placeholders
+type objectNameValues struct {
+	role       string
+	commonName string
+	requestID  string
+	entityName string
+	timestamp  time.Time
+}
+
+func (v objectNameValues) replacer() *strings.Replacer {
+	prefix := strings.ReplaceAll(v.requestID, "-", "")
+	if len(prefix) > requestIDPrefixLength {
+		prefix = prefix[:requestIDPrefixLength]
+	}
+	return strings.NewReplacer(
+		objectNameRole, v.role,
+		objectNameCommonName, v.commonName,
+		objectNameRequestIDPrefix, prefix,
+		objectNameEntityName, v.entityName,
+		objectNameTimestamp, v.timestamp.UTC().Format("20060102T150405Z"),
+	)
+}
+
+// validateObjectNameTemplate checks that the template has known placeholders only. TPP object names can't contain
+// backslashes, they separate the policy folders.
+func validateObjectNameTemplate(template string) error {
+	rest := objectNameValues{}.replacer().Replace(template)
+	if strings.Contains(rest, "{{") || strings.Contains(rest, "}}") {
+		return fmt.Errorf(errorTextInvalidObjectNameTemplate, template)
+	}
+	if strings.Contains(template, `\`) {
+		return fmt.Errorf(errorTextObjectNameBackslash, template)
+	}
+	return nil
+}
+
+// selectObjectNameTemplate returns the object name template of the request, object_name_template of the role if none
+// is requested
+func selectObjectNameTemplate(role *roleEntry, requested string) (string, error) {
+	if requested == "" {
+		return role.ObjectNameTemplate, nil
+	}
+	if !role.AllowObjectNameOverride {
+		return "", fmt.Errorf(errorTextObjectNameOverride)
+	}
+	return requested, validateObjectNameTemplate(requested)
+}
+
+// expandObjectName returns the TPP object name, the friendly name of the request. TPP names the object after the
+// common name if it's empty.
+func expandObjectName(template string, values objectNameValues) (string, error) {
+	name := strings.TrimSpace(values.replacer().Replace(template))
+	if strings.Contains(name, `\`) {
+		return "", fmt.Errorf(errorTextObjectNameBackslash, name)
+	}
+	return name, nil
+}
+
+const (
+	errorTextInvalidObjectNameTemplate = "invalid object name template %q, valid placeholders are {{role}}, {{common_name}}, " +
+		"{{request_id_prefix}}, {{entity_name}} and {{timestamp}}"
+	errorTextObjectNameBackslash = `object name %q can't contain "\"`
+	errorTextObjectNameOverride  = "object_name is not allowed by allow_object_name_override of the role"
+)
@@ -0,0 +1,75 @@
+package pki
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestObjectName(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+	b.System().(*logical.StaticSystemView).EntityVal = &logical.Entity{ID: "entity-id", Name: "team-a"}
+	createFakeRole(t, b, storage, "named", map[string]interface{}{
+		"object_name_template": "{{common_name}} ({{role}} {{entity_name}} {{request_id_prefix}})",
+	})
+	createFakeRole(t, b, storage, "override", map[string]interface{}{
+		"allow_object_name_override": true,
+	})
+
+	request := func(operation logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: operation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+			EntityID:  "entity-id",
+		})
+		return codedErrorResponse(t, resp, err)
+	}
+	objectName := func(role string, data map[string]interface{}) string {
+		resp := request(logical.UpdateOperation, "issue/"+role, data)
+		if resp.IsError() {
+			t.Fatalf("failed to issue certificate: %#v", resp)
+		}
+		resp = request(logical.ReadOperation, "cert/"+normalizeSerial(resp.Data["serial_number"].(string)), nil)
+		return resp.Data["object_name"].(string)
+	}
+
+	name := objectName("named", map[string]interface{}{"common_name": "web.example.com"})
+	if !regexp.MustCompile(`^web\.example\.com \(named team-a [0-9a-f]{8}\)$`).MatchString(name) {
+		t.Fatalf("unexpected object name %q", name)
+	}
+	if name == objectName("named", map[string]interface{}{"common_name": "web.example.com"}) {
+		t.Fatalf("object names of the same common name should be distinct, got %q twice", name)
+	}
+
+	resp := request(logical.UpdateOperation, "issue/named", map[string]interface{}{
+		"common_name": "web.example.com",
+		"object_name": "web",
+	})
+	if !resp.IsError() {
+		t.Fatalf("object_name should be refused without allow_object_name_override, got %#v", resp)
+	}
+	if name := objectName("override", map[string]interface{}{
+		"common_name": "web.example.com",
+		"object_name": "web-{{role}}",
+	}); name != "web-override" {
+		t.Fatalf("expected object name web-override, got %q", name)
+	}
+	if name := objectName("override", map[string]interface{}{"common_name": "web.example.com"}); name != "" {
+		t.Fatalf("expected no object name, got %q", name)
+	}
+
+	for _, template := range []string{"{{cn}}", `team\{{common_name}}`} {
+		resp := request(logical.UpdateOperation, "roles/invalid", map[string]interface{}{
+			"venafi_secret":        "named",
+			"object_name_template": template,
+		})
+		if !resp.IsError() {
+			t.Fatalf("object name template %q should be refused, got %#v", template, resp)
+		}
+	}
+}
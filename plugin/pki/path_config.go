@@ -0,0 +1,130 @@
+package pki
+
+import (
+	"context"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"time"
+)
+
+const (
+	configPath = "config"
+
+	// defaultHistoryRetention is how long the history events are kept when history_retention isn't configured
+	defaultHistoryRetention = 90 * 24 * time.Hour
+)
+
+// mountConfigEntry is the configuration of the plugin mount which is not specific to a role or a venafi secret
+type mountConfigEntry struct {
+	HistoryRetention time.Duration `json:"history_retention"`
+	PKICompatible    bool          `json:"pki_compatible"`
+}
+
+func pathConfig(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config$",
+		Fields: map[string]*framework.FieldSchema{
+			"history_retention": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How long events are kept in the certificate history. Defaults to 90 days",
+			},
+			"pki_compatible": {
+				Type:        framework.TypeBool,
+				Description: "Return the response schema of the built-in PKI secrets engine for all roles of the mount",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathConfigRead,
+				Summary:  "Read the configuration of the mount",
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathConfigWrite,
+				Summary:  "Update the configuration of the mount",
+			},
+		},
+
+		HelpSynopsis:    pathConfigHelpSyn,
+		HelpDescription: pathConfigHelpDesc,
+	}
+}
+
+func (b *backend) getMountConfig(ctx context.Context, s logical.Storage) (*mountConfigEntry, error) {
+	config := mountConfigEntry{HistoryRetention: defaultHistoryRetention}
+	entry, err := s.Get(ctx, configPath)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return &config, nil
+	}
+
+	if err := entry.DecodeJSON(&config); err != nil {
+		return nil, err
+	}
+	if config.HistoryRetention == 0 {
+		config.HistoryRetention = defaultHistoryRetention
+	}
+	return &config, nil
+}
+
+func (c *mountConfigEntry) ToResponseData() map[string]interface{} {
+	return map[string]interface{}{
+		"history_retention": int64(c.HistoryRetention.Seconds()),
+		"pki_compatible":    c.PKICompatible,
+	}
+}
+
+func (b *backend) pathConfigRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := b.getMountConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: config.ToResponseData(),
+	}, nil
+}
+
+func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := b.getMountConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if retention, ok := data.GetOk("history_retention"); ok {
+		config.HistoryRetention = time.Duration(retention.(int)) * time.Second
+	}
+	if pkiCompatible, ok := data.GetOk("pki_compatible"); ok {
+		config.PKICompatible = pkiCompatible.(bool)
+	}
+	if config.HistoryRetention < 0 {
+		return logical.ErrorResponse(errorTextNegativeRetention), nil
+	}
+
+	entry, err := logical.StorageEntryJSON(configPath, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+const errorTextNegativeRetention = `"history_retention" can't be negative`
+
+const pathConfigHelpSyn = `
+Configure the mount.
+`
+
+const pathConfigHelpDesc = `
+Settings which apply to all roles of the mount:
+
+history_retention - how long events are kept in the certificate history. Older events are
+                    deleted periodically. By default events are kept for 90 days.
+pki_compatible    - issue and sign of all roles return the response schema of the built-in PKI
+                    secrets engine (certificate, issuing_ca, ca_chain, private_key, private_key_type,
+                    serial_number, expiration) and accept its ttl, format, exclude_cn_from_sans and
+                    private_key_format parameters. It can be enabled per role as well.
+`
@@ -50,7 +50,8 @@ func pathRoles(b *backend) *framework.Path {
 
 			"no_store": {
 				Type:        framework.TypeBool,
-				Description: `If set, certificates issued/signed against this role will not be stored in the storage backend.`,
+				Description: `If set, certificates issued/signed against this role will not be stored in the storage backend.
+The generated private key of a request saved for pickup is kept until the certificate is picked up.`,
 			},
 
 			"service_generated_cert": {
@@ -71,7 +72,7 @@ func pathRoles(b *backend) *framework.Path {
 				Type:    framework.TypeString,
 				Default: "rsa",
 				Description: `The type of key to use; defaults to RSA. "rsa"
-				and "ec" (ECDSA) are the only valid values.`,
+				and "ec" (ECDSA) are the only valid values. "any" allows CSRs with any key type to be signed.`,
 			},
 			"key_bits": {
 				Type:    framework.TypeInt,
@@ -106,7 +107,7 @@ attached to them. Defaults to "false".`,
 			},
 			"server_timeout": {
 				Type:        framework.TypeInt,
-				Description: "Timeout of waiting certificate",
+				Description: "Timeout of waiting certificate in seconds, at most 1800",
 				Default:     180,
 			},
 			"venafi_secret": {
@@ -114,6 +115,143 @@ attached to them. Defaults to "false".`,
 				Description: `The name of the credentials object to be used for authentication`,
 				Required:    true,
 			},
+			"reuse_if_valid": {
+				Type: framework.TypeBool,
+				Description: `If set, issue returns a stored certificate with the same CN, SANs and key parameters instead of
+requesting a new one while it is valid for at least min_remaining_lifetime. Requires store_pkey`,
+			},
+			"min_remaining_lifetime": {
+				Type:        framework.TypeDurationSecond,
+				Description: `The minimal remaining lifetime of a certificate to be reused`,
+			},
+			"max_issuances_per_minute": {
+				Type:        framework.TypeInt,
+				Description: `The maximum number of certificates issued with the role per minute. 0 means no limit`,
+			},
+			"max_issuances_per_day": {
+				Type:        framework.TypeInt,
+				Description: `The maximum number of certificates issued with the role per 24 hours. 0 means no limit`,
+			},
+			"max_active_per_cn": {
+				Type:        framework.TypeInt,
+				Description: `The maximum number of unexpired certificates issued with the role for the same CN. 0 means no limit`,
+			},
+			"idempotency_window": {
+				Type: framework.TypeDurationSecond,
+				Description: `How long the result of a request made with an idempotency_key is returned for retries of the request.
+Defaults to 24 hours`,
+			},
+			"sign_csr_names": {
+				Type:    framework.TypeString,
+				Default: signCSRNamesEnforce,
+				Description: `How common_name, alt_names, ip_sans and uri_sans of a sign request are checked against the CSR.
+"enforce" (default) - requested names must be in the CSR, "strict" - the CSR can't contain other names either,
+"csr" - requested names are ignored. The certificate is issued with the names of the CSR. Requested names can't
+override or be added to the names of the CSR: the CSR is submitted to Venafi as it is (PKCS#10 only) and it's signed
+with the key of the requester, so it can't be changed by the plugin. Roles with "override" are refused`,
+			},
+			"allowed_domains": {
+				Type: framework.TypeCommaStringSlice,
+				Description: `Domains of the common name, DNS SANs and email SANs allowed by issue and sign. Any name is
+allowed if empty. Not applied by sign-verbatim`,
+			},
+			"allow_subdomains": {
+				Type:        framework.TypeBool,
+				Description: `If set, subdomains of allowed_domains are allowed, including wildcards`,
+			},
+			"allow_glob_domains": {
+				Type:        framework.TypeBool,
+				Description: `If set, allowed_domains can contain glob patterns, e.g. "web-*.example.com"`,
+			},
+			"allowed_organizations": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `Organizations allowed in the subject of CSRs submitted to sign. Any if empty`,
+			},
+			"allowed_ous": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `Organizational units allowed in the subject of CSRs submitted to sign. Any if empty`,
+			},
+			"allowed_key_curves": {
+				Type: framework.TypeCommaStringSlice,
+				Description: `Curves allowed for EC keys of CSRs submitted to sign: "P256", "P384" and "P521". All of them
+if empty. RSA keys of CSRs must have at least key_bits`,
+			},
+			"require_sha256_csr": {
+				Type:        framework.TypeBool,
+				Description: `If set, CSRs submitted to sign must be signed with SHA-256 or a stronger hash`,
+			},
+			"key_reuse": {
+				Type:    framework.TypeString,
+				Default: keyReuseAllow,
+				Description: `Whether keys of CSRs submitted to sign and sign-verbatim can be used for more than one certificate. "allow" (default),
+"deny_revoked" - keys of revoked certificates are refused, "deny" - keys of any issued or signed certificate are refused`,
+			},
+			"allow_key_reuse_same_cn": {
+				Type:        framework.TypeBool,
+				Description: `If set, key_reuse "deny" allows the key of a certificate with the same common name, for renewals`,
+			},
+			"key_usage": {
+				Type: framework.TypeCommaStringSlice,
+				Description: `Key usages requested in locally generated CSRs, e.g. "DigitalSignature,KeyEncipherment". Valid
+values are DigitalSignature, ContentCommitment, KeyEncipherment, DataEncipherment, KeyAgreement, CertSign, CRLSign,
+EncipherOnly and DecipherOnly`,
+			},
+			"ext_key_usage": {
+				Type: framework.TypeCommaStringSlice,
+				Description: `Extended key usages requested in locally generated CSRs, e.g. "ServerAuth,ClientAuth". Valid
+values are Any, ServerAuth, ClientAuth, CodeSigning, EmailProtection, IPSECEndSystem, IPSECTunnel, IPSECUser,
+TimeStamping, OCSPSigning, MicrosoftServerGatedCrypto and NetscapeServerGatedCrypto`,
+			},
+			"ext_key_usage_oids": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `OIDs of additional extended key usages requested in locally generated CSRs`,
+			},
+			"basic_constraints_valid_for_non_ca": {
+				Type:        framework.TypeBool,
+				Description: `If set, locally generated CSRs request the basic constraints extension with CA:FALSE`,
+			},
+			"policy_identifiers": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `OIDs of certificate policies requested in locally generated CSRs`,
+			},
+			"ca_template": {
+				Type: framework.TypeString,
+				Description: `DN of the TPP CA template certificates are requested from, e.g.
+"\VED\Policy\Certificate Authorities\Issuing CA". The default CA of the zone is used if empty`,
+			},
+			"allowed_ca_templates": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `DNs of the TPP CA templates which can be selected by the ca_template parameter of the request`,
+			},
+			"object_name_template": {
+				Type: framework.TypeString,
+				Description: `Template of the TPP object name of certificates, e.g. "{{common_name}} ({{role}} {{request_id_prefix}})".
+Placeholders are {{role}}, {{common_name}}, {{request_id_prefix}} - prefix of the request ID, {{entity_name}} - Vault
+entity of the requester and {{timestamp}}. There is no serial number placeholder: the serial number isn't known before
+the TPP object is created, {{request_id_prefix}} makes the name unique instead. TPP names objects after the common
+name if empty`,
+			},
+			"allow_object_name_override": {
+				Type:        framework.TypeBool,
+				Description: `If set, the object_name parameter of the request overrides object_name_template`,
+			},
+			"zone": {
+				Type: framework.TypeString,
+				Description: `Zone requests of the role are sent to instead of the zone of venafi_secret, so that one venafi secret
+can serve several policy folders. Must be allowed by allowed_zones of the venafi secret`,
+			},
+			"zone_routes": {
+				Type: framework.TypeSlice,
+				Description: `Ordered list of routes of requests to zones by the requested domains, e.g.
+[{"domains": ["*.eu.example.com"], "zone": "Certificates\\EU"}, {"domains": ["*.lab.example.com"], "venafi_secret": "lab"}].
+The first route with a pattern matching the name applies, a route sends requests to the zone and/or the venafi secret.
+Names without a route go to venafi_secret of the role. Requests with names routed to different zones are refused`,
+			},
+			"pki_compatible": {
+				Type: framework.TypeBool,
+				Description: `If set, issue and sign return the response schema of the built-in PKI secrets engine and accept its
+ttl, format, exclude_cn_from_sans and private_key_format parameters. Can be set for the whole mount in config`,
+			},
 			"update_if_exist": {
 				Type:        framework.TypeBool,
 				Description: `When true, settings of an existing role will be retained unless they are specified in the update.
@@ -152,6 +290,14 @@ const (
 	errorTextVenafiSecretEmpty                   = `"venafi_secret" argument is required`
 )
 
+const (
+	errorTextReuseRequiresStorePKey = `"reuse_if_valid" requires "store_pkey" and can't be used with "no_store"`
+	errorTextNegativeLifetime       = `"min_remaining_lifetime" can't be negative`
+	errorTextServerTimeoutTooLong   = `"server_timeout" can't be longer than %d seconds`
+	errorTextNegativeRateLimit      = `issuance limits can't be negative`
+	errorTextInvalidKeyType         = `invalid "key_type" %q, valid values are "rsa", "ec" and "any"`
+)
+
 func (b *backend) getRole(ctx context.Context, s logical.Storage, n string) (*roleEntry, error) {
 	entry, err := s.Get(ctx, "role/"+n)
 	if err != nil {
@@ -308,6 +454,159 @@ func (b *backend) pathRoleUpdate(ctx context.Context, req *logical.Request, data
 		entry.VenafiSecret = venafiSecret
 	}
 
+	_, isSet = data.GetOk("reuse_if_valid")
+	reuse_if_valid := data.Get("reuse_if_valid").(bool)
+	if isSet && (entry.ReuseIfValid != reuse_if_valid) {
+		entry.ReuseIfValid = reuse_if_valid
+	}
+
+	_, isSet = data.GetOk("min_remaining_lifetime")
+	min_remaining_lifetime := time.Duration(data.Get("min_remaining_lifetime").(int)) * time.Second
+	if isSet && (entry.MinRemainingLifetime != min_remaining_lifetime) {
+		entry.MinRemainingLifetime = min_remaining_lifetime
+	}
+
+	_, isSet = data.GetOk("max_issuances_per_minute")
+	max_issuances_per_minute := data.Get("max_issuances_per_minute").(int)
+	if isSet && (entry.MaxIssuancesPerMinute != max_issuances_per_minute) {
+		entry.MaxIssuancesPerMinute = max_issuances_per_minute
+	}
+
+	_, isSet = data.GetOk("max_issuances_per_day")
+	max_issuances_per_day := data.Get("max_issuances_per_day").(int)
+	if isSet && (entry.MaxIssuancesPerDay != max_issuances_per_day) {
+		entry.MaxIssuancesPerDay = max_issuances_per_day
+	}
+
+	_, isSet = data.GetOk("max_active_per_cn")
+	max_active_per_cn := data.Get("max_active_per_cn").(int)
+	if isSet && (entry.MaxActivePerCN != max_active_per_cn) {
+		entry.MaxActivePerCN = max_active_per_cn
+	}
+
+	_, isSet = data.GetOk("idempotency_window")
+	idempotency_window := time.Duration(data.Get("idempotency_window").(int)) * time.Second
+	if isSet && (entry.IdempotencyWindow != idempotency_window) {
+		entry.IdempotencyWindow = idempotency_window
+	}
+
+	_, isSet = data.GetOk("sign_csr_names")
+	sign_csr_names := data.Get("sign_csr_names").(string)
+	if isSet && (entry.SignCSRNames != sign_csr_names) {
+		entry.SignCSRNames = sign_csr_names
+	}
+
+	_, isSet = data.GetOk("allowed_domains")
+	if isSet {
+		entry.AllowedDomains = data.Get("allowed_domains").([]string)
+	}
+
+	_, isSet = data.GetOk("allow_subdomains")
+	allow_subdomains := data.Get("allow_subdomains").(bool)
+	if isSet && (entry.AllowSubdomains != allow_subdomains) {
+		entry.AllowSubdomains = allow_subdomains
+	}
+
+	_, isSet = data.GetOk("allow_glob_domains")
+	allow_glob_domains := data.Get("allow_glob_domains").(bool)
+	if isSet && (entry.AllowGlobDomains != allow_glob_domains) {
+		entry.AllowGlobDomains = allow_glob_domains
+	}
+
+	_, isSet = data.GetOk("allowed_organizations")
+	if isSet {
+		entry.AllowedOrganizations = data.Get("allowed_organizations").([]string)
+	}
+
+	_, isSet = data.GetOk("allowed_ous")
+	if isSet {
+		entry.AllowedOUs = data.Get("allowed_ous").([]string)
+	}
+
+	_, isSet = data.GetOk("allowed_key_curves")
+	if isSet {
+		entry.AllowedKeyCurves = data.Get("allowed_key_curves").([]string)
+	}
+
+	_, isSet = data.GetOk("require_sha256_csr")
+	require_sha256_csr := data.Get("require_sha256_csr").(bool)
+	if isSet && (entry.RequireSHA256CSR != require_sha256_csr) {
+		entry.RequireSHA256CSR = require_sha256_csr
+	}
+
+	_, isSet = data.GetOk("key_reuse")
+	key_reuse := data.Get("key_reuse").(string)
+	if isSet && (entry.KeyReuse != key_reuse) {
+		entry.KeyReuse = key_reuse
+	}
+
+	_, isSet = data.GetOk("allow_key_reuse_same_cn")
+	allow_key_reuse_same_cn := data.Get("allow_key_reuse_same_cn").(bool)
+	if isSet && (entry.AllowKeyReuseSameCN != allow_key_reuse_same_cn) {
+		entry.AllowKeyReuseSameCN = allow_key_reuse_same_cn
+	}
+
+	_, isSet = data.GetOk("key_usage")
+	if isSet {
+		entry.KeyUsage = data.Get("key_usage").([]string)
+	}
+
+	_, isSet = data.GetOk("ext_key_usage")
+	if isSet {
+		entry.ExtKeyUsage = data.Get("ext_key_usage").([]string)
+	}
+
+	_, isSet = data.GetOk("ext_key_usage_oids")
+	if isSet {
+		entry.ExtKeyUsageOIDs = data.Get("ext_key_usage_oids").([]string)
+	}
+
+	_, isSet = data.GetOk("basic_constraints_valid_for_non_ca")
+	basic_constraints_valid_for_non_ca := data.Get("basic_constraints_valid_for_non_ca").(bool)
+	if isSet && (entry.BasicConstraintsValidForNonCA != basic_constraints_valid_for_non_ca) {
+		entry.BasicConstraintsValidForNonCA = basic_constraints_valid_for_non_ca
+	}
+
+	_, isSet = data.GetOk("policy_identifiers")
+	if isSet {
+		entry.PolicyIdentifiers = data.Get("policy_identifiers").([]string)
+	}
+
+	_, isSet = data.GetOk("ca_template")
+	ca_template := data.Get("ca_template").(string)
+	if isSet && (entry.CATemplate != ca_template) {
+		entry.CATemplate = ca_template
+	}
+
+	_, isSet = data.GetOk("allowed_ca_templates")
+	if isSet {
+		entry.AllowedCATemplates = data.Get("allowed_ca_templates").([]string)
+	}
+
+	_, isSet = data.GetOk("object_name_template")
+	object_name_template := data.Get("object_name_template").(string)
+	if isSet && (entry.ObjectNameTemplate != object_name_template) {
+		entry.ObjectNameTemplate = object_name_template
+	}
+
+	_, isSet = data.GetOk("allow_object_name_override")
+	allow_object_name_override := data.Get("allow_object_name_override").(bool)
+	if isSet && (entry.AllowObjectNameOverride != allow_object_name_override) {
+		entry.AllowObjectNameOverride = allow_object_name_override
+	}
+
+	_, isSet = data.GetOk("zone")
+	zone := data.Get("zone").(string)
+	if isSet && (entry.Zone != zone) {
+		entry.Zone = zone
+	}
+
+	_, isSet = data.GetOk("pki_compatible")
+	pki_compatible := data.Get("pki_compatible").(bool)
+	if isSet && (entry.PKICompatible != pki_compatible) {
+		entry.PKICompatible = pki_compatible
+	}
+
 	err = validateEntry(entry)
 	if err != nil {
 		return nil, err
@@ -324,6 +623,13 @@ func (b *backend) pathRoleCreate(ctx context.Context, req *logical.Request, data
 
 	var entry *roleEntry
 
+	// server_timeout is checked only when it's set, so roles written before it was limited can still be updated,
+	// their timeout is limited by roleClientVenafi
+	if serverTimeout, ok := data.GetOk("server_timeout"); ok &&
+		time.Duration(serverTimeout.(int))*time.Second > maxServerTimeout {
+		return logical.ErrorResponse(fmt.Sprintf(errorTextServerTimeoutTooLong, int(maxServerTimeout.Seconds()))), nil
+	}
+
 	if updateEntry {
 		entry, err = b.pathRoleUpdate(ctx, req, data)
 		if err != nil {
@@ -332,21 +638,58 @@ func (b *backend) pathRoleCreate(ctx context.Context, req *logical.Request, data
 
 	} else {
 		entry = &roleEntry{
-			ChainOption:      data.Get("chain_option").(string),
-			StoreByCN:        data.Get("store_by_cn").(bool),
-			StoreBySerial:    data.Get("store_by_serial").(bool),
-			StoreBy:          data.Get("store_by").(string),
-			NoStore:          data.Get("no_store").(bool),
-			ServiceGenerated: data.Get("service_generated_cert").(bool),
-			StorePrivateKey:  data.Get("store_pkey").(bool),
-			KeyType:          data.Get("key_type").(string),
-			KeyBits:          data.Get("key_bits").(int),
-			KeyCurve:         data.Get("key_curve").(string),
-			MaxTTL:           time.Duration(data.Get("max_ttl").(int)) * time.Second,
-			TTL:              time.Duration(data.Get("ttl").(int)) * time.Second,
-			GenerateLease:    data.Get("generate_lease").(bool),
-			ServerTimeout:    time.Duration(data.Get("server_timeout").(int)) * time.Second,
-			VenafiSecret:     data.Get("venafi_secret").(string),
+			ChainOption:           data.Get("chain_option").(string),
+			StoreByCN:             data.Get("store_by_cn").(bool),
+			StoreBySerial:         data.Get("store_by_serial").(bool),
+			StoreBy:               data.Get("store_by").(string),
+			NoStore:               data.Get("no_store").(bool),
+			ServiceGenerated:      data.Get("service_generated_cert").(bool),
+			StorePrivateKey:       data.Get("store_pkey").(bool),
+			KeyType:               data.Get("key_type").(string),
+			KeyBits:               data.Get("key_bits").(int),
+			KeyCurve:              data.Get("key_curve").(string),
+			MaxTTL:                time.Duration(data.Get("max_ttl").(int)) * time.Second,
+			TTL:                   time.Duration(data.Get("ttl").(int)) * time.Second,
+			GenerateLease:         data.Get("generate_lease").(bool),
+			ServerTimeout:         time.Duration(data.Get("server_timeout").(int)) * time.Second,
+			VenafiSecret:          data.Get("venafi_secret").(string),
+			IdempotencyWindow:     time.Duration(data.Get("idempotency_window").(int)) * time.Second,
+			ReuseIfValid:          data.Get("reuse_if_valid").(bool),
+			MinRemainingLifetime:  time.Duration(data.Get("min_remaining_lifetime").(int)) * time.Second,
+			MaxIssuancesPerMinute: data.Get("max_issuances_per_minute").(int),
+			MaxIssuancesPerDay:    data.Get("max_issuances_per_day").(int),
+			MaxActivePerCN:        data.Get("max_active_per_cn").(int),
+			PKICompatible:         data.Get("pki_compatible").(bool),
+			SignCSRNames:          data.Get("sign_csr_names").(string),
+			AllowedDomains:        data.Get("allowed_domains").([]string),
+			AllowSubdomains:       data.Get("allow_subdomains").(bool),
+			AllowGlobDomains:      data.Get("allow_glob_domains").(bool),
+			AllowedOrganizations:  data.Get("allowed_organizations").([]string),
+			AllowedOUs:            data.Get("allowed_ous").([]string),
+			AllowedKeyCurves:      data.Get("allowed_key_curves").([]string),
+			RequireSHA256CSR:      data.Get("require_sha256_csr").(bool),
+			KeyReuse:              data.Get("key_reuse").(string),
+			AllowKeyReuseSameCN:   data.Get("allow_key_reuse_same_cn").(bool),
+			KeyUsage:              data.Get("key_usage").([]string),
+			ExtKeyUsage:           data.Get("ext_key_usage").([]string),
+			ExtKeyUsageOIDs:       data.Get("ext_key_usage_oids").([]string),
+			PolicyIdentifiers:     data.Get("policy_identifiers").([]string),
+			CATemplate:            data.Get("ca_template").(string),
+			AllowedCATemplates:    data.Get("allowed_ca_templates").([]string),
+			ObjectNameTemplate:    data.Get("object_name_template").(string),
+			Zone:                  data.Get("zone").(string),
+
+			AllowObjectNameOverride: data.Get("allow_object_name_override").(bool),
+
+			BasicConstraintsValidForNonCA: data.Get("basic_constraints_valid_for_non_ca").(bool),
+		}
+	}
+
+	// zone_routes is parsed here for both create and update, so that invalid routes are reported as a bad request
+	if raw, ok := data.GetOk("zone_routes"); ok {
+		entry.ZoneRoutes, err = parseZoneRoutes(raw.([]interface{}))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
 		}
 	}
 
@@ -354,6 +697,10 @@ func (b *backend) pathRoleCreate(ctx context.Context, req *logical.Request, data
 	if err != nil {
 		return logical.ErrorResponse(err.Error()), nil
 	}
+	err = b.checkRoleZones(ctx, req.Storage, entry)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
 
 	// Store it
 	jsonEntry, err := logical.StorageEntryJSON("role/"+name, entry)
@@ -413,6 +760,51 @@ func validateEntry(entry *roleEntry) (err error) {
 		}
 	}
 
+	if entry.ReuseIfValid && (!entry.StorePrivateKey || entry.NoStore) {
+		return fmt.Errorf(errorTextReuseRequiresStorePKey)
+	}
+	if entry.MinRemainingLifetime < 0 {
+		return fmt.Errorf(errorTextNegativeLifetime)
+	}
+	if entry.MaxIssuancesPerMinute < 0 || entry.MaxIssuancesPerDay < 0 || entry.MaxActivePerCN < 0 {
+		return fmt.Errorf(errorTextNegativeRateLimit)
+	}
+	if err := validateKeyCurves(entry.AllowedKeyCurves); err != nil {
+		return err
+	}
+	if _, err := usageExtensions(entry); err != nil {
+		return err
+	}
+	switch entry.KeyType {
+	case "":
+		entry.KeyType = "rsa"
+	case "rsa", "ec", "any":
+	default:
+		return fmt.Errorf(errorTextInvalidKeyType, entry.KeyType)
+	}
+	switch entry.KeyReuse {
+	case "":
+		entry.KeyReuse = keyReuseAllow
+	case keyReuseAllow, keyReuseDenyRevoked, keyReuseDeny:
+	default:
+		return fmt.Errorf(errorTextInvalidKeyReuse, entry.KeyReuse)
+	}
+	if err := validateObjectNameTemplate(entry.ObjectNameTemplate); err != nil {
+		return err
+	}
+	if err := validateZoneRoutes(entry.ZoneRoutes); err != nil {
+		return err
+	}
+	switch entry.SignCSRNames {
+	case "":
+		entry.SignCSRNames = signCSRNamesEnforce
+	case signCSRNamesEnforce, signCSRNamesStrict, signCSRNamesCSR:
+	case signCSRNamesOverride:
+		return fmt.Errorf(errorTextSignCSRNamesOverride)
+	default:
+		return fmt.Errorf(errorTextInvalidSignCSRNames, entry.SignCSRNames)
+	}
+
 	//StoreBySerial and StoreByCN options are deprecated
 	//if one of them is set we will set store_by option
 	//if both are set then we set store_by to serial
@@ -462,21 +854,82 @@ type roleEntry struct {
 	DeprecatedTTL    string        `json:"ttl"`
 	ServerTimeout    time.Duration `json:"server_timeout"`
 	VenafiSecret     string        `json:"venafi_secret"`
+
+	IdempotencyWindow     time.Duration `json:"idempotency_window"`
+	ReuseIfValid          bool          `json:"reuse_if_valid"`
+	MinRemainingLifetime  time.Duration `json:"min_remaining_lifetime"`
+	MaxIssuancesPerMinute int           `json:"max_issuances_per_minute"`
+	MaxIssuancesPerDay    int           `json:"max_issuances_per_day"`
+	MaxActivePerCN        int           `json:"max_active_per_cn"`
+	PKICompatible         bool          `json:"pki_compatible"`
+	SignCSRNames          string        `json:"sign_csr_names"`
+	AllowedDomains        []string      `json:"allowed_domains"`
+	AllowSubdomains       bool          `json:"allow_subdomains"`
+	AllowGlobDomains      bool          `json:"allow_glob_domains"`
+	AllowedOrganizations  []string      `json:"allowed_organizations"`
+	AllowedOUs            []string      `json:"allowed_ous"`
+	AllowedKeyCurves      []string      `json:"allowed_key_curves"`
+	RequireSHA256CSR      bool          `json:"require_sha256_csr"`
+	KeyReuse              string        `json:"key_reuse"`
+	AllowKeyReuseSameCN   bool          `json:"allow_key_reuse_same_cn"`
+	KeyUsage              []string      `json:"key_usage"`
+	ExtKeyUsage           []string      `json:"ext_key_usage"`
+	ExtKeyUsageOIDs       []string      `json:"ext_key_usage_oids"`
+	PolicyIdentifiers     []string      `json:"policy_identifiers"`
+	CATemplate            string        `json:"ca_template"`
+	AllowedCATemplates    []string      `json:"allowed_ca_templates"`
+	ObjectNameTemplate    string        `json:"object_name_template"`
+	ZoneRoutes            []zoneRoute   `json:"zone_routes"`
+
+	// Zone overrides the zone of the venafi secret, role copies routed by zone_routes have the zone of the route
+	Zone string `json:"zone,omitempty"`
+
+	BasicConstraintsValidForNonCA bool `json:"basic_constraints_valid_for_non_ca"`
+	AllowObjectNameOverride       bool `json:"allow_object_name_override"`
 }
 
 func (r *roleEntry) ToResponseData() map[string]interface{} {
 	responseData := map[string]interface{}{
-		"venafi_secret":          r.VenafiSecret,
-		"store_by":               r.StoreBy,
-		"no_store":               r.NoStore,
-		"store_by_cn":            r.StoreByCN,
-		"store_by_serial":        r.StoreBySerial,
-		"service_generated_cert": r.ServiceGenerated,
-		"store_pkey":             r.StorePrivateKey,
-		"ttl":                    int64(r.TTL.Seconds()),
-		"max_ttl":                int64(r.MaxTTL.Seconds()),
-		"generate_lease":         r.GenerateLease,
-		"chain_option":           r.ChainOption,
+		"venafi_secret":            r.VenafiSecret,
+		"store_by":                 r.StoreBy,
+		"no_store":                 r.NoStore,
+		"store_by_cn":              r.StoreByCN,
+		"store_by_serial":          r.StoreBySerial,
+		"service_generated_cert":   r.ServiceGenerated,
+		"store_pkey":               r.StorePrivateKey,
+		"ttl":                      int64(r.TTL.Seconds()),
+		"max_ttl":                  int64(r.MaxTTL.Seconds()),
+		"generate_lease":           r.GenerateLease,
+		"chain_option":             r.ChainOption,
+		"idempotency_window":       int64(r.IdempotencyWindow.Seconds()),
+		"reuse_if_valid":           r.ReuseIfValid,
+		"min_remaining_lifetime":   int64(r.MinRemainingLifetime.Seconds()),
+		"max_issuances_per_minute": r.MaxIssuancesPerMinute,
+		"max_issuances_per_day":    r.MaxIssuancesPerDay,
+		"max_active_per_cn":        r.MaxActivePerCN,
+		"pki_compatible":           r.PKICompatible,
+		"sign_csr_names":           r.SignCSRNames,
+		"allowed_domains":          r.AllowedDomains,
+		"allow_subdomains":         r.AllowSubdomains,
+		"allow_glob_domains":       r.AllowGlobDomains,
+		"allowed_organizations":    r.AllowedOrganizations,
+		"allowed_ous":              r.AllowedOUs,
+		"allowed_key_curves":       r.AllowedKeyCurves,
+		"require_sha256_csr":       r.RequireSHA256CSR,
+		"key_reuse":                r.KeyReuse,
+		"allow_key_reuse_same_cn":  r.AllowKeyReuseSameCN,
+		"key_usage":                r.KeyUsage,
+		"ext_key_usage":            r.ExtKeyUsage,
+		"ext_key_usage_oids":       r.ExtKeyUsageOIDs,
+		"policy_identifiers":       r.PolicyIdentifiers,
+		"ca_template":              r.CATemplate,
+		"allowed_ca_templates":     r.AllowedCATemplates,
+		"object_name_template":     r.ObjectNameTemplate,
+		"zone":                     r.Zone,
+		"zone_routes":              r.ZoneRoutes,
+
+		"basic_constraints_valid_for_non_ca": r.BasicConstraintsValidForNonCA,
+		"allow_object_name_override":         r.AllowObjectNameOverride,
 	}
 	return responseData
 }
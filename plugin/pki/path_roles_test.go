@@ -137,4 +137,19 @@ func TestRoleValidate(t *testing.T) {
 	if entry.StoreBy != storeByCNString {
 		t.Fatalf("Expecting store_by parameter will be set to %s", storeByCNString)
 	}
+
+	for _, keyType := range []string{"RSA", "ecdsa", "ed25519"} {
+		entry = &roleEntry{
+			VenafiSecret: "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx",
+			KeyType:      keyType,
+		}
+		err = validateEntry(entry)
+		if err == nil {
+			t.Fatalf("Expecting error for key type %s", keyType)
+		}
+		expectingError = fmt.Sprintf(errorTextInvalidKeyType, keyType)
+		if err.Error() != expectingError {
+			t.Fatalf("Expecting error %s but got %s", expectingError, err)
+		}
+	}
 }
@@ -5,11 +5,14 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"github.com/Venafi/vcert/pkg/endpoint"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/helper/consts"
 	"net"
+	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
 	"time"
@@ -20,7 +23,7 @@ import (
 )
 
 func pathVenafiCertEnroll(b *backend) *framework.Path {
-	return &framework.Path{
+	path := &framework.Path{
 		Pattern: "issue/" + framework.GenericNameRegex("role"),
 		Fields: map[string]*framework.FieldSchema{
 			"role": {
@@ -39,10 +42,39 @@ func pathVenafiCertEnroll(b *backend) *framework.Path {
 				Type:        framework.TypeCommaStringSlice,
 				Description: "The requested IP SANs, if any, in a comma-delimited list",
 			},
+			"uri_sans": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "The requested URI SANs, if any, in a comma-delimited list",
+			},
+			"exclude_cn_from_sans": {
+				Type:        framework.TypeBool,
+				Description: "If set, the common name is not added to the DNS or email SANs",
+			},
+			"ttl": {
+				Type: framework.TypeDurationSecond,
+				Description: `The requested lease duration, capped by max_ttl of the role and the expiration of the certificate.
+The validity of the certificate is defined by the Venafi policy`,
+			},
 			"key_password": {
 				Type:        framework.TypeString,
 				Description: "Password for encrypting private key",
 			},
+			"ca_template": {
+				Type:        framework.TypeString,
+				Description: `DN of the TPP CA template to request the certificate from, ca_template or one of allowed_ca_templates of the role. ca_template of the role if not set`,
+			},
+			"object_name": {
+				Type:        framework.TypeString,
+				Description: `TPP object name of the certificate, overrides object_name_template of the role if allow_object_name_override is set. The placeholders of the template can be used`,
+			},
+			"async": {
+				Type:        framework.TypeBool,
+				Description: `Set it to true to return a pickup ID immediately instead of waiting for the certificate to be issued. Use pickup/<pickup_id> to get the certificate`,
+			},
+			"idempotency_key": {
+				Type:        framework.TypeString,
+				Description: `Unique key of the request. A retry by the same entity or token with the same key and parameters returns the result of the first request instead of issuing another certificate`,
+			},
 		},
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.UpdateOperation: b.pathVenafiIssue,
@@ -51,10 +83,63 @@ func pathVenafiCertEnroll(b *backend) *framework.Path {
 		HelpSynopsis:    pathVenafiCertEnrollHelp,
 		HelpDescription: pathVenafiCertEnrollDesc,
 	}
+	for name, field := range pkiCompatFields(false) {
+		path.Fields[name] = field
+	}
+	return path
+}
+
+// pathVenafiCertSignVerbatim submits the CSR as it is, only the key type of the role is checked. It's a separate path
+// to be granted to trusted automation by ACL.
+func pathVenafiCertSignVerbatim(b *backend) *framework.Path {
+	path := &framework.Path{
+		Pattern: "sign-verbatim/" + framework.GenericNameRegex("role"),
+		Fields: map[string]*framework.FieldSchema{
+			"csr": {
+				Type:        framework.TypeString,
+				Description: `PEM-format CSR to be signed. Names and requested extensions of the CSR are submitted unchanged`,
+			},
+			"role": {
+				Type:        framework.TypeString,
+				Description: `The desired role with configuration for this request`,
+			},
+			"ttl": {
+				Type: framework.TypeDurationSecond,
+				Description: `The requested lease duration, capped by max_ttl of the role and the expiration of the certificate.
+The validity of the certificate is defined by the Venafi policy`,
+			},
+			"ca_template": {
+				Type:        framework.TypeString,
+				Description: `DN of the TPP CA template to request the certificate from, ca_template or one of allowed_ca_templates of the role. ca_template of the role if not set`,
+			},
+			"object_name": {
+				Type:        framework.TypeString,
+				Description: `TPP object name of the certificate, overrides object_name_template of the role if allow_object_name_override is set. The placeholders of the template can be used`,
+			},
+			"async": {
+				Type:        framework.TypeBool,
+				Description: `Set it to true to return a pickup ID immediately instead of waiting for the certificate to be issued. Use pickup/<pickup_id> to get the certificate`,
+			},
+			"idempotency_key": {
+				Type:        framework.TypeString,
+				Description: `Unique key of the request. A retry by the same entity or token with the same key and parameters returns the result of the first request instead of issuing another certificate`,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathVenafiSignVerbatim,
+		},
+
+		HelpSynopsis:    pathVenafiCertSignVerbatimHelp,
+		HelpDescription: pathVenafiCertSignVerbatimDesc,
+	}
+	for name, field := range pkiCompatFields(true) {
+		path.Fields[name] = field
+	}
+	return path
 }
 
 func pathVenafiCertSign(b *backend) *framework.Path {
-	return &framework.Path{
+	path := &framework.Path{
 		Pattern: "sign/" + framework.GenericNameRegex("role"),
 		Fields: map[string]*framework.FieldSchema{
 			"csr": {
@@ -65,6 +150,47 @@ func pathVenafiCertSign(b *backend) *framework.Path {
 				Type:        framework.TypeString,
 				Description: `The desired role with configuration for this request`,
 			},
+			"common_name": {
+				Type:        framework.TypeString,
+				Description: "Requested common name, checked against the CSR according to sign_csr_names of the role",
+			},
+			"alt_names": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Requested alternative names, checked against the CSR according to sign_csr_names of the role",
+			},
+			"ip_sans": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Requested IP SANs, checked against the CSR according to sign_csr_names of the role",
+			},
+			"uri_sans": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Requested URI SANs, checked against the CSR according to sign_csr_names of the role",
+			},
+			"exclude_cn_from_sans": {
+				Type:        framework.TypeBool,
+				Description: "If set, the common name isn't expected in the SANs of the CSR in strict sign_csr_names mode",
+			},
+			"ttl": {
+				Type: framework.TypeDurationSecond,
+				Description: `The requested lease duration, capped by max_ttl of the role and the expiration of the certificate.
+The validity of the certificate is defined by the Venafi policy`,
+			},
+			"ca_template": {
+				Type:        framework.TypeString,
+				Description: `DN of the TPP CA template to request the certificate from, ca_template or one of allowed_ca_templates of the role. ca_template of the role if not set`,
+			},
+			"object_name": {
+				Type:        framework.TypeString,
+				Description: `TPP object name of the certificate, overrides object_name_template of the role if allow_object_name_override is set. The placeholders of the template can be used`,
+			},
+			"async": {
+				Type:        framework.TypeBool,
+				Description: `Set it to true to return a pickup ID immediately instead of waiting for the certificate to be issued. Use pickup/<pickup_id> to get the certificate`,
+			},
+			"idempotency_key": {
+				Type:        framework.TypeString,
+				Description: `Unique key of the request. A retry by the same entity or token with the same key and parameters returns the result of the first request instead of issuing another certificate`,
+			},
 		},
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.UpdateOperation: b.pathVenafiSign,
@@ -73,6 +199,10 @@ func pathVenafiCertSign(b *backend) *framework.Path {
 		HelpSynopsis:    pathVenafiCertSignHelp,
 		HelpDescription: pathVenafiCertSignDesc,
 	}
+	for name, field := range pkiCompatFields(true) {
+		path.Fields[name] = field
+	}
+	return path
 }
 
 func (b *backend) pathVenafiIssue(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -84,14 +214,15 @@ func (b *backend) pathVenafiIssue(ctx context.Context, req *logical.Request, dat
 		return nil, err
 	}
 	if role == nil {
-		return logical.ErrorResponse(fmt.Sprintf("unknown role: %s", roleName)), nil
+		return venafiErrorResponse(req, invalidRequest(fmt.Errorf("unknown role: %s", roleName)))
 	}
 
 	if role.KeyType == "any" {
-		return logical.ErrorResponse("role key type \"any\" not allowed for issuing certificates, only signing"), nil
+		return venafiErrorResponse(req, invalidRequest(errors.New(
+			"role key type \"any\" not allowed for issuing certificates, only signing")))
 	}
 
-	return b.pathVenafiCertObtain(ctx, req, data, role, false)
+	return b.pathVenafiCertObtain(ctx, req, data, role, false, false)
 }
 
 // pathSign issues a certificate from a submitted CSR, subject to role
@@ -105,19 +236,36 @@ func (b *backend) pathVenafiSign(ctx context.Context, req *logical.Request, data
 		return nil, err
 	}
 	if role == nil {
-		return logical.ErrorResponse(fmt.Sprintf("unknown role: %s", roleName)), nil
+		return venafiErrorResponse(req, invalidRequest(fmt.Errorf("unknown role: %s", roleName)))
+	}
+
+	return b.pathVenafiCertObtain(ctx, req, data, role, true, false)
+}
+
+// pathVenafiSignVerbatim signs the CSR without the domain and subject restrictions of the role
+func (b *backend) pathVenafiSignVerbatim(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	roleName := data.Get("role").(string)
+
+	role, err := b.getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return venafiErrorResponse(req, invalidRequest(fmt.Errorf("unknown role: %s", roleName)))
 	}
 
-	return b.pathVenafiCertObtain(ctx, req, data, role, true)
+	return b.pathVenafiCertObtain(ctx, req, data, role, true, true)
 }
 
-func (b *backend) pathVenafiCertObtain(ctx context.Context, req *logical.Request, data *framework.FieldData, role *roleEntry, signCSR bool) (
-	*logical.Response, error) {
+func (b *backend) pathVenafiCertObtain(ctx context.Context, req *logical.Request, data *framework.FieldData, role *roleEntry, signCSR bool,
+	verbatim bool) (*logical.Response, error) {
 
 	// When utilizing performance standbys in Vault Enterprise, this forces the call to be redirected to the primary since
 	// a storage call is made after the API calls to issue the certificate.  This prevents the certificate from being
 	// issued twice in this scenario.
-	if !role.NoStore && b.System().ReplicationState().
+	async := data.Get("async").(bool)
+	_, idempotent := data.GetOk("idempotency_key")
+	if (!role.NoStore || async || idempotent || hasRateLimits(role)) && b.System().ReplicationState().
 		HasState(consts.ReplicationPerformanceStandby|consts.ReplicationPerformanceSecondary) {
 		return nil, logical.ErrReadOnly
 	}
@@ -125,17 +273,47 @@ func (b *backend) pathVenafiCertObtain(ctx context.Context, req *logical.Request
 	b.Logger().Debug("Getting the role\n")
 	roleName := data.Get("role").(string)
 
-	b.Logger().Debug("Creating Venafi client:")
-	cl, timeout, err := b.ClientVenafi(ctx, req.Storage, data, req, roleName)
-	if err != nil {
-		return logical.ErrorResponse(err.Error()), nil
+	idem, resp, err := b.startIdempotentRequest(ctx, req, data, roleName, role)
+	if resp != nil || err != nil {
+		return resp, err
 	}
 
+	resp, err = b.obtainCertificate(ctx, req, data, role, roleName, signCSR, verbatim, idem)
+	b.finishIdempotentRequest(ctx, req.Storage, idem, role, resp, err)
+
+	failed := failedResponseData(resp)
+	if (err != nil || failed != nil) && failed["error_code"] != errorCodeRateLimited {
+		// requests refused by the rate limits are not recorded, so they can't flood the history.
+		// sign-verbatim has no common_name parameter
+		commonNameRaw, _ := data.GetOk("common_name")
+		commonName, _ := commonNameRaw.(string)
+		event := &historyEvent{
+			Event:        historyEventIssued,
+			Role:         roleName,
+			VenafiSecret: role.VenafiSecret,
+			CommonName:   commonName,
+			Outcome:      historyOutcomeFailure,
+			Error:        failedResponseError(resp, err),
+		}
+		if signCSR {
+			event.Event = historyEventSigned
+		}
+		b.recordHistory(ctx, req, event)
+	}
+	return resp, err
+}
+
+func (b *backend) obtainCertificate(ctx context.Context, req *logical.Request, data *framework.FieldData, role *roleEntry,
+	roleName string, signCSR bool, verbatim bool, idem *idempotentRequest) (*logical.Response, error) {
+
+	async := data.Get("async").(bool)
+
 	var certReq *certificate.Request
 	var reqData requestData
+	var err error
 
 	if data == nil {
-		return logical.ErrorResponse("data can't be nil"), nil
+		return venafiErrorResponse(req, invalidRequest(errors.New("data can't be nil")))
 	}
 
 	commonNameRaw, ok := data.GetOk("common_name")
@@ -153,6 +331,27 @@ func (b *backend) pathVenafiCertObtain(ctx context.Context, req *logical.Request
 		reqData.ipSANs = ipSANsRaw.([]string)
 	}
 
+	uriSANsRaw, ok := data.GetOk("uri_sans")
+	if ok {
+		reqData.uriSANs = uriSANsRaw.([]string)
+	}
+
+	excludeCNFromSANsRaw, ok := data.GetOk("exclude_cn_from_sans")
+	if ok {
+		reqData.excludeCNFromSANs = excludeCNFromSANsRaw.(bool)
+	}
+
+	reqData.verbatim = verbatim
+	reqData.caTemplate, err = selectCATemplate(role, data.Get("ca_template").(string))
+	if err != nil {
+		return venafiErrorResponse(req, policyViolation(err))
+	}
+	objectNameTemplate, err := selectObjectNameTemplate(role, data.Get("object_name").(string))
+	if err != nil {
+		return venafiErrorResponse(req, policyViolation(err))
+	}
+	ttl := time.Duration(data.Get("ttl").(int)) * time.Second
+
 	keyPasswordRaw, ok := data.GetOk("key_password")
 	if ok {
 		reqData.keyPassword = keyPasswordRaw.(string)
@@ -163,13 +362,71 @@ func (b *backend) pathVenafiCertObtain(ctx context.Context, req *logical.Request
 		reqData.csrString = csrStringRaw.(string)
 	}
 
+	compatEnabled, err := b.pkiCompatEnabled(ctx, req.Storage, role)
+	if err != nil {
+		return nil, err
+	}
+	compat, err := parsePKICompatOptions(data, compatEnabled)
+	if err != nil {
+		return venafiErrorResponse(req, invalidRequest(err))
+	}
+
 	certReq, err = formRequest(reqData, role, signCSR, b.Logger())
 	if err != nil {
-		return logical.ErrorResponse(err.Error()), nil
+		return venafiErrorResponse(req, err)
+	}
+	if signCSR && reqData.commonName == "" {
+		reqData.commonName = requestCommonName(certReq)
+	}
+	// sign-verbatim skips the role restrictions on the names, but not the key_reuse policy
+	var csrPublicKey []byte
+	if signCSR {
+		block, _ := pem.Decode(certReq.GetCSR())
+		if block == nil {
+			return venafiErrorResponse(req, invalidRequest(errors.New("can't decode the CSR")))
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			return venafiErrorResponse(req, invalidRequest(err))
+		}
+		csrPublicKey = csr.RawSubjectPublicKeyInfo
+	}
+
+	role, err = b.routeRequest(ctx, req.Storage, role, requestNames(certReq))
+	if err != nil {
+		return venafiErrorResponse(req, policyViolation(err))
+	}
+
+	if role.ReuseIfValid && !signCSR && reqData.keyPassword == "" {
+		cert, parsedCertificate, err := b.findReusableCertificate(ctx, req.Storage, roleName, role, certReq)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil {
+			b.Logger().Debug("Reusing certificate " + cert.SerialNumber)
+			pcc := &certificate.PEMCollection{Certificate: cert.Certificate, PrivateKey: cert.PrivateKey}
+			resp, err := b.certificateResponse(role, roleName, reqData.commonName, cert.SerialNumber, cert.CertificateChain, pcc,
+				parsedCertificate, signCSR, ttl, compat)
+			if err != nil {
+				return nil, err
+			}
+			resp.AddWarning(fmt.Sprintf(warningTextCertificateReused, cert.SerialNumber))
+			return resp, nil
+		}
+	}
+
+	b.Logger().Debug("Creating Venafi client:")
+	cl, timeout, err := b.clientVenafiWithRetry(ctx, req, data, roleName, role)
+	if err != nil {
+		return venafiErrorResponse(req, err)
 	}
 
 	b.Logger().Debug("Making certificate request")
-	err = cl.GenerateRequest(nil, certReq)
+	started := time.Now()
+	err = b.callVenafi(ctx, role.VenafiSecret, "generate request", true, func() error {
+		return cl.GenerateRequest(nil, certReq)
+	})
+	b.measureVenafiCall("generate_request", roleName, cl, started, metricOutcome(err))
 	if (err != nil) && (cl.GetType() == endpoint.ConnectorTypeTPP) {
 		msg := err.Error()
 
@@ -179,54 +436,252 @@ func (b *backend) pathVenafiCertObtain(ctx context.Context, req *logical.Request
 		//validate if the error is related to a expired accces token, at this moment the only way can validate this is using the error message
 		//and verify if that message describes errors related to expired access token.
 		if (strings.Contains(msg, "\"error\":\"expired_token\"") && strings.Contains(msg, "\"error_description\":\"Access token expired\"")) || regex.MatchString(msg) {
-			cfg, err := b.getConfig(ctx, req, roleName, true)
+			cfg, err := b.getRoleConfig(ctx, req, role, true)
 
 			if err != nil {
-				return logical.ErrorResponse(err.Error()), nil
+				return venafiErrorResponse(req, err)
 			}
 
-			if cfg.Credentials.RefreshToken != "" {
-				err = updateAccessToken(cfg, b, ctx, req, roleName)
+			if cfg.Credentials.RefreshToken != "" || cfg.Credentials.ClientPKCS12 {
+				err = updateAccessToken(cfg, b, ctx, req, role.VenafiSecret)
+				b.countTokenRefresh(roleName, err)
 
 				if err != nil {
-					return logical.ErrorResponse(err.Error()), nil
+					return venafiErrorResponse(req, err)
 				}
 
 				//everything went fine so get the new client with the new refreshed access token
-				cl, timeout, err = b.ClientVenafi(ctx, req.Storage, data, req, roleName)
+				cl, timeout, err = b.clientVenafiWithRetry(ctx, req, data, roleName, role)
 				if err != nil {
-					return logical.ErrorResponse(err.Error()), nil
+					return venafiErrorResponse(req, err)
 				}
 
 				b.Logger().Debug("Making certificate request again")
 
-				err = cl.GenerateRequest(nil, certReq)
+				started = time.Now()
+				err = b.callVenafi(ctx, role.VenafiSecret, "generate request", true, func() error {
+					return cl.GenerateRequest(nil, certReq)
+				})
+				b.measureVenafiCall("generate_request", roleName, cl, started, metricOutcome(err))
 				if err != nil {
-					return logical.ErrorResponse(err.Error()), nil
+					return venafiErrorResponse(req, err)
 				}
 			} else {
-				return logical.ErrorResponse("Tried to get new access token, but refresh token is empty"), nil
+				return venafiErrorResponse(req, venafiErrorf(errorCodeAuthFailed, http.StatusForbidden,
+					"Tried to get new access token, but refresh token is empty"))
 			}
 		} else {
-			return logical.ErrorResponse(err.Error()), nil
+			return venafiErrorResponse(req, err)
 		}
 	}
 
+	pending, err := newPendingRequest(roleName, reqData.commonName, signCSR, certReq)
+	if err != nil {
+		return nil, err
+	}
+	pending.Requester = idempotencyRequester(req)
+	if idem != nil {
+		pending.IdempotencyPath = idem.path
+	}
+	pending.TTL = ttl
+	pending.PKICompat = compat
+	if len(role.ZoneRoutes) > 0 {
+		pending.VenafiSecret, pending.Zone = role.VenafiSecret, role.Zone
+	}
+
+	if objectNameTemplate != "" {
+		values := objectNameValues{
+			role:       roleName,
+			commonName: requestCommonName(certReq),
+			requestID:  pending.ID,
+			timestamp:  pending.Created,
+		}
+		if req.EntityID != "" {
+			entity, err := b.System().EntityInfo(req.EntityID)
+			if err != nil {
+				return nil, err
+			}
+			if entity != nil {
+				values.entityName = entity.Name
+			}
+		}
+		certReq.FriendlyName, err = expandObjectName(objectNameTemplate, values)
+		if err != nil {
+			return venafiErrorResponse(req, invalidRequest(err))
+		}
+		pending.ObjectName = certReq.FriendlyName
+	}
+
+	if csrPublicKey != nil {
+		err = b.reservePublicKey(ctx, req.Storage, role, pending, requestCommonName(certReq), csrPublicKey)
+		if err != nil {
+			return venafiErrorResponse(req, policyViolation(err))
+		}
+	}
+
+	// The WAL entry keeps the request and the private key until the certificate is stored, so that the rollback can
+	// complete the issuance if Vault goes down in between. Nothing is stored when no_store is set.
+	var walID string
+	if !role.NoStore || async {
+		walID, err = framework.PutWAL(ctx, req.Storage, walIssuanceKind, pending)
+		if err != nil {
+			b.releasePendingKey(ctx, req.Storage, pending)
+			return nil, err
+		}
+	}
+
+	pending.Reserved, err = b.reserveIssuance(ctx, req.Storage, roleName, role, requestCommonName(certReq))
+	if err != nil {
+		b.deleteWAL(ctx, req.Storage, walID)
+		b.releasePendingKey(ctx, req.Storage, pending)
+		if isRateLimited(err) {
+			return venafiErrorResponse(req, err)
+		}
+		return nil, err
+	}
+
 	b.Logger().Debug("Running enroll request")
 
-	requestID, err := cl.RequestCertificate(certReq)
+	// requesting is not idempotent, so it's never retried
+	var requestID string
+	started = time.Now()
+	err = b.callVenafi(ctx, role.VenafiSecret, "request certificate", false, func() (err error) {
+		requestID, err = cl.RequestCertificate(certReq)
+		return err
+	})
+	b.measureVenafiCall("request_certificate", roleName, cl, started, metricOutcome(err))
 	if err != nil {
-		return logical.ErrorResponse(err.Error()), nil
+		b.deleteWAL(ctx, req.Storage, walID)
+		b.releaseRejectedIssuance(ctx, req.Storage, pending)
+		return venafiErrorResponse(req, err)
 	}
 
-	pickupReq := &certificate.Request{
-		PickupID: requestID,
-		Timeout:  timeout,
+	pending.PickupID = requestID
+	walID, err = b.updateWAL(ctx, req.Storage, walID, walIssuanceKind, pending)
+	if err != nil {
+		return nil, err
+	}
+
+	if async {
+		err = b.storePendingRequest(ctx, req.Storage, pending)
+		if err != nil {
+			return nil, err
+		}
+		b.deleteWAL(ctx, req.Storage, walID)
+		b.Logger().Debug("Certificate request is saved with pickup ID " + pending.ID)
+		return pending.toResponse(statusPending), nil
+	}
+
+	pcc, err := b.retrieveCertificate(ctx, cl, role, pending, timeout)
+	var timeoutErr endpoint.ErrRetrieveCertificateTimeout
+	switch {
+	case err != nil && (ctx.Err() != nil || errors.As(err, &timeoutErr)):
+		// keep the request, so the certificate can be picked up later instead of requesting it again
+		idem.savedForPickup(pending.ID)
+		return b.suspendIssuance(ctx, req, pending, walID, err)
+	case err != nil && isRetrievalRetryable(err):
+		idem.savedForPickup(pending.ID)
+		return b.failIssuance(ctx, req, pending, walID, err)
+	case err != nil:
+		// the request is rejected, it can't be picked up later
+		b.deleteWAL(ctx, req.Storage, walID)
+		b.releaseRejectedIssuance(ctx, req.Storage, pending)
+		return venafiErrorResponse(req, err)
+	}
+
+	pcc.PrivateKey = pending.PrivateKey
+	resp, err := b.storeCertificate(ctx, req, role, pending, pcc)
+	if err != nil {
+		return nil, err
 	}
-	pcc, err := cl.RetrieveCertificate(pickupReq)
+	b.deleteWAL(ctx, req.Storage, walID)
+	return resp, nil
+}
+
+// releaseRejectedIssuance stops counting the request rejected by Venafi for the rate limits of the role and releases
+// the key of its CSR
+func (b *backend) releaseRejectedIssuance(ctx context.Context, s logical.Storage, pending *pendingRequest) {
+	err := b.releaseIssuance(ctx, s, pending.Role, pending.Reserved)
 	if err != nil {
-		return logical.ErrorResponse(err.Error()), nil
+		b.Logger().Warn(fmt.Sprintf("Error releasing issuance reservation of role %s: %s", pending.Role, err))
 	}
+	b.releasePendingKey(ctx, s, pending)
+}
+
+// releasePendingKey releases the key of the CSR reserved by the request which won't be completed
+func (b *backend) releasePendingKey(ctx context.Context, s logical.Storage, pending *pendingRequest) {
+	err := b.releasePublicKey(ctx, s, pending)
+	if err != nil {
+		b.Logger().Warn(fmt.Sprintf("Error releasing key reservation of request %s: %s", pending.ID, err))
+	}
+}
+
+// suspendIssuance saves the request for pickup when waiting for the certificate is interrupted.
+// The request context may be already canceled, so the storage is accessed with a new one.
+func (b *backend) suspendIssuance(ctx context.Context, req *logical.Request, pending *pendingRequest, walID string,
+	cause error) (*logical.Response, error) {
+
+	storageCtx, cancel := context.WithTimeout(context.Background(), suspendStorageTimeout)
+	defer cancel()
+
+	err := b.storePendingRequest(storageCtx, req.Storage, pending)
+	if err != nil {
+		return nil, err
+	}
+	b.deleteWAL(storageCtx, req.Storage, walID)
+
+	b.Logger().Warn(fmt.Sprintf("Waiting for certificate %s is stopped (%s), it's saved with pickup ID %s",
+		pending.PickupID, cause, pending.ID))
+	if ctx.Err() != nil {
+		resp := pending.toResponse(statusPending)
+		resp.AddWarning(fmt.Sprintf(warningTextIssuanceSuspended, ctx.Err(), pending.Role, pending.ID))
+		return resp, nil
+	}
+	return venafiErrorResponse(req, venafiErrorf(errorCodeTimeout, http.StatusGatewayTimeout, errorTextRetrieveTimeout,
+		pending.Role, pending.ID).savedForPickup(pending.ID))
+}
+
+// failIssuance saves the request for pickup when retrieving the certificate fails with an error which may go away,
+// like Venafi being unavailable. The request exists in Venafi, so it's kept with the error instead of being completed
+// later by the rollback of the WAL entry.
+func (b *backend) failIssuance(ctx context.Context, req *logical.Request, pending *pendingRequest, walID string,
+	cause error) (*logical.Response, error) {
+
+	saved := *pending
+	saved.Error = cause.Error()
+	err := b.storePendingRequest(ctx, req.Storage, &saved)
+	if err != nil {
+		return nil, err
+	}
+	b.deleteWAL(ctx, req.Storage, walID)
+
+	b.Logger().Warn(fmt.Sprintf("Retrieving certificate %s failed (%s), it's saved with pickup ID %s",
+		pending.PickupID, cause, pending.ID))
+	classified := classifyVenafiError(cause)
+	return venafiErrorResponse(req, venafiErrorf(classified.code, classified.status, errorTextRetrieveFailed, cause,
+		pending.Role, pending.ID).savedForPickup(pending.ID))
+}
+
+// clientVenafiWithRetry creates the Venafi client of the role, authentication is retried on transient errors
+func (b *backend) clientVenafiWithRetry(ctx context.Context, req *logical.Request, data *framework.FieldData, roleName string,
+	role *roleEntry) (cl endpoint.Connector, timeout time.Duration, err error) {
+
+	b.Logger().Debug(fmt.Sprintf("Using role %s with venafi secret %s", roleName, role.VenafiSecret))
+	err = b.callVenafi(ctx, role.VenafiSecret, "create client", true, func() (err error) {
+		cl, timeout, err = b.roleClientVenafi(ctx, req, role)
+		return err
+	})
+	return cl, timeout, err
+}
+
+// storeCertificate saves the issued certificate of the request according to the role settings and builds the response.
+// The private key is expected to be already added to the collection when the CSR was generated locally.
+// A certificate which is already stored, when the rollback of the WAL entry runs after a completed issuance, is only
+// returned, so it's never recorded twice and it doesn't replace a newer certificate of the CN.
+func (b *backend) storeCertificate(ctx context.Context, req *logical.Request, role *roleEntry, pending *pendingRequest,
+	pcc *certificate.PEMCollection) (*logical.Response, error) {
+
+	roleName, commonName, signCSR := pending.Role, pending.CommonName, pending.SignCSR
 
 	pemBlock, _ := pem.Decode([]byte(pcc.Certificate))
 	parsedCertificate, err := x509.ParseCertificate(pemBlock.Bytes)
@@ -241,11 +696,14 @@ func (b *backend) pathVenafiCertObtain(ctx context.Context, req *logical.Request
 	var entry *logical.StorageEntry
 	chain := strings.Join(append([]string{pcc.Certificate}, pcc.Chain...), "\n")
 
-	if !signCSR {
-		err = pcc.AddPrivateKey(certReq.PrivateKey, []byte(data.Get("key_password").(string)))
-		if err != nil {
-			return nil, err
-		}
+	stored, err := b.isCertificateStored(ctx, req.Storage, serialNumber)
+	if err != nil {
+		return nil, err
+	}
+	if stored {
+		b.Logger().Debug("Certificate " + serialNumber + " is already stored")
+		return b.certificateResponse(role, roleName, commonName, serialNumber, chain, pcc, parsedCertificate, signCSR,
+			pending.TTL, pending.PKICompat)
 	}
 
 	if role.StorePrivateKey && !signCSR {
@@ -254,24 +712,59 @@ func (b *backend) pathVenafiCertObtain(ctx context.Context, req *logical.Request
 			CertificateChain: chain,
 			PrivateKey:       pcc.PrivateKey,
 			SerialNumber:     serialNumber,
+			CATemplate:       pending.CATemplate,
+			ObjectName:       pending.ObjectName,
+			Role:             roleName,
+			VenafiSecret:     pending.VenafiSecret,
+			Zone:             pending.Zone,
 		})
 	} else {
 		entry, err = logical.StorageEntryJSON("", VenafiCert{
 			Certificate:      pcc.Certificate,
 			CertificateChain: chain,
 			SerialNumber:     serialNumber,
+			CATemplate:       pending.CATemplate,
+			ObjectName:       pending.ObjectName,
+			Role:             roleName,
+			VenafiSecret:     pending.VenafiSecret,
+			Zone:             pending.Zone,
 		})
 	}
 	if err != nil {
 		return nil, err
 	}
 
+	event := &historyEvent{
+		Event:        historyEventIssued,
+		Role:         roleName,
+		VenafiSecret: role.VenafiSecret,
+		SerialNumber: serialNumber,
+		CommonName:   commonName,
+		Certificate:  pcc.Certificate,
+	}
+	if signCSR {
+		event.Event = historyEventSigned
+	}
+
 	//if no_store is not specified
 	if !role.NoStore {
 		if role.StoreBy == storeByCNString {
 			//Writing certificate to the storage with CN
-			b.Logger().Debug("Writing certificate to the certs/" + reqData.commonName)
-			entry.Key = "certs/" + reqData.commonName
+			b.Logger().Debug("Writing certificate to the certs/" + commonName)
+			entry.Key = "certs/" + commonName
+
+			// the certificate replaces the previous one of the CN, the history keeps the trace
+			previous, err := req.Storage.Get(ctx, entry.Key)
+			if err != nil {
+				return nil, err
+			}
+			if previous != nil {
+				var previousCert VenafiCert
+				if err := previous.DecodeJSON(&previousCert); err == nil && previousCert.SerialNumber != serialNumber {
+					event.Event = historyEventRenewed
+					event.PreviousSerial = previousCert.SerialNumber
+				}
+			}
 
 			if err := req.Storage.Put(ctx, entry); err != nil {
 				b.Logger().Error("Error putting entry to storage: " + err.Error())
@@ -288,26 +781,86 @@ func (b *backend) pathVenafiCertObtain(ctx context.Context, req *logical.Request
 			}
 		}
 
+		if role.StorePrivateKey && !signCSR {
+			err = b.indexCertificate(ctx, req.Storage, roleName, entry.Key, parsedCertificate, pcc.PrivateKey)
+			if err != nil {
+				b.Logger().Warn("Error indexing certificate " + entry.Key + ": " + err.Error())
+			}
+		}
 	}
 
-	var respData map[string]interface{}
+	err = b.recordActiveCertificate(ctx, req.Storage, roleName, role, parsedCertificate)
+	if err != nil {
+		b.Logger().Warn("Error counting active certificate " + serialNumber + ": " + err.Error())
+	}
+	err = b.indexPublicKey(ctx, req.Storage, roleName, pending.ID, serialNumber, commonName,
+		parsedCertificate.RawSubjectPublicKeyInfo)
+	if err != nil {
+		b.Logger().Warn("Error indexing public key of certificate " + serialNumber + ": " + err.Error())
+	}
+	b.recordHistory(ctx, req, event)
+
+	resp, err := b.certificateResponse(role, roleName, commonName, serialNumber, chain, pcc, parsedCertificate, signCSR,
+		pending.TTL, pending.PKICompat)
+	if err != nil {
+		return nil, err
+	}
 	if !signCSR {
+		// the CA can ignore the usages requested in the CSR
+		if missing := missingUsages(role, parsedCertificate); len(missing) > 0 {
+			b.Logger().Warn(fmt.Sprintf("Certificate %s is issued without the requested usages: %s", serialNumber,
+				strings.Join(missing, ", ")))
+			resp.AddWarning(fmt.Sprintf(warningTextUsagesDropped, strings.Join(missing, ", ")))
+		}
+	}
+	return resp, nil
+}
+
+// certificateResponse builds the response of issue and sign requests. With the PKI compatibility options the
+// response has the schema of the built-in PKI secrets engine. The lease duration is capped by the requested ttl.
+func (b *backend) certificateResponse(role *roleEntry, roleName string, commonName string, serialNumber string, chain string,
+	pcc *certificate.PEMCollection, parsedCertificate *x509.Certificate, signCSR bool, ttl time.Duration,
+	compat *pkiCompatOptions) (*logical.Response, error) {
+
+	var respData map[string]interface{}
+	var err error
+	if compat != nil {
+		respData, err = pkiCompatResponseData(compat, role, serialNumber, chain, pcc.Certificate, pcc.PrivateKey,
+			parsedCertificate, signCSR)
+		if err != nil {
+			return nil, err
+		}
+	} else if !signCSR {
 		respData = map[string]interface{}{
-			"common_name":       reqData.commonName,
+			"common_name":       commonName,
 			"serial_number":     serialNumber,
 			"certificate_chain": chain,
 			"certificate":       pcc.Certificate,
 			"private_key":       pcc.PrivateKey,
 		}
 	} else {
+		// issuing_ca and ca_chain are returned for clients of the PKI secrets engine, like cert-manager
+		caCerts := caChain(chain, pcc.Certificate, role.ChainOption)
+		issuingCA := ""
+		if len(caCerts) > 0 {
+			issuingCA = caCerts[0]
+		}
 		respData = map[string]interface{}{
-			"common_name":       reqData.commonName,
+			"common_name":       commonName,
 			"serial_number":     serialNumber,
 			"certificate_chain": chain,
 			"certificate":       pcc.Certificate,
+			"issuing_ca":        issuingCA,
+			"ca_chain":          caCerts,
 		}
 	}
 
+	if len(role.ZoneRoutes) > 0 {
+		// the zone the request was routed to
+		respData["zone"] = role.Zone
+		respData["venafi_secret"] = role.VenafiSecret
+	}
+
 	var logResp *logical.Response
 	switch {
 	case !role.GenerateLease:
@@ -321,8 +874,10 @@ func (b *backend) pathVenafiCertObtain(ctx context.Context, req *logical.Request
 			respData,
 			map[string]interface{}{
 				"serial_number": serialNumber,
+				"role":          roleName,
+				"common_name":   commonName,
 			})
-		TTL := time.Until(parsedCertificate.NotAfter)
+		TTL := leaseTTL(role, ttl, time.Until(parsedCertificate.NotAfter))
 		b.Logger().Debug("Setting up secret lease duration to: " + TTL.String())
 		logResp.Secret.TTL = TTL
 	}
@@ -333,12 +888,28 @@ func (b *backend) pathVenafiCertObtain(ctx context.Context, req *logical.Request
 	return logResp, nil
 }
 
+// leaseTTL is the lease duration of the certificate, capped by the requested ttl and max_ttl of the role
+func leaseTTL(role *roleEntry, requested time.Duration, certTTL time.Duration) time.Duration {
+	ttl := certTTL
+	if requested > 0 && requested < ttl {
+		ttl = requested
+	}
+	if role.MaxTTL > 0 && role.MaxTTL < ttl {
+		ttl = role.MaxTTL
+	}
+	return ttl
+}
+
 type requestData struct {
-	commonName  string
-	altNames    []string
-	ipSANs      []string
-	keyPassword string
-	csrString   string
+	commonName        string
+	altNames          []string
+	ipSANs            []string
+	uriSANs           []string
+	keyPassword       string
+	csrString         string
+	excludeCNFromSANs bool
+	verbatim          bool
+	caTemplate        string
 }
 
 func formRequest(reqData requestData, role *roleEntry, signCSR bool, logger hclog.Logger) (certReq *certificate.Request, err error) {
@@ -349,7 +920,10 @@ func formRequest(reqData requestData, role *roleEntry, signCSR bool, logger hclo
 		if len(reqData.commonName) == 0 && len(reqData.altNames) > 0 {
 			reqData.commonName = reqData.altNames[0]
 		}
-		if !sliceContains(reqData.altNames, reqData.commonName) {
+		if err := checkAllowedNames(role, append([]string{reqData.commonName}, reqData.altNames...)...); err != nil {
+			return certReq, policyViolation(err)
+		}
+		if !reqData.excludeCNFromSANs && !sliceContains(reqData.altNames, reqData.commonName) {
 			logger.Debug(fmt.Sprintf("Adding CN %s to SAN %s because it wasn't included.", reqData.commonName, reqData.altNames))
 			reqData.altNames = append(reqData.altNames, reqData.commonName)
 		}
@@ -383,6 +957,20 @@ func formRequest(reqData requestData, role *roleEntry, signCSR bool, logger hclo
 		for k := range nameSet {
 			certReq.DNSNames = append(certReq.DNSNames, k)
 		}
+		extensions, err := usageExtensions(role)
+		if err != nil {
+			return certReq, err
+		}
+		if len(extensions) > 0 {
+			certReq.Attributes = append(certReq.Attributes, extensionRequest(extensions))
+		}
+		for _, v := range reqData.uriSANs {
+			uri, err := url.Parse(v)
+			if err != nil {
+				return certReq, fmt.Errorf("invalid URI SAN %s: %v", v, err)
+			}
+			certReq.URIs = append(certReq.URIs, uri)
+		}
 
 	} else {
 		logger.Debug("Signing user provided CSR")
@@ -399,7 +987,23 @@ func formRequest(reqData requestData, role *roleEntry, signCSR bool, logger hclo
 		if err != nil {
 			return certReq, fmt.Errorf("can't parse provided CSR %v", err)
 		}
-		reqData.commonName = csr.Subject.CommonName
+		if err := checkCSRSignature(csr, role); err != nil {
+			return certReq, err
+		}
+		if err := checkCSRKeyType(csr, role); err != nil {
+			return certReq, policyViolation(err)
+		}
+		if !reqData.verbatim {
+			if err := checkCSRKeyParams(csr, role); err != nil {
+				return certReq, policyViolation(err)
+			}
+			if err := checkCSRNames(csr, reqData, role.SignCSRNames); err != nil {
+				return certReq, policyViolation(err)
+			}
+			if err := checkCSRRestrictions(csr, role); err != nil {
+				return certReq, policyViolation(err)
+			}
+		}
 		certReq = &certificate.Request{
 			CsrOrigin: certificate.UserProvidedCSR,
 		}
@@ -438,6 +1042,8 @@ func formRequest(reqData requestData, role *roleEntry, signCSR bool, logger hclo
 		return certReq, fmt.Errorf("Invalid chain option %s", role.ChainOption)
 	}
 
+	certReq.CADN = reqData.caTemplate
+
 	//Adding origin custom field with utility name to certificate metadata
 	certReq.CustomFields = []certificate.CustomField{{Type: certificate.CustomFieldOrigin, Value: utilityName}}
 
@@ -449,8 +1055,33 @@ type VenafiCert struct {
 	CertificateChain string `json:"certificate_chain"`
 	PrivateKey       string `json:"private_key"`
 	SerialNumber     string `json:"serial_number"`
+
+	// CATemplate is the DN of the TPP CA template the certificate was requested from
+	CATemplate string `json:"ca_template,omitempty"`
+
+	// ObjectName is the TPP object name requested for the certificate
+	ObjectName string `json:"object_name,omitempty"`
+
+	// Role is the role the certificate was issued by, it's empty for certificates stored by older versions
+	Role string `json:"role,omitempty"`
+
+	// VenafiSecret and Zone are set when the request was routed by zone_routes of the role
+	VenafiSecret string `json:"venafi_secret,omitempty"`
+	Zone         string `json:"zone,omitempty"`
+
+	// Revoked is set when the certificate was revoked in Venafi
+	Revoked bool `json:"revoked,omitempty"`
 }
 
+// suspendStorageTimeout limits saving of the interrupted request
+const suspendStorageTimeout = 10 * time.Second
+
+const (
+	errorTextRetrieveTimeout     = "certificate is not issued within server_timeout, use pickup/%s/%s to get it later"
+	errorTextRetrieveFailed      = "%s. The request is saved, use pickup/%s/%s to retry or to delete it"
+	warningTextIssuanceSuspended = "waiting for the certificate is stopped (%s), use pickup/%s/%s to get it later"
+)
+
 const (
 	pathConfigRootHelpSyn = `
 Configure the Venafi TPP credentials that are used to manage certificates,
@@ -469,5 +1100,13 @@ Sign Venafi certificate
 `
 	pathVenafiCertSignDesc = `
 Sign Venafi certificate
+`
+	pathVenafiCertSignVerbatimHelp = `
+Sign Venafi certificate from the CSR as it is
+`
+	pathVenafiCertSignVerbatimDesc = `
+Submits the CSR with all its names and requested extensions to Venafi. Only the key type of the role
+is checked, the domain and subject restrictions of the role are not applied. Access to this path
+should be granted to trusted automation only.
 `
 )
@@ -0,0 +1,461 @@
+package pki
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/Venafi/vcert/pkg/certificate"
+	"github.com/Venafi/vcert/pkg/endpoint"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+	"time"
+)
+
+// retrievePollInterval is the interval of checking if the certificate is issued, the same as vcert uses
+var retrievePollInterval = 2 * time.Second
+
+const (
+	pendingPath   = "pending/"
+	statusPending = "pending"
+	statusIssued  = "issued"
+	statusUnknown = "unknown"
+
+	errorTextPickupRejected = "%s. The request can't be picked up, pending request %s is deleted"
+	errorTextPickupNotFound = "pickup ID %s not found"
+)
+
+// pendingRequest is a certificate request which was sent to Venafi but not yet retrieved. It keeps the generated
+// private key until the certificate is picked up, also for roles with no_store, so it's stored seal wrapped.
+type pendingRequest struct {
+	ID         string    `json:"id"`
+	Role       string    `json:"role"`
+	PickupID   string    `json:"venafi_pickup_id"`
+	CommonName string    `json:"common_name"`
+	SignCSR    bool      `json:"sign_csr"`
+	PrivateKey string    `json:"private_key"`
+	Created    time.Time `json:"created"`
+
+	// Requester is the client which made the request, only it can pick up the certificate
+	Requester string `json:"requester"`
+
+	// IdempotencyPath is the idempotency record to be completed when the certificate is picked up
+	IdempotencyPath string `json:"idempotency_path,omitempty"`
+
+	// TTL is the requested lease duration
+	TTL time.Duration `json:"ttl,omitempty"`
+
+	// PKICompat are the options of the PKI compatibility mode the certificate is returned with
+	PKICompat *pkiCompatOptions `json:"pki_compat,omitempty"`
+
+	// CATemplate is the DN of the TPP CA template the certificate is requested from
+	CATemplate string `json:"ca_template,omitempty"`
+
+	// ObjectName is the TPP object name of the certificate
+	ObjectName string `json:"object_name,omitempty"`
+
+	// VenafiSecret and Zone are set when the request is routed by zone_routes of the role
+	VenafiSecret string `json:"venafi_secret,omitempty"`
+	Zone         string `json:"zone,omitempty"`
+
+	// Error is the failure of retrieving the certificate when the request was made
+	Error string `json:"error,omitempty"`
+
+	// Reserved is the time the request was counted for the rate limits of the role, it's released when Venafi rejects
+	// the request
+	Reserved time.Time `json:"reserved,omitempty"`
+
+	// KeyFingerprint is set when the key of the CSR is reserved for the request by key_reuse deny of the role
+	KeyFingerprint string `json:"key_fingerprint,omitempty"`
+}
+
+// isRetrievalRetryable is true for errors of retrieving the certificate which may go away, so the request is worth
+// keeping for pickup. Rejected requests never get a certificate.
+func isRetrievalRetryable(err error) bool {
+	switch classifyVenafiError(err).code {
+	case errorCodeUpstreamUnavailable, errorCodeAuthFailed, errorCodePendingApproval, errorCodeTimeout:
+		return true
+	}
+	return false
+}
+
+// routedRole returns a copy of the role with the venafi secret and the zone the request was routed to
+func (p *pendingRequest) routedRole(role *roleEntry) *roleEntry {
+	if p.VenafiSecret == "" {
+		return role
+	}
+	routed := *role
+	routed.VenafiSecret, routed.Zone = p.VenafiSecret, p.Zone
+	return &routed
+}
+
+func pathVenafiCertPickupList(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "pickup/" + framework.GenericNameRegex("role") + "/?$",
+		Fields: map[string]*framework.FieldSchema{
+			"role": {
+				Type:        framework.TypeString,
+				Description: "Name of the role the certificates were requested with",
+			},
+			"check_status": {
+				Type:        framework.TypeBool,
+				Default:     false,
+				Description: "Fetch the status of every pending request from the Venafi platform",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathVenafiPickupList,
+		},
+
+		HelpSynopsis:    pathVenafiPickupListHelpSyn,
+		HelpDescription: pathVenafiPickupListHelpDesc,
+	}
+}
+
+func pathVenafiCertPickup(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "pickup/" + framework.GenericNameRegex("role") + "/" + framework.GenericNameRegex("pickup_id"),
+		Fields: map[string]*framework.FieldSchema{
+			"role": {
+				Type:        framework.TypeString,
+				Description: "Name of the role the certificate was requested with",
+			},
+			"pickup_id": {
+				Type:        framework.TypeString,
+				Description: "Pickup ID returned by the asynchronous issue or sign request",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathVenafiPickup,
+			logical.DeleteOperation: b.pathVenafiPickupDelete,
+		},
+
+		HelpSynopsis:    pathVenafiPickupHelpSyn,
+		HelpDescription: pathVenafiPickupHelpDesc,
+	}
+}
+
+// pendingRequestPath is the storage path of the pending request of the role
+func pendingRequestPath(roleName string, id string) string {
+	return pendingPath + roleName + "/" + id
+}
+
+func newPendingRequest(roleName string, commonName string, signCSR bool, certReq *certificate.Request) (*pendingRequest, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := &pendingRequest{
+		ID:         id,
+		Role:       roleName,
+		CommonName: commonName,
+		SignCSR:    signCSR,
+		Created:    time.Now().UTC(),
+		CATemplate: certReq.CADN,
+	}
+
+	if !signCSR {
+		var block *pem.Block
+		if certReq.KeyPassword != "" {
+			block, err = certificate.GetEncryptedPrivateKeyPEMBock(certReq.PrivateKey, []byte(certReq.KeyPassword))
+		} else {
+			block, err = certificate.GetPrivateKeyPEMBock(certReq.PrivateKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+		pending.PrivateKey = string(pem.EncodeToMemory(block))
+	}
+
+	return pending, nil
+}
+
+func (p *pendingRequest) toResponse(status string) *logical.Response {
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"pickup_id":        p.ID,
+			"venafi_pickup_id": p.PickupID,
+			"role":             p.Role,
+			"common_name":      p.CommonName,
+			"status":           status,
+			"created":          p.Created.Format(time.RFC3339),
+		},
+	}
+	if p.Error != "" {
+		resp.Data["error"] = p.Error
+	}
+	return resp
+}
+
+func (b *backend) storePendingRequest(ctx context.Context, s logical.Storage, pending *pendingRequest) error {
+	entry, err := logical.StorageEntryJSON(pendingRequestPath(pending.Role, pending.ID), pending)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+func (b *backend) getPendingRequest(ctx context.Context, s logical.Storage, roleName string, id string) (*pendingRequest, error) {
+	entry, err := s.Get(ctx, pendingRequestPath(roleName, id))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var pending pendingRequest
+	if err := entry.DecodeJSON(&pending); err != nil {
+		return nil, err
+	}
+	return &pending, nil
+}
+
+// retrievePending asks Venafi for the certificate without waiting. It returns nil collection and the Venafi status
+// when the certificate is not issued yet.
+func (b *backend) retrievePending(ctx context.Context, cl endpoint.Connector, role *roleEntry, pending *pendingRequest) (
+	*certificate.PEMCollection, string, error) {
+
+	var pcc *certificate.PEMCollection
+	var pendingErr endpoint.ErrCertificatePending
+	started := time.Now()
+	err := b.callVenafi(ctx, role.VenafiSecret, "retrieve certificate", true, func() (err error) {
+		pcc, err = cl.RetrieveCertificate(&certificate.Request{
+			PickupID: pending.PickupID,
+			Timeout:  0,
+		})
+		if errors.As(err, &pendingErr) {
+			return nil
+		}
+		return err
+	})
+	switch {
+	case err != nil:
+		b.measureVenafiCall("retrieve_certificate", pending.Role, cl, started, metricOutcomeFailure)
+	case pcc == nil:
+		b.measureVenafiCall("retrieve_certificate", pending.Role, cl, started, metricOutcomePending)
+	default:
+		b.measureVenafiCall("retrieve_certificate", pending.Role, cl, started, metricOutcomeSuccess)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if pcc == nil {
+		if pendingErr.Status == "" {
+			return nil, statusPending, nil
+		}
+		return nil, pendingErr.Status, nil
+	}
+	return pcc, statusIssued, nil
+}
+
+// retrieveCertificate polls Venafi until the certificate is issued, the timeout is reached or the context is done
+func (b *backend) retrieveCertificate(ctx context.Context, cl endpoint.Connector, role *roleEntry, pending *pendingRequest,
+	timeout time.Duration) (*certificate.PEMCollection, error) {
+
+	deadline := time.Now().Add(timeout)
+	for {
+		pcc, status, err := b.retrievePending(ctx, cl, role, pending)
+		if err != nil || pcc != nil {
+			return pcc, err
+		}
+		if time.Now().After(deadline) {
+			return nil, endpoint.ErrRetrieveCertificateTimeout{CertificateID: pending.PickupID}
+		}
+		b.Logger().Debug(fmt.Sprintf("Certificate %s is %s, waiting", pending.PickupID, status))
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retrievePollInterval):
+		}
+	}
+}
+
+// getRequesterPending returns the pending request of the role only if it was made by the client of the request
+func (b *backend) getRequesterPending(ctx context.Context, req *logical.Request, roleName string, id string) (
+	*pendingRequest, error) {
+
+	pending, err := b.getPendingRequest(ctx, req.Storage, roleName, id)
+	if err != nil || pending == nil {
+		return nil, err
+	}
+	if pending.Requester != idempotencyRequester(req) {
+		return nil, nil
+	}
+	return pending, nil
+}
+
+func (b *backend) pathVenafiPickup(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	roleName := data.Get("role").(string)
+	id := data.Get("pickup_id").(string)
+
+	pending, err := b.getRequesterPending(ctx, req, roleName, id)
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil {
+		return venafiErrorResponse(req, invalidRequest(fmt.Errorf(errorTextPickupNotFound, id)))
+	}
+
+	role, err := b.getRole(ctx, req.Storage, pending.Role)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return venafiErrorResponse(req, invalidRequest(fmt.Errorf("unknown role %s of pending request %s", pending.Role, id)))
+	}
+	role = pending.routedRole(role)
+
+	// See pathVenafiCertObtain: the certificate is written to storage so the call must be served by the primary.
+	if b.System().ReplicationState().HasState(consts.ReplicationPerformanceStandby | consts.ReplicationPerformanceSecondary) {
+		return nil, logical.ErrReadOnly
+	}
+
+	cl, _, err := b.clientVenafiWithRetry(ctx, req, data, pending.Role, role)
+	if err != nil {
+		return venafiErrorResponse(req, err)
+	}
+
+	b.Logger().Debug("Retrieving certificate for pickup ID " + id)
+	pcc, status, err := b.retrievePending(ctx, cl, role, pending)
+	if err != nil && !isRetrievalRetryable(err) {
+		// the request is rejected, so it's not kept
+		if deleteErr := req.Storage.Delete(ctx, pendingRequestPath(roleName, id)); deleteErr != nil {
+			return nil, deleteErr
+		}
+		b.releaseRejectedIssuance(ctx, req.Storage, pending)
+		classified := classifyVenafiError(err)
+		return venafiErrorResponse(req, venafiErrorf(classified.code, classified.status, errorTextPickupRejected, err, id))
+	}
+	if err != nil {
+		return venafiErrorResponse(req, err)
+	}
+	if pcc == nil {
+		return pending.toResponse(status), nil
+	}
+
+	pcc.PrivateKey = pending.PrivateKey
+	resp, err := b.storeCertificate(ctx, req, role, pending, pcc)
+	if err != nil {
+		return nil, err
+	}
+
+	if pending.IdempotencyPath != "" {
+		b.completeIdempotencyRecord(ctx, req.Storage, pending.IdempotencyPath, role, resp)
+	}
+
+	if err := req.Storage.Delete(ctx, pendingRequestPath(roleName, id)); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (b *backend) pathVenafiPickupDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	roleName := data.Get("role").(string)
+	id := data.Get("pickup_id").(string)
+
+	pending, err := b.getRequesterPending(ctx, req, roleName, id)
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil {
+		return nil, nil
+	}
+	err = req.Storage.Delete(ctx, pendingRequestPath(roleName, id))
+	if err != nil {
+		return nil, err
+	}
+	b.releasePendingKey(ctx, req.Storage, pending)
+	return nil, nil
+}
+
+func (b *backend) pathVenafiPickupList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	roleName := data.Get("role").(string)
+	checkStatus := data.Get("check_status").(bool)
+
+	stored, err := req.Storage.List(ctx, pendingPath+roleName+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	clients := make(map[string]endpoint.Connector)
+	keyInfo := make(map[string]interface{})
+	for _, id := range stored {
+		pending, err := b.getRequesterPending(ctx, req, roleName, id)
+		if err != nil {
+			return nil, err
+		}
+		if pending == nil {
+			continue
+		}
+		ids = append(ids, id)
+
+		info := pending.toResponse(statusUnknown).Data
+		delete(info, "pickup_id")
+		if !checkStatus {
+			keyInfo[id] = info
+			continue
+		}
+
+		role, err := b.getRole(ctx, req.Storage, pending.Role)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			info["error"] = fmt.Sprintf("unknown role %s", pending.Role)
+			keyInfo[id] = info
+			continue
+		}
+
+		role = pending.routedRole(role)
+		clientKey := pending.Role + "/" + role.VenafiSecret + "/" + role.Zone
+		cl, ok := clients[clientKey]
+		if !ok {
+			cl, _, err = b.clientVenafiWithRetry(ctx, req, data, pending.Role, role)
+			if err != nil {
+				b.Logger().Warn(fmt.Sprintf("Can't create Venafi client for role %s: %s", pending.Role, err))
+			}
+			clients[clientKey] = cl
+		}
+		if cl != nil {
+			_, status, err := b.retrievePending(ctx, cl, role, pending)
+			if err != nil {
+				info["error"] = err.Error()
+				info["error_code"] = classifyVenafiError(err).code
+			} else {
+				info["status"] = status
+			}
+		}
+		keyInfo[id] = info
+	}
+
+	return logical.ListResponseWithInfo(ids, keyInfo), nil
+}
+
+const pathVenafiPickupListHelpSyn = `
+List pending certificate requests.
+`
+
+const pathVenafiPickupListHelpDesc = `
+List certificate requests of the role made with async=true which were not picked up yet. Only the requests made by
+the same client (entity, or token if it has no entity) are listed. With check_status=true the status of every request
+is fetched from the Venafi platform, otherwise it is reported as unknown.
+`
+
+const pathVenafiPickupHelpSyn = `
+Retrieve the certificate of a pending request.
+`
+
+const pathVenafiPickupHelpDesc = `
+Writing to this path retrieves the certificate of a request made with async=true. Only the client which made the
+request (the same entity, or the same token if it has no entity) can pick it up or delete it.
+If the certificate is issued it is stored and returned the same way as issue and sign do and the pending request is
+removed. Otherwise the current status of the request is returned. A request which was rejected by Venafi is removed
+as well. Deleting this path discards the pending request.
+`
@@ -0,0 +1,314 @@
+package pki
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Venafi/vcert/pkg/certificate"
+	"github.com/Venafi/vcert/pkg/endpoint"
+	"github.com/Venafi/vcert/pkg/verror"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// createFakeRole writes a fake venafi secret and a role which uses it
+func createFakeRole(t *testing.T, b *backend, storage logical.Storage, roleName string, roleData map[string]interface{}) {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "venafi/" + roleName,
+		Storage:   storage,
+		Data:      map[string]interface{}{"fakemode": true},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("failed to write venafi secret: err: %v resp: %#v", err, resp)
+	}
+
+	data := map[string]interface{}{"venafi_secret": roleName}
+	for k, v := range roleData {
+		data[k] = v
+	}
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/" + roleName,
+		Storage:   storage,
+		Data:      data,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("failed to write role: err: %v resp: %#v", err, resp)
+	}
+}
+
+func TestAsyncIssuance(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	createFakeRole(t, b, storage, "async", map[string]interface{}{
+		"store_by":   "serial",
+		"store_pkey": true,
+	})
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "issue/async",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"common_name":  "async.example.com",
+			"key_password": "password",
+			"async":        true,
+		},
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to issue certificate: err: %v resp: %#v", err, resp)
+	}
+	if resp.Data["status"] != statusPending {
+		t.Fatalf("expected status %s, got %v", statusPending, resp.Data["status"])
+	}
+	if _, ok := resp.Data["certificate"]; ok {
+		t.Fatal("certificate should not be returned by async request")
+	}
+	pickupID := resp.Data["pickup_id"].(string)
+
+	list := func(entityID string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "pickup/async/",
+			Storage:   storage,
+			EntityID:  entityID,
+			Data:      data,
+		})
+		if err != nil || resp.IsError() {
+			t.Fatalf("failed to list pending requests: err: %v resp: %#v", err, resp)
+		}
+		return resp
+	}
+
+	resp = list("", nil)
+	keys := resp.Data["keys"].([]string)
+	if len(keys) != 1 || keys[0] != pickupID {
+		t.Fatalf("expected pending request %s, got %v", pickupID, keys)
+	}
+	info := resp.Data["key_info"].(map[string]interface{})[pickupID].(map[string]interface{})
+	if info["common_name"] != "async.example.com" || info["role"] != "async" {
+		t.Fatalf("unexpected key info %#v", info)
+	}
+	if info["status"] != statusUnknown {
+		t.Fatalf("status should be fetched only with check_status, got %v", info["status"])
+	}
+	resp = list("", map[string]interface{}{"check_status": true})
+	info = resp.Data["key_info"].(map[string]interface{})[pickupID].(map[string]interface{})
+	if info["status"] != statusIssued {
+		t.Fatalf("fake connector issues certificates immediately, got status %v", info["status"])
+	}
+
+	// the requests of other clients are not listed and can't be picked up
+	resp = list("other-entity", nil)
+	if _, ok := resp.Data["keys"]; ok {
+		t.Fatalf("requests of other clients should not be listed, got %#v", resp.Data)
+	}
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "pickup/async/" + pickupID,
+		Storage:   storage,
+		EntityID:  "other-entity",
+	})
+	if !codedErrorResponse(t, resp, err).IsError() {
+		t.Fatalf("pickup by another client should fail: err: %v resp: %#v", err, resp)
+	}
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "pickup/async/" + pickupID,
+		Storage:   storage,
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to pick up certificate: err: %v resp: %#v", err, resp)
+	}
+	block, _ := pem.Decode([]byte(resp.Data["private_key"].(string)))
+	if _, err := x509.DecryptPEMBlock(block, []byte("password")); err != nil {
+		t.Fatalf("private key should be encrypted with key_password: %s", err)
+	}
+	block, _ = pem.Decode([]byte(resp.Data["certificate"].(string)))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "async.example.com" {
+		t.Fatalf("unexpected common name %s", cert.Subject.CommonName)
+	}
+
+	entry, err := storage.Get(context.Background(), "certs/"+normalizeSerial(resp.Data["serial_number"].(string)))
+	if err != nil || entry == nil {
+		t.Fatalf("certificate should be stored: %v", err)
+	}
+	entry, err = storage.Get(context.Background(), pendingRequestPath("async", pickupID))
+	if err != nil || entry != nil {
+		t.Fatalf("pending request should be removed: %v", err)
+	}
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "pickup/async/" + pickupID,
+		Storage:   storage,
+	})
+	if !codedErrorResponse(t, resp, err).IsError() {
+		t.Fatalf("second pickup should fail: err: %v resp: %#v", err, resp)
+	}
+}
+
+func TestAsyncIssuanceNoStore(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	createFakeRole(t, b, storage, "nostore", map[string]interface{}{
+		"no_store": true,
+	})
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "issue/nostore",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"common_name": "nostore.example.com",
+			"async":       true,
+		},
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to issue certificate: err: %v resp: %#v", err, resp)
+	}
+	pickupID := resp.Data["pickup_id"].(string)
+
+	// the private key is kept until the pickup, also by no_store roles
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "pickup/nostore/" + pickupID,
+		Storage:   storage,
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to pick up certificate: err: %v resp: %#v", err, resp)
+	}
+	if resp.Data["private_key"] == nil || resp.Data["private_key"] == "" {
+		t.Fatal("picked up certificate should be returned with the private key")
+	}
+	pending, err := b.getPendingRequest(context.Background(), storage, "nostore", pickupID)
+	if err != nil || pending != nil {
+		t.Fatalf("pending request should be removed after the pickup: %v", err)
+	}
+	certs, err := storage.List(context.Background(), "certs/")
+	if err != nil || len(certs) != 0 {
+		t.Fatalf("no_store role should not store the certificate, got %v %v", certs, err)
+	}
+}
+
+// pendingConnector is a connector which never issues the certificate
+type pendingConnector struct {
+	endpoint.Connector
+	calls int
+}
+
+func (c *pendingConnector) GetType() endpoint.ConnectorType {
+	return endpoint.ConnectorTypeFake
+}
+
+func (c *pendingConnector) RetrieveCertificate(req *certificate.Request) (*certificate.PEMCollection, error) {
+	c.calls++
+	return nil, endpoint.ErrCertificatePending{CertificateID: req.PickupID, Status: "WaitingForApproval"}
+}
+
+func TestRetrieveCertificateCanceled(t *testing.T) {
+	retrievePollInterval = 10 * time.Millisecond
+	defer func() { retrievePollInterval = 2 * time.Second }()
+
+	b, storage := createBackendWithStorage(t)
+	role := &roleEntry{VenafiSecret: "secret"}
+	pending := &pendingRequest{ID: "id", Role: "role", PickupID: `\VED\Policy\test`, PrivateKey: "key"}
+
+	cl := &pendingConnector{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	_, err := b.retrieveCertificate(ctx, cl, role, pending, time.Hour)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(started) > time.Second {
+		t.Fatalf("polling should stop when the context is done, got %v after %s", err, time.Since(started))
+	}
+	if cl.calls < 2 {
+		t.Fatalf("certificate should be polled until the context is done, got %d calls", cl.calls)
+	}
+
+	_, err = b.retrieveCertificate(context.Background(), cl, role, pending, 30*time.Millisecond)
+	var timeoutErr endpoint.ErrRetrieveCertificateTimeout
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+
+	req := &logical.Request{Storage: storage}
+	resp, err := b.suspendIssuance(ctx, req, pending, "", ctx.Err())
+	if err != nil || resp.IsError() || resp.Data["pickup_id"] != "id" || len(resp.Warnings) != 1 {
+		t.Fatalf("canceled request should be saved for pickup, got err: %v resp: %#v", err, resp)
+	}
+	saved, err := b.getPendingRequest(context.Background(), storage, "role", "id")
+	if err != nil || saved == nil || saved.PrivateKey != "key" || saved.PickupID != pending.PickupID {
+		t.Fatalf("pending request should be stored with the key, got %#v", saved)
+	}
+
+	resp, err = b.suspendIssuance(context.Background(), req, pending, "", timeoutErr)
+	data := failedResponseData(resp)
+	if err != nil || resp.Data[logical.HTTPStatusCode] != http.StatusGatewayTimeout || data["pickup_id"] != "id" ||
+		!strings.Contains(data["error"].(string), "pickup/role/id") {
+		t.Fatalf("timed out request should return error with pickup ID, got err: %v resp: %#v", err, resp)
+	}
+}
+
+func TestRetrieveCertificateFailed(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+	pending := &pendingRequest{ID: "id", Role: "role", PickupID: `\VED\Policy\test`, PrivateKey: "key"}
+	walID, err := framework.PutWAL(ctx, storage, walIssuanceKind, pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &logical.Request{Storage: storage}
+	cause := fmt.Errorf("%w: connection reset", errVenafiUnavailable)
+	resp, err := b.failIssuance(ctx, req, pending, walID, cause)
+	data := failedResponseData(resp)
+	if err != nil || data["pickup_id"] != "id" || !strings.Contains(data["error"].(string), "pickup/role/id") {
+		t.Fatalf("failed request should return error with pickup ID, got err: %v resp: %#v", err, resp)
+	}
+
+	// the request is saved with the error, the rollback won't complete it later
+	wals, err := framework.ListWAL(ctx, storage)
+	if err != nil || len(wals) != 0 {
+		t.Fatalf("WAL entry should be removed, got %v %v", wals, err)
+	}
+	saved, err := b.getPendingRequest(ctx, storage, "role", "id")
+	if err != nil || saved == nil || saved.Error != cause.Error() {
+		t.Fatalf("pending request should be stored with the error, got %#v", saved)
+	}
+	if saved.toResponse(statusUnknown).Data["error"] != saved.Error {
+		t.Fatal("pending request status should have the error")
+	}
+	if saved.PrivateKey != "key" {
+		t.Fatalf("private key should be kept for the pickup, got %#v", saved)
+	}
+}
+
+func TestRetrievalRetryable(t *testing.T) {
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{fmt.Errorf("%w: connection reset", errVenafiUnavailable), true},
+		{fmt.Errorf("%w: token expired", verror.AuthError), true},
+		{endpoint.ErrRetrieveCertificateTimeout{CertificateID: "id"}, true},
+		{errors.New("certificate request was rejected"), false},
+		{policyViolation(errors.New("name is not allowed")), false},
+	}
+	for _, c := range cases {
+		if isRetrievalRetryable(c.err) != c.retryable {
+			t.Errorf("expected retryable %t for %v", c.retryable, c.err)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package pki
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
@@ -17,8 +19,8 @@ func pathVenafiCertRead(b *backend) *framework.Path {
 			},
 		},
 		Callbacks: map[logical.Operation]framework.OperationFunc{
-			logical.ReadOperation: b.pathVenafiCertRead,
-			//todo: maybe add delete operation to delete certificate entry from storage
+			logical.ReadOperation:   b.pathVenafiCertRead,
+			logical.DeleteOperation: b.pathVenafiCertDelete,
 		},
 
 		HelpSynopsis:    pathConfigRootHelpSyn,
@@ -60,6 +62,8 @@ func (b *backend) pathVenafiCertRead(ctx context.Context, req *logical.Request,
 		"certificate_chain": cert.CertificateChain,
 		"certificate":       cert.Certificate,
 		"private_key":       cert.PrivateKey,
+		"ca_template":       cert.CATemplate,
+		"object_name":       cert.ObjectName,
 	}
 
 	return &logical.Response{
@@ -67,3 +71,75 @@ func (b *backend) pathVenafiCertRead(ctx context.Context, req *logical.Request,
 		Data: respData,
 	}, nil
 }
+
+func (b *backend) pathVenafiCertDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	certUID := data.Get("certificate_uid").(string)
+	if len(certUID) == 0 {
+		return logical.ErrorResponse("no common name specified on certificate"), nil
+	}
+
+	event := &historyEvent{Event: historyEventDeleted}
+	if !b.describeStoredCertificate(ctx, req.Storage, certUID, event) {
+		return nil, nil
+	}
+
+	if err := b.removeStoredCertificate(ctx, req.Storage, certUID); err != nil {
+		return nil, err
+	}
+	b.recordHistory(ctx, req, event)
+	return nil, nil
+}
+
+// removeStoredCertificate deletes the certificate from storage together with its fingerprint and its max_active_per_cn
+// count. The public key index entry is kept, so the key of a deleted certificate is still refused by key_reuse.
+func (b *backend) removeStoredCertificate(ctx context.Context, s logical.Storage, certUID string) error {
+	cert, parsed, err := b.getStoredCertificate(ctx, s, certUID)
+	if err != nil || cert == nil {
+		return err
+	}
+	path := "certs/" + certUID
+	if err := s.Delete(ctx, path); err != nil {
+		return err
+	}
+
+	if parsed == nil || cert.Role == "" {
+		return nil
+	}
+	if err := b.unindexCertificate(ctx, s, cert.Role, path, parsed); err != nil {
+		b.Logger().Warn(fmt.Sprintf("Can't remove fingerprint of certificate %s: %s", certUID, err))
+	}
+	if cert.Revoked {
+		// it was released when it was revoked
+		return nil
+	}
+	if err := b.releaseActiveCertificate(ctx, s, cert.Role, parsed); err != nil {
+		b.Logger().Warn(fmt.Sprintf("Can't release active certificate %s: %s", certUID, err))
+	}
+	return nil
+}
+
+// getStoredCertificate reads the stored certificate, the parsed certificate is nil when it can't be decoded
+func (b *backend) getStoredCertificate(ctx context.Context, s logical.Storage, certUID string) (*VenafiCert,
+	*x509.Certificate, error) {
+
+	entry, err := s.Get(ctx, "certs/"+certUID)
+	if err != nil || entry == nil {
+		return nil, nil, err
+	}
+	var cert VenafiCert
+	if err := entry.DecodeJSON(&cert); err != nil {
+		return nil, nil, err
+	}
+
+	block, _ := pem.Decode([]byte(cert.Certificate))
+	if block == nil {
+		b.Logger().Warn(fmt.Sprintf("Can't decode certificate %s", certUID))
+		return &cert, nil, nil
+	}
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		b.Logger().Warn(fmt.Sprintf("Can't parse certificate %s: %s", certUID, err))
+		return &cert, nil, nil
+	}
+	return &cert, parsed, nil
+}
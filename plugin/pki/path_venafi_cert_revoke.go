@@ -2,8 +2,15 @@ package pki
 
 import (
 	"context"
-	"github.com/hashicorp/vault/sdk/logical"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/Venafi/vcert/pkg/certificate"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"strings"
+	"time"
 )
 
 func pathVenafiCertRevoke(b *backend) *framework.Path {
@@ -16,7 +23,7 @@ func pathVenafiCertRevoke(b *backend) *framework.Path {
 			},
 			"certificate_uid": {
 				Type:        framework.TypeString,
-				Description: "Common name for created certificate",
+				Description: "Common name or serial number of the stored certificate to be revoked in Venafi, it must be issued by the role",
 			},
 		},
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -29,5 +36,120 @@ func pathVenafiCertRevoke(b *backend) *framework.Path {
 }
 
 func (b *backend) venafiCertRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if req.Secret != nil {
+		// the certificate stays valid when its lease expires or is revoked, it's revoked in Venafi with revoke/<role>
+		return nil, nil
+	}
+
+	roleName := d.Get("role").(string)
+	certUID := d.Get("certificate_uid").(string)
+	if certUID == "" {
+		return logical.ErrorResponse(errorTextRevokeNoCertificate), nil
+	}
+	role, err := b.getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse(fmt.Sprintf(errorTextRevokeUnknownRole, roleName)), nil
+	}
+
+	event := &historyEvent{Event: historyEventRevoked, Role: roleName, VenafiSecret: role.VenafiSecret}
+	if !b.describeStoredCertificate(ctx, req.Storage, certUID, event) {
+		event.Outcome = historyOutcomeFailure
+		event.Error = fmt.Sprintf(errorTextRevokeCertificateNotFound, certUID)
+		b.recordHistory(ctx, req, event)
+		return logical.ErrorResponse(event.Error), nil
+	}
+	cert, _, err := b.getStoredCertificate(ctx, req.Storage, certUID)
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil || cert.Role != roleName {
+		// certificates of other roles and of older versions, which don't record the role, can't be revoked
+		event.Outcome = historyOutcomeFailure
+		event.Error = fmt.Sprintf(errorTextRevokeOtherRole, certUID, roleName)
+		b.recordHistory(ctx, req, event)
+		return logical.ErrorResponse(event.Error), nil
+	}
+	if cert.VenafiSecret != "" {
+		// the certificate is revoked where it was requested when the request was routed by zone_routes
+		routed := *role
+		routed.VenafiSecret, routed.Zone = cert.VenafiSecret, cert.Zone
+		role = &routed
+		event.VenafiSecret = role.VenafiSecret
+	}
+
+	block, _ := pem.Decode([]byte(event.Certificate))
+	if block == nil {
+		return nil, fmt.Errorf(errorTextRevokeCertificateDecode, certUID)
+	}
+
+	thumbprint := sha1.Sum(block.Bytes)
+	err = b.revokeInVenafi(ctx, req, roleName, role, &certificate.RevocationRequest{
+		Thumbprint: strings.ToUpper(hex.EncodeToString(thumbprint[:])),
+		Comments:   "revoked by Vault",
+	})
+	if err != nil {
+		event.Outcome = historyOutcomeFailure
+		event.Error = err.Error()
+		b.recordHistory(ctx, req, event)
+		return venafiErrorResponse(req, err)
+	}
+
+	if err := b.storeRevoked(ctx, req.Storage, certUID); err != nil {
+		b.Logger().Warn("Error storing revocation of certificate " + certUID + ": " + err.Error())
+	}
+	if event.SerialNumber != "" {
+		if err := b.markPublicKeyRevoked(ctx, req.Storage, event.SerialNumber); err != nil {
+			b.Logger().Warn("Error marking public key of certificate " + event.SerialNumber + " revoked: " + err.Error())
+		}
+	}
+	b.recordHistory(ctx, req, event)
 	return nil, nil
 }
+
+const (
+	errorTextRevokeNoCertificate       = "no certificate_uid specified"
+	errorTextRevokeUnknownRole         = "unknown role %s"
+	errorTextRevokeCertificateNotFound = "certificate %s is not found"
+	errorTextRevokeCertificateDecode   = "can't decode certificate %s"
+	errorTextRevokeOtherRole           = "certificate %s was not issued by role %s"
+)
+
+// storeRevoked marks the stored certificate revoked, so it doesn't count for max_active_per_cn anymore
+func (b *backend) storeRevoked(ctx context.Context, s logical.Storage, certUID string) error {
+	cert, parsed, err := b.getStoredCertificate(ctx, s, certUID)
+	if err != nil || cert == nil || cert.Revoked {
+		return err
+	}
+	cert.Revoked = true
+	entry, err := logical.StorageEntryJSON("certs/"+certUID, cert)
+	if err != nil {
+		return err
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return err
+	}
+	if parsed == nil || cert.Role == "" {
+		return nil
+	}
+	return b.releaseActiveCertificate(ctx, s, cert.Role, parsed)
+}
+
+// revokeInVenafi revokes the certificate in Venafi with the venafi secret and the zone of the role
+func (b *backend) revokeInVenafi(ctx context.Context, req *logical.Request, roleName string, role *roleEntry,
+	revReq *certificate.RevocationRequest) error {
+
+	cl, _, err := b.clientVenafiWithRetry(ctx, req, nil, roleName, role)
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+	err = b.callVenafi(ctx, role.VenafiSecret, "revoke certificate", false, func() error {
+		return cl.RevokeCertificate(revReq)
+	})
+	b.measureVenafiCall("revoke_certificate", roleName, cl, started, metricOutcome(err))
+	return err
+}
@@ -0,0 +1,167 @@
+package pki
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// createRevokingRole creates a role with a TPP mock which revokes all certificates, the thumbprints of the revoked
+// certificates are sent to the returned channel
+func createRevokingRole(t *testing.T, b *backend, storage logical.Storage, roleName string) (*httptest.Server,
+	chan string) {
+
+	revoked := make(chan string, 10)
+	tppServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/vedsdk/certificates/revoke" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var revReq struct{ Thumbprint string }
+		if err := json.NewDecoder(r.Body).Decode(&revReq); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		revoked <- revReq.Thumbprint
+		_, _ = w.Write([]byte(`{"Requested":true,"Success":true}`))
+	}))
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "venafi/" + roleName,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"url":          tppServer.URL,
+			"zone":         "devops\\vcert",
+			"access_token": "foo123bar==",
+			"trust_bundle": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tppServer.Certificate().Raw})),
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("failed to write venafi secret: err: %v resp: %#v", err, resp)
+	}
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/" + roleName,
+		Storage:   storage,
+		Data:      map[string]interface{}{"venafi_secret": roleName},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("failed to write role: err: %v resp: %#v", err, resp)
+	}
+	return tppServer, revoked
+}
+
+// routeStoredCertificate records the stored certificate as requested with the venafi secret of zone_routes, so it's
+// revoked with that secret
+func routeStoredCertificate(t *testing.T, b *backend, storage logical.Storage, certUID string, venafiSecret string) {
+	cert, _, err := b.getStoredCertificate(context.Background(), storage, certUID)
+	if err != nil || cert == nil {
+		t.Fatalf("failed to read certificate %s: %v", certUID, err)
+	}
+	cert.VenafiSecret, cert.Zone = venafiSecret, "devops\\vcert"
+	entry, err := logical.StorageEntryJSON("certs/"+certUID, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRevokeCertificate(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+	createFakeRole(t, b, storage, "fake", map[string]interface{}{
+		"store_by":       "serial",
+		"generate_lease": true,
+	})
+	tppServer, revoked := createRevokingRole(t, b, storage, "tpp")
+	defer tppServer.Close()
+
+	issued, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "issue/fake",
+		Storage:   storage,
+		Data:      map[string]interface{}{"common_name": "revoke.example.com"},
+	})
+	if err != nil || issued.IsError() {
+		t.Fatalf("failed to issue certificate: err: %v resp: %#v", err, issued)
+	}
+	serial := issued.Data["serial_number"].(string)
+
+	revoke := func(roleName string, certUID string) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "revoke/" + roleName,
+			Storage:   storage,
+			Data:      map[string]interface{}{"certificate_uid": certUID},
+		})
+		return codedErrorResponse(t, resp, err)
+	}
+	events := func() []*historyEvent {
+		events, _, err := b.queryHistory(ctx, storage, &historyFilter{event: historyEventRevoked})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return events
+	}
+
+	// the lease of the certificate expires, but the certificate is still valid in Venafi
+	_, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.RevokeOperation,
+		Storage:   storage,
+		Secret:    issued.Secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events()) != 0 {
+		t.Fatal("expiration of the lease should not be recorded as revocation")
+	}
+
+	if resp := revoke("tpp", "unknown"); !resp.IsError() {
+		t.Fatalf("revocation of unknown certificate should fail, got %#v", resp)
+	}
+	if resp := revoke("tpp", normalizeSerial(serial)); !resp.IsError() ||
+		!strings.Contains(resp.Data["error"].(string), "not issued by role tpp") {
+		t.Fatalf("revocation of certificate of another role should fail, got %#v", resp)
+	}
+	if resp := revoke("fake", normalizeSerial(serial)); !resp.IsError() {
+		t.Fatalf("revocation is not supported by the fake connector, got %#v", resp)
+	}
+	recorded := events()
+	if len(recorded) != 3 {
+		t.Fatalf("failed revocations should be recorded, got %#v", recorded)
+	}
+	for _, event := range recorded {
+		if event.Outcome != historyOutcomeFailure {
+			t.Fatalf("failed revocations should be recorded as failures, got %#v", event)
+		}
+	}
+
+	// the certificate is revoked with the venafi secret the request was routed to
+	routeStoredCertificate(t, b, storage, normalizeSerial(serial), "tpp")
+	if resp := revoke("fake", normalizeSerial(serial)); resp.IsError() {
+		t.Fatalf("failed to revoke certificate: %#v", resp)
+	}
+	select {
+	case thumbprint := <-revoked:
+		if len(thumbprint) != 40 {
+			t.Fatalf("certificate should be revoked by its thumbprint, got %q", thumbprint)
+		}
+	default:
+		t.Fatal("certificate should be revoked in Venafi")
+	}
+	recorded = events()
+	if len(recorded) != 4 || recorded[3].Outcome != historyOutcomeSuccess || recorded[3].SerialNumber != serial ||
+		recorded[3].VenafiSecret != "tpp" {
+		t.Fatalf("expected successful revocation of %s, got %#v", serial, recorded)
+	}
+}
@@ -0,0 +1,210 @@
+package pki
+
+import (
+	"context"
+	"fmt"
+	"github.com/Venafi/vcert/pkg/certificate"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"time"
+)
+
+const orphansPath = "orphans/"
+
+// orphanEntry is a certificate which may exist in Venafi but is not recorded by the plugin
+type orphanEntry struct {
+	ID         string    `json:"id"`
+	Role       string    `json:"role"`
+	CommonName string    `json:"common_name"`
+	PickupID   string    `json:"venafi_pickup_id"`
+	Reason     string    `json:"reason"`
+	Requested  time.Time `json:"requested"`
+	Detected   time.Time `json:"detected"`
+
+	// VenafiSecret and Zone are set when the request was routed by zone_routes of the role
+	VenafiSecret string `json:"venafi_secret,omitempty"`
+	Zone         string `json:"zone,omitempty"`
+}
+
+func pathVenafiOrphansList(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "orphans/?$",
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathVenafiOrphansList,
+		},
+
+		HelpSynopsis:    pathVenafiOrphansHelpSyn,
+		HelpDescription: pathVenafiOrphansHelpDesc,
+	}
+}
+
+func pathVenafiOrphans(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "orphans/" + framework.GenericNameRegex("id"),
+		Fields: map[string]*framework.FieldSchema{
+			"id": {
+				Type:        framework.TypeString,
+				Description: "ID of the orphaned certificate request",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathVenafiOrphanRead,
+			logical.UpdateOperation: b.pathVenafiOrphanRevoke,
+			logical.DeleteOperation: b.pathVenafiOrphanDelete,
+		},
+
+		HelpSynopsis:    pathVenafiOrphansHelpSyn,
+		HelpDescription: pathVenafiOrphansHelpDesc,
+	}
+}
+
+func (b *backend) storeOrphan(ctx context.Context, s logical.Storage, pending *pendingRequest, reason string) error {
+	b.Logger().Error(fmt.Sprintf("Certificate request %s for %s is orphaned: %s", pending.ID, pending.CommonName, reason))
+	entry, err := logical.StorageEntryJSON(orphansPath+pending.ID, &orphanEntry{
+		ID:         pending.ID,
+		Role:       pending.Role,
+		CommonName: pending.CommonName,
+		PickupID:   pending.PickupID,
+		Reason:     reason,
+		Requested:  pending.Created,
+		Detected:   time.Now().UTC(),
+
+		VenafiSecret: pending.VenafiSecret,
+		Zone:         pending.Zone,
+	})
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+func (b *backend) getOrphan(ctx context.Context, s logical.Storage, id string) (*orphanEntry, error) {
+	entry, err := s.Get(ctx, orphansPath+id)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var orphan orphanEntry
+	if err := entry.DecodeJSON(&orphan); err != nil {
+		return nil, err
+	}
+	return &orphan, nil
+}
+
+func (o *orphanEntry) ToResponseData() map[string]interface{} {
+	return map[string]interface{}{
+		"role":             o.Role,
+		"common_name":      o.CommonName,
+		"venafi_pickup_id": o.PickupID,
+		"reason":           o.Reason,
+		"requested":        o.Requested.Format(time.RFC3339),
+		"detected":         o.Detected.Format(time.RFC3339),
+	}
+}
+
+func (b *backend) pathVenafiOrphansList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	ids, err := req.Storage.List(ctx, orphansPath)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := make(map[string]interface{})
+	for _, id := range ids {
+		orphan, err := b.getOrphan(ctx, req.Storage, id)
+		if err != nil {
+			return nil, err
+		}
+		if orphan != nil {
+			keyInfo[id] = orphan.ToResponseData()
+		}
+	}
+
+	return logical.ListResponseWithInfo(ids, keyInfo), nil
+}
+
+func (b *backend) pathVenafiOrphanRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	orphan, err := b.getOrphan(ctx, req.Storage, data.Get("id").(string))
+	if err != nil {
+		return nil, err
+	}
+	if orphan == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: orphan.ToResponseData(),
+	}, nil
+}
+
+// pathVenafiOrphanRevoke revokes the orphaned certificate in Venafi and removes the entry. The certificate is found
+// by the DN Venafi Platform returned for the request, requests without it have to be handled in Venafi.
+func (b *backend) pathVenafiOrphanRevoke(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	id := data.Get("id").(string)
+	orphan, err := b.getOrphan(ctx, req.Storage, id)
+	if err != nil {
+		return nil, err
+	}
+	if orphan == nil {
+		return logical.ErrorResponse(fmt.Sprintf("orphan %s not found", id)), nil
+	}
+	if orphan.PickupID == "" {
+		return logical.ErrorResponse(errorTextOrphanNoPickupID), nil
+	}
+
+	role, err := b.getRole(ctx, req.Storage, orphan.Role)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse(fmt.Sprintf(errorTextOrphanRoleDeleted, orphan.Role)), nil
+	}
+	if orphan.VenafiSecret != "" {
+		routed := *role
+		routed.VenafiSecret, routed.Zone = orphan.VenafiSecret, orphan.Zone
+		role = &routed
+	}
+
+	err = b.revokeInVenafi(ctx, req, orphan.Role, role, &certificate.RevocationRequest{
+		CertificateDN: orphan.PickupID,
+		Comments:      "orphaned by interrupted issuance in Vault",
+		Disable:       true,
+	})
+	if err != nil {
+		return venafiErrorResponse(req, err)
+	}
+	b.Logger().Info(fmt.Sprintf("Orphaned certificate %s is revoked", orphan.PickupID))
+
+	if err := req.Storage.Delete(ctx, orphansPath+id); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (b *backend) pathVenafiOrphanDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	err := req.Storage.Delete(ctx, orphansPath+data.Get("id").(string))
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+const pathVenafiOrphansHelpSyn = `
+Manage certificate requests which were interrupted and can't be recovered.
+`
+
+const pathVenafiOrphansHelpDesc = `
+When issuance is interrupted (e.g. Vault is restarted) after the request was sent to Venafi, the plugin
+completes it on recovery: the certificate is stored or the request is saved under pickup/. If that is not
+possible the request is recorded here so the certificate can be found and revoked in Venafi by an administrator.
+Writing to orphans/<id> revokes the certificate in Venafi Platform and removes the entry. Requests interrupted before
+Venafi returned the request ID can't be revoked by the plugin, delete the entry once it is handled in Venafi.
+`
+
+const (
+	errorTextOrphanNoPickupID  = "the request ID of the orphan is not known, find and revoke the certificate in Venafi"
+	errorTextOrphanRoleDeleted = "role %s of the orphan is deleted, revoke the certificate in Venafi"
+)
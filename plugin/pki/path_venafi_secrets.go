@@ -2,9 +2,19 @@ package pki
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"github.com/Venafi/vcert/pkg/endpoint"
+	"github.com/Venafi/vcert/pkg/venafi/tpp"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/crypto/pkcs12"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
 )
 
 func pathCredentialsList(b *backend) *framework.Path {
@@ -22,6 +32,27 @@ func pathCredentialsList(b *backend) *framework.Path {
 	}
 }
 
+func pathCredentialsTest(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: CredentialsRootPath + framework.GenericNameRegex("name") + "/test$",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the authentication object",
+				Required:    true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathVenafiSecretTest,
+				Summary:  "Check connectivity, credentials and zone of a venafi secret",
+			},
+		},
+		HelpSynopsis:    pathVenafiSecretTestHelpSyn,
+		HelpDescription: pathVenafiSecretTestHelpDesc,
+	}
+}
+
 func pathCredentials(b *backend) *framework.Path {
 	return &framework.Path{
 		Pattern: CredentialsRootPath + framework.GenericNameRegex("name"),
@@ -38,6 +69,11 @@ Example for Platform: testpolicy\\vault
 Example for Venafi Cloud: e33f3e40-4e7e-11ea-8da3-b3c196ebeb0b`,
 				Required: true,
 			},
+			"allowed_zones": {
+				Type: framework.TypeCommaStringSlice,
+				Description: `Zones which roles using the secret can set in addition to zone, so that one credential serves several
+policy folders. A zone ending with "\*" allows the zones below it. Any zone if empty`,
+			},
 			"tpp_url": {
 				Type:        framework.TypeString,
 				Description: `URL of Venafi Platform. Example: https://tpp.venafi.example/vedsdk. Deprecated, use 'url' instead`,
@@ -79,7 +115,55 @@ Example for Venafi Cloud: e33f3e40-4e7e-11ea-8da3-b3c196ebeb0b`,
 			"trust_bundle_file": {
 				Type: framework.TypeString,
 				Description: `Use to specify a PEM formatted file with certificates to be used as trust anchors when communicating with the remote server.
-Example: trust_bundle_file="/path-to/bundle.pem""`,
+Example: trust_bundle_file="/path-to/bundle.pem"". Reading the secret shows the subject and expiration of the certificates of the file`,
+			},
+			"trust_bundle": {
+				Type: framework.TypeString,
+				Description: `PEM formatted certificates to be used as trust anchors when communicating with the remote server.
+The bundle is stored with the venafi secret and takes precedence over trust_bundle_file`,
+			},
+			"proxy_url": {
+				Type:        framework.TypeString,
+				Description: `URL of the HTTP proxy used to connect to the Venafi API Endpoint. Example: http://proxy.example:3128. By default proxy is taken from the environment`,
+			},
+			"connect_timeout": {
+				Type:        framework.TypeDurationSecond,
+				Description: `Timeout for establishing a connection to the Venafi API Endpoint`,
+				Default:     30,
+			},
+			"request_timeout": {
+				Type:        framework.TypeDurationSecond,
+				Description: `Timeout for a single request to the Venafi API Endpoint`,
+				Default:     30,
+			},
+			"min_tls_version": {
+				Type:        framework.TypeString,
+				Description: `Minimum TLS version accepted when connecting to the Venafi API Endpoint. Valid values are: "tls10", "tls11", "tls12", "tls13"`,
+			},
+			"server_name": {
+				Type:        framework.TypeString,
+				Description: `Server name sent in SNI and used to verify the certificate of the Venafi API Endpoint, if it differs from the host of url`,
+			},
+			"verify": {
+				Type:        framework.TypeBool,
+				Description: `Set it to true to check connectivity, credentials and zone before the venafi secret is saved`,
+				Default:     false,
+			},
+			"client_certificate": {
+				Type:        framework.TypeString,
+				Description: `PEM formatted client certificate used to authenticate to Venafi Platform with mutual TLS. Requires client_private_key`,
+			},
+			"client_private_key": {
+				Type:        framework.TypeString,
+				Description: `PEM formatted private key of the client certificate used to authenticate to Venafi Platform`,
+			},
+			"client_pkcs12": {
+				Type:        framework.TypeString,
+				Description: `Base64 encoded PKCS#12 bundle with the client certificate and private key used to authenticate to Venafi Platform. Can't be used together with client_certificate`,
+			},
+			"client_pkcs12_password": {
+				Type:        framework.TypeString,
+				Description: `Password of the PKCS#12 bundle set in client_pkcs12`,
 			},
 			"fakemode": {
 				Type:        framework.TypeBool,
@@ -111,16 +195,36 @@ const (
 	tokenMode             = `TPP Token (access_token, refresh_token)` // #nosec G101
 	tppMode               = `TPP Credentials (tpp_user, tpp_password)`
 	cloudMode             = `Cloud API Key (apikey)`
+	clientCertMode        = `TPP Client Certificate (client_certificate, client_private_key or client_pkcs12)`
 	errorMultiModeMessage = `can't specify both: %s and %s modes in the same venafi secret`
 	errorTextURLEmpty     = `"url" argument is required`
 	errorTextZoneEmpty    = `"zone" argument is required`
-	errorTextInvalidMode  = "invalid mode: fakemode or apikey or tpp credentials or tpp access token required"
+	errorTextInvalidMode  = "invalid mode: fakemode or apikey or tpp credentials or tpp access token or client certificate required"
+
+	errorTextClientCertKeyPair    = `"client_certificate" and "client_private_key" must be specified together`
+	errorTextClientCertAndPKCS12  = `can't specify both "client_pkcs12" and "client_certificate"`
+	errorTextClientCertInvalid    = `failed to parse client certificate: %s`
+	errorTextTrustBundleInvalid   = `"trust_bundle" is invalid: %s`
+	errorTextTrustBundleFileEmpty = `trust bundle file %s contains no certificates`
+	errorTextProxyURLInvalid      = `"proxy_url" is invalid: %s`
+	errorTextMinTLSVersion        = `"min_tls_version" can be "tls10", "tls11", "tls12" or "tls13", not %s`
+	errorTextNegativeTimeout      = `"connect_timeout" and "request_timeout" can't be negative`
+
+	errorTextVerifyUnreachable  = `Venafi endpoint %s is not reachable: %s`
+	errorTextVerifyTLS          = `TLS trust error connecting to Venafi endpoint %s: %s. Check trust_bundle or trust_bundle_file`
+	errorTextVerifyAuth         = `authentication to Venafi endpoint %s failed: %s. Check the credentials of the venafi secret`
+	errorTextVerifyZoneNotFound = `zone %q not found. Check the zone of the venafi secret`
+	errorTextVerifyZone         = `failed to read configuration of zone %q: %s`
+
+	errorTextVerifyClientCertNotTPP = `client certificate authentication is supported by Venafi Platform only`
 )
 
 var (
 	errorTextMixedTPPAndToken   = fmt.Sprintf(errorMultiModeMessage, tppMode, tokenMode)
 	errorTextMixedTPPAndCloud   = fmt.Sprintf(errorMultiModeMessage, tppMode, cloudMode)
 	errorTextMixedTokenAndCloud = fmt.Sprintf(errorMultiModeMessage, tokenMode, cloudMode)
+	errorTextMixedTPPAndCert    = fmt.Sprintf(errorMultiModeMessage, tppMode, clientCertMode)
+	errorTextMixedCertAndCloud  = fmt.Sprintf(errorMultiModeMessage, clientCertMode, cloudMode)
 )
 
 func (b *backend) pathVenafiSecretList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
@@ -148,6 +252,7 @@ func (b *backend) pathVenafiSecretRead(ctx context.Context, req *logical.Request
 	resp := &logical.Response{
 		Data: cred.ToResponseData(),
 	}
+	resp.Data["circuit_breaker"] = b.circuitStatus(policyName)
 
 	return resp, nil
 }
@@ -157,6 +262,8 @@ func (b *backend) pathVenafiSecretDelete(ctx context.Context, req *logical.Reque
 	if err != nil {
 		return nil, err
 	}
+	b.resetCircuit(data.Get("name").(string))
+	b.forgetSecretHealth(data.Get("name").(string))
 	return nil, nil
 }
 
@@ -187,7 +294,21 @@ func (b *backend) pathVenafiSecretCreate(ctx context.Context, req *logical.Reque
 		CloudURL:        cloudUrl,
 		Apikey:          data.Get("apikey").(string),
 		TrustBundleFile: data.Get("trust_bundle_file").(string),
+		TrustBundle:     data.Get("trust_bundle").(string),
 		Fakemode:        data.Get("fakemode").(bool),
+
+		ProxyURL:       data.Get("proxy_url").(string),
+		ConnectTimeout: time.Duration(data.Get("connect_timeout").(int)) * time.Second,
+		RequestTimeout: time.Duration(data.Get("request_timeout").(int)) * time.Second,
+		MinTLSVersion:  data.Get("min_tls_version").(string),
+		ServerName:     data.Get("server_name").(string),
+
+		ClientCertificate:    data.Get("client_certificate").(string),
+		ClientPrivateKey:     data.Get("client_private_key").(string),
+		ClientPKCS12:         data.Get("client_pkcs12").(string),
+		ClientPKCS12Password: data.Get("client_pkcs12_password").(string),
+
+		AllowedZones: data.Get("allowed_zones").([]string),
 	}
 
 	err = validateVenafiSecretEntry(entry)
@@ -195,6 +316,13 @@ func (b *backend) pathVenafiSecretCreate(ctx context.Context, req *logical.Reque
 		return logical.ErrorResponse(err.Error()), nil
 	}
 
+	if data.Get("verify").(bool) {
+		_, err = b.verifyVenafiSecret(entry)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
 	//Store it
 	jsonEntry, err := logical.StorageEntryJSON(CredentialsRootPath+name, entry)
 	if err != nil {
@@ -205,6 +333,8 @@ func (b *backend) pathVenafiSecretCreate(ctx context.Context, req *logical.Reque
 	if err != nil {
 		return nil, err
 	}
+	b.resetCircuit(name)
+	b.forgetSecretHealth(name)
 
 	var logResp *logical.Response
 
@@ -223,6 +353,39 @@ func (b *backend) pathVenafiSecretCreate(ctx context.Context, req *logical.Reque
 	return nil, nil
 }
 
+func (b *backend) pathVenafiSecretTest(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	entry, err := b.getVenafiSecret(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return logical.ErrorResponse(fmt.Sprintf("unknown venafi secret %s", name)), nil
+	}
+
+	accessToken := entry.AccessToken
+	connectorType, err := b.verifyVenafiSecret(entry)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	// the token pair obtained with the client certificate is kept for the next requests
+	if entry.AccessToken != accessToken {
+		err = b.storeVenafiSecret(ctx, req, name, entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"connector_type": connectorType.String(),
+			"url":            entry.URL,
+			"zone":           entry.Zone,
+		},
+	}, nil
+}
+
 func (b *backend) getVenafiSecret(ctx context.Context, s logical.Storage, name string) (*venafiSecretEntry, error) {
 	entry, err := s.Get(ctx, CredentialsRootPath+name)
 	if err != nil {
@@ -242,7 +405,8 @@ func (b *backend) getVenafiSecret(ctx context.Context, s logical.Storage, name s
 }
 
 func validateVenafiSecretEntry(entry *venafiSecretEntry) error {
-	if !entry.Fakemode && entry.Apikey == "" && (entry.TppUser == "" || entry.TppPassword == "") && entry.AccessToken == "" {
+	if !entry.Fakemode && entry.Apikey == "" && (entry.TppUser == "" || entry.TppPassword == "") && entry.AccessToken == "" &&
+		!entry.hasClientCertificate() {
 		return fmt.Errorf(errorTextInvalidMode)
 	}
 
@@ -268,6 +432,54 @@ func validateVenafiSecretEntry(entry *venafiSecretEntry) error {
 		if entry.AccessToken != "" && entry.Apikey != "" {
 			return fmt.Errorf(errorTextMixedTokenAndCloud)
 		}
+
+		if entry.TrustBundle != "" {
+			_, err := parseTrustBundlePEM(entry.TrustBundle)
+			if err != nil {
+				return fmt.Errorf(errorTextTrustBundleInvalid, err)
+			}
+		}
+
+		if entry.ProxyURL != "" {
+			proxyURL, err := url.Parse(entry.ProxyURL)
+			if err == nil && (proxyURL.Scheme == "" || proxyURL.Host == "") {
+				err = fmt.Errorf("scheme and host are required")
+			}
+			if err != nil {
+				return fmt.Errorf(errorTextProxyURLInvalid, err)
+			}
+		}
+
+		if _, ok := tlsVersions[entry.MinTLSVersion]; entry.MinTLSVersion != "" && !ok {
+			return fmt.Errorf(errorTextMinTLSVersion, entry.MinTLSVersion)
+		}
+
+		if entry.ConnectTimeout < 0 || entry.RequestTimeout < 0 {
+			return fmt.Errorf(errorTextNegativeTimeout)
+		}
+
+		if (entry.ClientCertificate == "") != (entry.ClientPrivateKey == "") {
+			return fmt.Errorf(errorTextClientCertKeyPair)
+		}
+
+		if entry.ClientCertificate != "" && entry.ClientPKCS12 != "" {
+			return fmt.Errorf(errorTextClientCertAndPKCS12)
+		}
+
+		if entry.hasClientCertificate() {
+			if entry.TppUser != "" {
+				return fmt.Errorf(errorTextMixedTPPAndCert)
+			}
+
+			if entry.Apikey != "" {
+				return fmt.Errorf(errorTextMixedCertAndCloud)
+			}
+
+			_, err := entry.getClientCertificate()
+			if err != nil {
+				return fmt.Errorf(errorTextClientCertInvalid, err)
+			}
+		}
 	}
 	return nil
 }
@@ -288,6 +500,9 @@ func getWarnings(entry *venafiSecretEntry, name string) []string {
 	if entry.TppPassword != "" {
 		warnings = append(warnings, "tpp_password is deprecated, please use access_token instead")
 	}
+	if entry.TrustBundle != "" && entry.TrustBundleFile != "" {
+		warnings = append(warnings, "trust_bundle_file is ignored because trust_bundle is set")
+	}
 	//Include success message in warnings
 	if len(warnings) > 0 {
 		warnings = append(warnings, "Venafi secret "+name+" saved successfully")
@@ -306,7 +521,148 @@ type venafiSecretEntry struct {
 	CloudURL        string `json:"cloud_url"`
 	Apikey          string `json:"apikey"`
 	TrustBundleFile string `json:"trust_bundle_file"`
+	TrustBundle     string `json:"trust_bundle"`
 	Fakemode        bool   `json:"fakemode"`
+
+	ProxyURL       string        `json:"proxy_url"`
+	ConnectTimeout time.Duration `json:"connect_timeout"`
+	RequestTimeout time.Duration `json:"request_timeout"`
+	MinTLSVersion  string        `json:"min_tls_version"`
+	ServerName     string        `json:"server_name"`
+
+	ClientCertificate    string `json:"client_certificate"`
+	ClientPrivateKey     string `json:"client_private_key"`
+	ClientPKCS12         string `json:"client_pkcs12"`
+	ClientPKCS12Password string `json:"client_pkcs12_password"`
+
+	// AccessTokenExpires is known only for tokens obtained by the plugin
+	AccessTokenExpires time.Time `json:"access_token_expires"`
+
+	// AllowedZones are the zones roles can set to override Zone
+	AllowedZones []string `json:"allowed_zones"`
+}
+
+// zoneAllowed checks if a role using the secret can target the zone, zone names are case insensitive
+func (p *venafiSecretEntry) zoneAllowed(zone string) bool {
+	if len(p.AllowedZones) == 0 || strings.EqualFold(zone, p.Zone) {
+		return true
+	}
+	for _, allowed := range p.AllowedZones {
+		if strings.EqualFold(zone, allowed) {
+			return true
+		}
+		if prefix := strings.TrimSuffix(allowed, "*"); prefix != allowed && strings.HasSuffix(prefix, `\`) &&
+			len(zone) > len(prefix) && strings.EqualFold(zone[:len(prefix)], prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// getTrustBundlePEM returns the inline trust bundle or, if it is not set, reads the bundle from trust_bundle_file
+func (p *venafiSecretEntry) getTrustBundlePEM() (string, error) {
+	if p.TrustBundle != "" {
+		return p.TrustBundle, nil
+	}
+	if p.TrustBundleFile == "" {
+		return "", nil
+	}
+
+	trustBundle, err := ioutil.ReadFile(p.TrustBundleFile)
+	if err != nil {
+		return "", err
+	}
+	return string(trustBundle), nil
+}
+
+func (p *venafiSecretEntry) getHTTPClientSettings() (httpClientSettings, error) {
+	settings := httpClientSettings{
+		proxyURL:       p.ProxyURL,
+		connectTimeout: p.ConnectTimeout,
+		requestTimeout: p.RequestTimeout,
+		minTLSVersion:  tlsVersions[p.MinTLSVersion],
+		serverName:     p.ServerName,
+	}
+
+	if p.hasClientCertificate() {
+		clientCert, err := p.getClientCertificate()
+		if err != nil {
+			return settings, err
+		}
+		settings.clientCert = clientCert
+	}
+	return settings, nil
+}
+
+// connectorType is the Venafi platform the secret connects to
+func (p *venafiSecretEntry) connectorType() endpoint.ConnectorType {
+	switch {
+	case p.Fakemode:
+		return endpoint.ConnectorTypeFake
+	case p.URL != "" && (p.TppUser != "" || p.AccessToken != "" || p.hasClientCertificate()):
+		return endpoint.ConnectorTypeTPP
+	case p.Apikey != "":
+		return endpoint.ConnectorTypeCloud
+	}
+	return endpoint.ConnectorTypeUndefined
+}
+
+func (p *venafiSecretEntry) hasClientCertificate() bool {
+	return p.ClientCertificate != "" || p.ClientPKCS12 != ""
+}
+
+// needsClientCertificateToken is true when a new token pair has to be obtained with the client certificate, because
+// there is no access token yet or the one obtained by the plugin expired
+func (p *venafiSecretEntry) needsClientCertificateToken() bool {
+	if !p.hasClientCertificate() {
+		return false
+	}
+	return p.AccessToken == "" || (!p.AccessTokenExpires.IsZero() && time.Now().After(p.AccessTokenExpires))
+}
+
+// setAccessData keeps the token pair obtained from TPP in the entry
+func (p *venafiSecretEntry) setAccessData(resp tpp.OauthRefreshAccessTokenResponse) {
+	p.AccessToken = resp.Access_token
+	p.RefreshToken = resp.Refresh_token
+	p.AccessTokenExpires = time.Time{}
+	if resp.Expires > 0 {
+		p.AccessTokenExpires = time.Unix(int64(resp.Expires), 0).UTC()
+	}
+}
+
+// getClientCertificate returns the TLS client certificate configured either as PEM pair or as a PKCS#12 bundle
+func (p *venafiSecretEntry) getClientCertificate() (*tls.Certificate, error) {
+	var certPEM, keyPEM []byte
+
+	if p.ClientPKCS12 != "" {
+		pfxData, err := base64.StdEncoding.DecodeString(p.ClientPKCS12)
+		if err != nil {
+			return nil, fmt.Errorf("client_pkcs12 is not a valid base64 string: %s", err)
+		}
+
+		blocks, err := pkcs12.ToPEM(pfxData, p.ClientPKCS12Password)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, block := range blocks {
+			if block.Type == "CERTIFICATE" {
+				certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+			} else {
+				keyPEM = append(keyPEM, pem.EncodeToMemory(block)...)
+			}
+		}
+	} else {
+		certPEM = []byte(p.ClientCertificate)
+		keyPEM = []byte(p.ClientPrivateKey)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
 }
 
 func (p *venafiSecretEntry) ToResponseData() map[string]interface{} {
@@ -323,10 +679,20 @@ func (p *venafiSecretEntry) ToResponseData() map[string]interface{} {
 	if p.Apikey != "" {
 		apiKey = "********"
 	}
+	var clientPrivateKey, clientPKCS12, clientPKCS12Password string
+	if p.ClientPrivateKey != "" {
+		clientPrivateKey = "********"
+	}
+	if p.ClientPKCS12 != "" {
+		clientPKCS12 = "********"
+	}
+	if p.ClientPKCS12Password != "" {
+		clientPKCS12Password = "********"
+	}
 
 	responseData := map[string]interface{}{
 		//Sensible data will not be returned.
-		//tpp_password, api_key, access_token, refresh_token
+		//tpp_password, api_key, access_token, refresh_token, client_private_key, client_pkcs12, client_pkcs12_password
 
 		"url":               p.URL,
 		"zone":              p.Zone,
@@ -337,6 +703,43 @@ func (p *venafiSecretEntry) ToResponseData() map[string]interface{} {
 		"apikey":            apiKey,
 		"trust_bundle_file": p.TrustBundleFile,
 		"fakemode":          p.Fakemode,
+
+		"client_certificate":     p.ClientCertificate,
+		"client_private_key":     clientPrivateKey,
+		"client_pkcs12":          clientPKCS12,
+		"client_pkcs12_password": clientPKCS12Password,
+
+		"allowed_zones": p.AllowedZones,
+	}
+
+	if p.ProxyURL != "" {
+		responseData["proxy_url"] = redactURLPassword(p.ProxyURL)
+	}
+	if p.ConnectTimeout != 0 {
+		responseData["connect_timeout"] = int64(p.ConnectTimeout.Seconds())
+	}
+	if p.RequestTimeout != 0 {
+		responseData["request_timeout"] = int64(p.RequestTimeout.Seconds())
+	}
+	if p.MinTLSVersion != "" {
+		responseData["min_tls_version"] = p.MinTLSVersion
+	}
+	if p.ServerName != "" {
+		responseData["server_name"] = p.ServerName
+	}
+
+	if p.TrustBundle != "" {
+		responseData["trust_bundle"] = getTrustBundleInfo(p.TrustBundle)
+	} else if p.TrustBundleFile != "" {
+		// the file is read on every request, so it's checked again to show a missing or replaced bundle
+		trustBundle, err := p.getTrustBundlePEM()
+		if err != nil {
+			responseData["trust_bundle_error"] = err.Error()
+		} else if info := getTrustBundleInfo(trustBundle); len(info) == 0 {
+			responseData["trust_bundle_error"] = fmt.Sprintf(errorTextTrustBundleFileEmpty, p.TrustBundleFile)
+		} else {
+			responseData["trust_bundle"] = info
+		}
 	}
 	return responseData
 }
@@ -347,3 +750,8 @@ const (
 	pathVenafiSecretsHelpSyn      = `Manage the Venafi Secrets that can be created with this backend.`                    // #nosec
 	pathVenafiSecretsHelpDesc     = `This path lets you manage the Venafi Secrets that can be created with this backend.` // #nosec
 )
+
+const (
+	pathVenafiSecretTestHelpSyn  = `Verify a Venafi Secret`                                                                       // #nosec
+	pathVenafiSecretTestHelpDesc = `Checks that the Venafi endpoint is reachable, the credentials are valid and the zone exists.` // #nosec
+)
@@ -0,0 +1,229 @@
+package pki
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"strings"
+)
+
+const (
+	pkiFormatPEM       = "pem"
+	pkiFormatDER       = "der"
+	pkiFormatPEMBundle = "pem_bundle"
+
+	pkiPrivateKeyFormatPKCS8 = "pkcs8"
+)
+
+// pkiCompatOptions are the request parameters of the built-in PKI secrets engine. They are kept with the pending
+// request, so the certificate picked up later is returned in the same format. ttl and exclude_cn_from_sans are
+// accepted in any mode.
+type pkiCompatOptions struct {
+	Format           string `json:"format,omitempty"`
+	PrivateKeyFormat string `json:"private_key_format,omitempty"`
+}
+
+// pkiCompatFields are the fields of the issue and sign paths which are accepted in the PKI compatibility mode only
+func pkiCompatFields(signCSR bool) map[string]*framework.FieldSchema {
+	fields := map[string]*framework.FieldSchema{
+		"format": {
+			Type:        framework.TypeString,
+			Default:     pkiFormatPEM,
+			Description: `Format of the returned data: "pem", "der" or "pem_bundle". Requires pki_compatible`,
+		},
+	}
+	if !signCSR {
+		fields["private_key_format"] = &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Default:     pkiFormatDER,
+			Description: `Format of the returned private key: "der" or "pem" to follow format, or "pkcs8". Requires pki_compatible`,
+		}
+	}
+	return fields
+}
+
+// pkiCompatEnabled tells whether the PKI compatibility mode is enabled for the role or for the mount
+func (b *backend) pkiCompatEnabled(ctx context.Context, s logical.Storage, role *roleEntry) (bool, error) {
+	if role.PKICompatible {
+		return true, nil
+	}
+	config, err := b.getMountConfig(ctx, s)
+	if err != nil {
+		return false, err
+	}
+	return config.PKICompatible, nil
+}
+
+// parsePKICompatOptions returns the options of the PKI compatibility mode, or nil when the mode is disabled.
+// Parameters of the mode are rejected when it's disabled.
+func parsePKICompatOptions(data *framework.FieldData, enabled bool) (*pkiCompatOptions, error) {
+	if !enabled {
+		for name := range pkiCompatFields(false) {
+			if _, ok := data.Schema[name]; !ok {
+				continue
+			}
+			if _, ok := data.Raw[name]; ok {
+				return nil, fmt.Errorf(errorTextPKICompatDisabled, name)
+			}
+		}
+		return nil, nil
+	}
+
+	opts := &pkiCompatOptions{
+		Format: data.Get("format").(string),
+	}
+	if _, ok := data.Schema["private_key_format"]; ok {
+		opts.PrivateKeyFormat = data.Get("private_key_format").(string)
+	}
+
+	switch opts.Format {
+	case pkiFormatPEM, pkiFormatDER, pkiFormatPEMBundle:
+	default:
+		return nil, fmt.Errorf(errorTextInvalidFormat, opts.Format)
+	}
+	switch opts.PrivateKeyFormat {
+	case "", pkiFormatPEM, pkiFormatDER, pkiPrivateKeyFormatPKCS8:
+	default:
+		return nil, fmt.Errorf(errorTextInvalidPrivateKeyFormat, opts.PrivateKeyFormat)
+	}
+	if keyPassword, ok := data.GetOk("key_password"); ok && keyPassword.(string) != "" &&
+		(opts.Format == pkiFormatDER || opts.PrivateKeyFormat == pkiPrivateKeyFormatPKCS8) {
+		return nil, fmt.Errorf(errorTextEncryptedKeyFormat)
+	}
+	return opts, nil
+}
+
+// caChain returns the CA certificates of the chain starting with the issuing CA, like the PKI secrets engine does
+func caChain(chain string, certificate string, chainOption string) []string {
+	var certs []string
+	rest := []byte(chain)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert := strings.TrimSpace(string(pem.EncodeToMemory(block)))
+		if cert == strings.TrimSpace(certificate) {
+			continue
+		}
+		certs = append(certs, cert)
+	}
+	if chainOption == "first" {
+		for i, j := 0, len(certs)-1; i < j; i, j = i+1, j-1 {
+			certs[i], certs[j] = certs[j], certs[i]
+		}
+	}
+	return certs
+}
+
+func pemToDER(data string) string {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(block.Bytes)
+}
+
+// convertPrivateKey returns the private key in the requested format. Encrypted keys are returned as they are.
+func convertPrivateKey(privateKey string, opts *pkiCompatOptions) (string, error) {
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil || x509.IsEncryptedPEMBlock(block) {
+		return privateKey, nil
+	}
+
+	if opts.PrivateKeyFormat == pkiPrivateKeyFormatPKCS8 {
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return "", err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return "", err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+
+	if opts.Format == pkiFormatDER {
+		return base64.StdEncoding.EncodeToString(block.Bytes), nil
+	}
+	return strings.TrimSpace(string(pem.EncodeToMemory(block))), nil
+}
+
+func privateKeyType(cert *x509.Certificate) string {
+	switch cert.PublicKeyAlgorithm {
+	case x509.RSA:
+		return "rsa"
+	case x509.ECDSA:
+		return "ec"
+	case x509.Ed25519:
+		return "ed25519"
+	}
+	return ""
+}
+
+// pkiCompatResponseData builds the response data of issue and sign in the schema of the PKI secrets engine
+func pkiCompatResponseData(opts *pkiCompatOptions, role *roleEntry, serialNumber string, chain string, certificate string,
+	privateKey string, parsedCertificate *x509.Certificate, signCSR bool) (map[string]interface{}, error) {
+
+	caCerts := caChain(chain, certificate, role.ChainOption)
+	issuingCA := ""
+	if len(caCerts) > 0 {
+		issuingCA = caCerts[0]
+	}
+	certificate = strings.TrimSpace(certificate)
+
+	respData := map[string]interface{}{
+		"serial_number": serialNumber,
+		"expiration":    parsedCertificate.NotAfter.Unix(),
+	}
+
+	if !signCSR {
+		key, err := convertPrivateKey(privateKey, opts)
+		if err != nil {
+			return nil, err
+		}
+		respData["private_key"] = key
+		respData["private_key_type"] = privateKeyType(parsedCertificate)
+	}
+
+	switch opts.Format {
+	case pkiFormatDER:
+		certificate = pemToDER(certificate)
+		issuingCA = pemToDER(issuingCA)
+		for i := range caCerts {
+			caCerts[i] = pemToDER(caCerts[i])
+		}
+	case pkiFormatPEMBundle:
+		bundle := []string{certificate}
+		if !signCSR {
+			bundle = append([]string{respData["private_key"].(string)}, bundle...)
+		}
+		certificate = strings.Join(append(bundle, caCerts...), "\n")
+	}
+
+	respData["certificate"] = certificate
+	respData["issuing_ca"] = issuingCA
+	respData["ca_chain"] = caCerts
+	return respData, nil
+}
+
+const (
+	errorTextPKICompatDisabled       = `"%s" is accepted only when pki_compatible is set for the role or the mount`
+	errorTextInvalidFormat           = `invalid format %q, valid values are "pem", "der" and "pem_bundle"`
+	errorTextInvalidPrivateKeyFormat = `invalid private_key_format %q, valid values are "der", "pem" and "pkcs8"`
+	errorTextEncryptedKeyFormat      = `private key encrypted with key_password can be returned in PEM format only`
+)
@@ -0,0 +1,145 @@
+package pki
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestPKICompatibleResponse(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+	createFakeRole(t, b, storage, "venafi", nil)
+	createFakeRole(t, b, storage, "compat", map[string]interface{}{
+		"pki_compatible": true,
+		"generate_lease": true,
+		"max_ttl":        "2h",
+	})
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		return codedErrorResponse(t, resp, err)
+	}
+
+	// parameters of the PKI secrets engine are refused unless the mode is enabled
+	resp := request("issue/venafi", map[string]interface{}{"common_name": "compat.example.com", "format": "der"})
+	if !resp.IsError() {
+		t.Fatalf("format should be refused without pki_compatible, got %#v", resp)
+	}
+	resp = request("issue/venafi", map[string]interface{}{"common_name": "compat.example.com"})
+	if resp.IsError() || resp.Data["certificate_chain"] == nil || resp.Data["ca_chain"] != nil {
+		t.Fatalf("expected response of the plugin, got %#v", resp)
+	}
+
+	resp = request("issue/compat", map[string]interface{}{
+		"common_name":          "compat.example.com",
+		"alt_names":            "www.compat.example.com",
+		"exclude_cn_from_sans": true,
+		"ttl":                  "1h",
+	})
+	if resp.IsError() {
+		t.Fatalf("failed to issue certificate: %#v", resp)
+	}
+	if resp.Data["certificate_chain"] != nil || resp.Data["private_key_type"] != "rsa" {
+		t.Fatalf("expected response of the PKI secrets engine, got %#v", resp.Data)
+	}
+	cert := parsePEMCertificate(t, resp.Data["certificate"].(string))
+	if resp.Data["expiration"] != cert.NotAfter.Unix() {
+		t.Fatalf("expected expiration %d, got %v", cert.NotAfter.Unix(), resp.Data["expiration"])
+	}
+	serial, _ := getHexFormatted(cert.SerialNumber.Bytes(), ":")
+	if resp.Data["serial_number"] != serial {
+		t.Fatalf("expected serial number %s, got %v", serial, resp.Data["serial_number"])
+	}
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "www.compat.example.com" {
+		t.Fatalf("common name should be excluded from SANs, got %v", cert.DNSNames)
+	}
+	caCerts := resp.Data["ca_chain"].([]string)
+	if len(caCerts) == 0 || resp.Data["issuing_ca"] != caCerts[0] {
+		t.Fatalf("expected issuing CA at the beginning of the CA chain, got %#v", resp.Data)
+	}
+	issuingCA := parsePEMCertificate(t, caCerts[0])
+	if err := cert.CheckSignatureFrom(issuingCA); err != nil {
+		t.Fatalf("certificate isn't signed by the issuing CA: %s", err)
+	}
+	if resp.Secret == nil || resp.Secret.TTL != time.Hour {
+		t.Fatalf("expected lease of one hour, got %#v", resp.Secret)
+	}
+
+	// the mode can be enabled for the whole mount
+	request("config", map[string]interface{}{"pki_compatible": true})
+	resp = request("issue/venafi", map[string]interface{}{
+		"common_name":        "der.example.com",
+		"format":             "der",
+		"private_key_format": "pkcs8",
+	})
+	if resp.IsError() {
+		t.Fatalf("failed to issue certificate: %#v", resp)
+	}
+	der, err := base64.StdEncoding.DecodeString(resp.Data["certificate"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := x509.ParseCertificate(der); err != nil {
+		t.Fatalf("expected DER certificate: %s", err)
+	}
+	der, err = base64.StdEncoding.DecodeString(resp.Data["private_key"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(der); err != nil {
+		t.Fatalf("expected PKCS#8 private key: %s", err)
+	}
+
+	resp = request("issue/venafi", map[string]interface{}{
+		"common_name":  "der.example.com",
+		"format":       "der",
+		"key_password": "secret",
+	})
+	if !resp.IsError() {
+		t.Fatalf("encrypted key should be refused in DER format, got %#v", resp)
+	}
+
+	csr := createTestCSR(t, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "bundle.example.com"},
+		DNSNames: []string{"bundle.example.com"},
+	})
+	resp = request("sign/venafi", map[string]interface{}{
+		"csr":    csr,
+		"format": "pem_bundle",
+	})
+	if resp.IsError() {
+		t.Fatalf("failed to sign certificate: %#v", resp)
+	}
+	if _, ok := resp.Data["private_key"]; ok {
+		t.Fatal("sign shouldn't return a private key")
+	}
+	bundle := resp.Data["certificate"].(string)
+	if strings.Count(bundle, "BEGIN CERTIFICATE") != 1+len(resp.Data["ca_chain"].([]string)) {
+		t.Fatalf("expected certificate and CA chain in the bundle, got %s", bundle)
+	}
+}
+
+func parsePEMCertificate(t *testing.T, data string) *x509.Certificate {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		t.Fatalf("no PEM data in %q", data)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
@@ -0,0 +1,246 @@
+package pki
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/logical"
+	"strings"
+	"time"
+)
+
+const (
+	publicKeysPath      = "pubkeys/"
+	publicKeySerialPath = "pubkey-serials/"
+
+	keyReuseAllow       = "allow"
+	keyReuseDenyRevoked = "deny_revoked"
+	keyReuseDeny        = "deny"
+)
+
+// publicKeyUse is a certificate issued for the public key
+type publicKeyUse struct {
+	SerialNumber string    `json:"serial_number"`
+	CommonName   string    `json:"common_name"`
+	Role         string    `json:"role"`
+	Issued       time.Time `json:"issued"`
+	Revoked      bool      `json:"revoked"`
+
+	// RequestID is set when the key is reserved by a request in progress, the reservation is replaced by the
+	// certificate when it's stored
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// publicKeyEntry lists the certificates issued for the public key, the key is the SHA-256 of the SPKI
+type publicKeyEntry struct {
+	Certificates []publicKeyUse `json:"certificates"`
+}
+
+// spkiFingerprint is the SHA-256 of the DER encoded SubjectPublicKeyInfo
+func spkiFingerprint(rawSPKI []byte) string {
+	hash := sha256.Sum256(rawSPKI)
+	return hex.EncodeToString(hash[:])
+}
+
+func (b *backend) getPublicKeyEntry(ctx context.Context, s logical.Storage, fingerprint string) (*publicKeyEntry, error) {
+	var keyEntry publicKeyEntry
+	entry, err := s.Get(ctx, publicKeysPath+fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return &keyEntry, nil
+	}
+	if err := entry.DecodeJSON(&keyEntry); err != nil {
+		return nil, err
+	}
+	return &keyEntry, nil
+}
+
+func (b *backend) putPublicKeyEntry(ctx context.Context, s logical.Storage, fingerprint string, keyEntry *publicKeyEntry) error {
+	entry, err := logical.StorageEntryJSON(publicKeysPath+fingerprint, keyEntry)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// indexPublicKey records the issued or signed certificate under the fingerprint of its public key, it replaces the
+// reservation of the key by the request
+func (b *backend) indexPublicKey(ctx context.Context, s logical.Storage, roleName string, requestID string,
+	serialNumber string, commonName string, rawSPKI []byte) error {
+
+	fingerprint := spkiFingerprint(rawSPKI)
+
+	b.publicKeysLock.Lock()
+	defer b.publicKeysLock.Unlock()
+
+	keyEntry, err := b.getPublicKeyEntry(ctx, s, fingerprint)
+	if err != nil {
+		return err
+	}
+	uses := keyEntry.Certificates[:0]
+	indexed := false
+	for _, use := range keyEntry.Certificates {
+		if use.RequestID != "" && use.RequestID == requestID {
+			continue
+		}
+		indexed = indexed || use.SerialNumber == serialNumber
+		uses = append(uses, use)
+	}
+	keyEntry.Certificates = uses
+	if !indexed {
+		keyEntry.Certificates = append(keyEntry.Certificates, publicKeyUse{
+			SerialNumber: serialNumber,
+			CommonName:   commonName,
+			Role:         roleName,
+			Issued:       time.Now().UTC(),
+		})
+	}
+	if err := b.putPublicKeyEntry(ctx, s, fingerprint, keyEntry); err != nil {
+		return err
+	}
+
+	// revocation knows the serial number only
+	entry := &logical.StorageEntry{
+		Key:   publicKeySerialPath + normalizeSerial(serialNumber),
+		Value: []byte(fingerprint),
+	}
+	return s.Put(ctx, entry)
+}
+
+// markPublicKeyRevoked records that the certificate issued for the public key is revoked. It's called only after
+// Venafi confirmed the revocation.
+func (b *backend) markPublicKeyRevoked(ctx context.Context, s logical.Storage, serialNumber string) error {
+	entry, err := s.Get(ctx, publicKeySerialPath+normalizeSerial(serialNumber))
+	if err != nil || entry == nil {
+		return err
+	}
+	fingerprint := string(entry.Value)
+
+	b.publicKeysLock.Lock()
+	defer b.publicKeysLock.Unlock()
+
+	keyEntry, err := b.getPublicKeyEntry(ctx, s, fingerprint)
+	if err != nil {
+		return err
+	}
+	for i := range keyEntry.Certificates {
+		if normalizeSerial(keyEntry.Certificates[i].SerialNumber) == normalizeSerial(serialNumber) {
+			keyEntry.Certificates[i].Revoked = true
+		}
+	}
+	return b.putPublicKeyEntry(ctx, s, fingerprint, keyEntry)
+}
+
+// isCertificateStored is true when storeCertificate already completed for the certificate. The serial number entry
+// of the public key index is written for every certificate and it's kept when the certificate is deleted.
+func (b *backend) isCertificateStored(ctx context.Context, s logical.Storage, serialNumber string) (bool, error) {
+	entry, err := s.Get(ctx, publicKeySerialPath+normalizeSerial(serialNumber))
+	if err != nil {
+		return false, err
+	}
+	return entry != nil, nil
+}
+
+// reservePublicKey refuses the CSR key according to key_reuse of the role. With key_reuse deny the key is reserved
+// for the request while the lock is held, so concurrent requests with the same key can't both pass the check before
+// the certificate is indexed. The reservation is replaced by indexPublicKey or removed by releasePublicKey.
+func (b *backend) reservePublicKey(ctx context.Context, s logical.Storage, role *roleEntry, pending *pendingRequest,
+	commonName string, rawSPKI []byte) error {
+
+	if role.KeyReuse == "" || role.KeyReuse == keyReuseAllow {
+		return nil
+	}
+	fingerprint := spkiFingerprint(rawSPKI)
+
+	b.publicKeysLock.Lock()
+	defer b.publicKeysLock.Unlock()
+
+	keyEntry, err := b.getPublicKeyEntry(ctx, s, fingerprint)
+	if err != nil {
+		return err
+	}
+	err = b.checkKeyReuse(ctx, s, role, commonName, keyEntry)
+	if err != nil || role.KeyReuse != keyReuseDeny {
+		return err
+	}
+	keyEntry.Certificates = append(keyEntry.Certificates, publicKeyUse{
+		CommonName: commonName,
+		Role:       pending.Role,
+		Issued:     time.Now().UTC(),
+		RequestID:  pending.ID,
+	})
+	if err := b.putPublicKeyEntry(ctx, s, fingerprint, keyEntry); err != nil {
+		return err
+	}
+	pending.KeyFingerprint = fingerprint
+	return nil
+}
+
+// releasePublicKey removes the reservation of the key by the request which failed
+func (b *backend) releasePublicKey(ctx context.Context, s logical.Storage, pending *pendingRequest) error {
+	if pending.KeyFingerprint == "" {
+		return nil
+	}
+
+	b.publicKeysLock.Lock()
+	defer b.publicKeysLock.Unlock()
+
+	keyEntry, err := b.getPublicKeyEntry(ctx, s, pending.KeyFingerprint)
+	if err != nil {
+		return err
+	}
+	uses := keyEntry.Certificates[:0]
+	for _, use := range keyEntry.Certificates {
+		if use.RequestID != pending.ID {
+			uses = append(uses, use)
+		}
+	}
+	if len(uses) == 0 {
+		return s.Delete(ctx, publicKeysPath+pending.KeyFingerprint)
+	}
+	keyEntry.Certificates = uses
+	return b.putPublicKeyEntry(ctx, s, pending.KeyFingerprint, keyEntry)
+}
+
+// checkKeyReuse refuses the CSR key according to key_reuse of the role. With allow_key_reuse_same_cn earlier
+// certificates of the same common name don't count, unless they are revoked. A reservation which wasn't released,
+// because Vault went down during the request, doesn't count once the rollback ran and no pending request keeps it.
+func (b *backend) checkKeyReuse(ctx context.Context, s logical.Storage, role *roleEntry, commonName string,
+	keyEntry *publicKeyEntry) error {
+
+	for _, use := range keyEntry.Certificates {
+		if use.Revoked {
+			return fmt.Errorf(errorTextKeyReusedRevoked, use.SerialNumber)
+		}
+		if role.KeyReuse != keyReuseDeny {
+			continue
+		}
+		if role.AllowKeyReuseSameCN && strings.EqualFold(use.CommonName, commonName) {
+			continue
+		}
+		if use.RequestID == "" {
+			return fmt.Errorf(errorTextKeyReused, use.SerialNumber, use.CommonName)
+		}
+		if time.Since(use.Issued) > walRollbackMinAge {
+			pending, err := b.getPendingRequest(ctx, s, use.Role, use.RequestID)
+			if err != nil {
+				return err
+			}
+			if pending == nil {
+				continue
+			}
+		}
+		return fmt.Errorf(errorTextKeyReserved, use.RequestID, use.CommonName)
+	}
+	return nil
+}
+
+const (
+	errorTextKeyReused        = "key of the CSR was already used for certificate %s of %s"
+	errorTextKeyReserved      = "key of the CSR is used by request %s of %s in progress"
+	errorTextKeyReusedRevoked = "key of the CSR was used for revoked certificate %s"
+	errorTextInvalidKeyReuse  = `invalid key_reuse %q, valid values are "allow", "deny_revoked" and "deny"`
+)
@@ -0,0 +1,200 @@
+package pki
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestKeyReuse(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+	createFakeRole(t, b, storage, "allow", nil)
+	createFakeRole(t, b, storage, "deny", map[string]interface{}{"key_reuse": keyReuseDeny})
+	createFakeRole(t, b, storage, "renew", map[string]interface{}{
+		"key_reuse":               keyReuseDeny,
+		"allow_key_reuse_same_cn": true,
+	})
+	createFakeRole(t, b, storage, "revoked", map[string]interface{}{"key_reuse": keyReuseDenyRevoked})
+	tppServer, _ := createRevokingRole(t, b, storage, "tpp")
+	defer tppServer.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrFor := func(cn string) string {
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject:  pkix.Name{CommonName: cn},
+			DNSNames: []string{cn},
+		}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+	}
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		return codedErrorResponse(t, resp, err)
+	}
+
+	resp := request("sign/allow", map[string]interface{}{"csr": csrFor("first.example.com")})
+	if resp.IsError() {
+		t.Fatalf("failed to sign certificate: %#v", resp)
+	}
+	serial := resp.Data["serial_number"].(string)
+
+	if resp := request("sign/deny", map[string]interface{}{"csr": csrFor("second.example.com")}); !resp.IsError() {
+		t.Fatalf("reused key should be refused, got %#v", resp)
+	}
+	if resp := request("sign/renew", map[string]interface{}{"csr": csrFor("second.example.com")}); !resp.IsError() {
+		t.Fatalf("reused key of another common name should be refused, got %#v", resp)
+	}
+	if resp := request("sign/renew", map[string]interface{}{"csr": csrFor("first.example.com")}); resp.IsError() {
+		t.Fatalf("renewal with the key of the same common name should be allowed, got %#v", resp)
+	}
+	if resp := request("sign/revoked", map[string]interface{}{"csr": csrFor("second.example.com")}); resp.IsError() {
+		t.Fatalf("key which isn't revoked should be allowed, got %#v", resp)
+	}
+
+	// neither the expired lease nor the failed revocation revoke the certificate in Venafi
+	_, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.RevokeOperation,
+		Storage:   storage,
+		Secret: &logical.Secret{InternalData: map[string]interface{}{
+			"secret_type":   SecretCertsType,
+			"serial_number": serial,
+			"role":          "allow",
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := request("revoke/allow", map[string]interface{}{"certificate_uid": normalizeSerial(serial)}); !resp.IsError() {
+		t.Fatalf("revocation is not supported by the fake connector, got %#v", resp)
+	}
+	if resp := request("sign/revoked", map[string]interface{}{"csr": csrFor("third.example.com")}); resp.IsError() {
+		t.Fatalf("key of the certificate which isn't revoked in Venafi should be allowed, got %#v", resp)
+	}
+
+	routeStoredCertificate(t, b, storage, normalizeSerial(serial), "tpp")
+	if resp := request("revoke/allow", map[string]interface{}{"certificate_uid": normalizeSerial(serial)}); resp.IsError() {
+		t.Fatalf("failed to revoke certificate: %#v", resp)
+	}
+	if resp := request("sign/revoked", map[string]interface{}{"csr": csrFor("second.example.com")}); !resp.IsError() {
+		t.Fatalf("key of revoked certificate should be refused, got %#v", resp)
+	}
+	if resp := request("sign/renew", map[string]interface{}{"csr": csrFor("first.example.com")}); !resp.IsError() {
+		t.Fatalf("key of revoked certificate should be refused for renewals too, got %#v", resp)
+	}
+
+	// sign-verbatim applies the key reuse policy too
+	if resp := request("sign-verbatim/deny", map[string]interface{}{"csr": csrFor("first.example.com")}); !resp.IsError() {
+		t.Fatalf("sign-verbatim should refuse the reused key, got %#v", resp)
+	}
+	if resp := request("sign-verbatim/allow", map[string]interface{}{"csr": csrFor("first.example.com")}); resp.IsError() {
+		t.Fatalf("sign-verbatim should sign the CSR, got %#v", resp)
+	}
+}
+
+func TestKeyReservation(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+	createFakeRole(t, b, storage, "deny", map[string]interface{}{"key_reuse": keyReuseDeny})
+	role, err := b.getRole(ctx, storage, "deny")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawSPKI, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "reserved.example.com"},
+		DNSNames: []string{"reserved.example.com"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func() *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "sign/deny",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"csr": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})),
+			},
+		})
+		return codedErrorResponse(t, resp, err)
+	}
+
+	// another request with the same key is in progress
+	pending := &pendingRequest{ID: "in-progress", Role: "deny"}
+	if err := b.reservePublicKey(ctx, storage, role, pending, "other.example.com", rawSPKI); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.reservePublicKey(ctx, storage, role, &pendingRequest{ID: "concurrent", Role: "deny"},
+		"concurrent.example.com", rawSPKI); err == nil {
+		t.Fatal("reserved key should be refused")
+	}
+	if resp := sign(); !resp.IsError() {
+		t.Fatalf("key reserved by the request in progress should be refused, got %#v", resp)
+	}
+
+	// the request failed, so its key can be used
+	if err := b.releasePublicKey(ctx, storage, pending); err != nil {
+		t.Fatal(err)
+	}
+	resp := sign()
+	if resp.IsError() {
+		t.Fatalf("released key should be allowed, got %#v", resp)
+	}
+	keyEntry, err := b.getPublicKeyEntry(ctx, storage, spkiFingerprint(rawSPKI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyEntry.Certificates) != 1 || keyEntry.Certificates[0].RequestID != "" ||
+		keyEntry.Certificates[0].SerialNumber != resp.Data["serial_number"] {
+		t.Fatalf("reservation should be replaced by the certificate, got %#v", keyEntry.Certificates)
+	}
+	if resp := sign(); !resp.IsError() {
+		t.Fatalf("key of the issued certificate should be refused, got %#v", resp)
+	}
+
+	// the reservation of the request interrupted by Vault going down doesn't count after the rollback
+	keyEntry.Certificates = []publicKeyUse{{
+		CommonName: "interrupted.example.com",
+		Role:       "deny",
+		Issued:     time.Now().Add(-walRollbackMinAge - time.Minute),
+		RequestID:  "interrupted",
+	}}
+	if err := b.putPublicKeyEntry(ctx, storage, spkiFingerprint(rawSPKI), keyEntry); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.checkKeyReuse(ctx, storage, role, "reserved.example.com", keyEntry); err != nil {
+		t.Fatalf("stale reservation should be ignored, got %s", err)
+	}
+	if err := b.storePendingRequest(ctx, storage, &pendingRequest{ID: "interrupted", Role: "deny"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.checkKeyReuse(ctx, storage, role, "reserved.example.com", keyEntry); err == nil {
+		t.Fatal("reservation of the pending request should be kept")
+	}
+}
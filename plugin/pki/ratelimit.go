@@ -0,0 +1,251 @@
+package pki
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/Venafi/vcert/pkg/certificate"
+	"github.com/hashicorp/vault/sdk/logical"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	rateLimitPath = "ratelimit/"
+
+	errorTextRateLimitPerMinute = "role %s allows %d issuances per minute, retry after %s"
+	errorTextRateLimitPerDay    = "role %s allows %d issuances per day, retry after %s"
+	errorTextRateLimitActive    = "role %s allows %d active certificates for %s, retry after %s"
+)
+
+// rateLimitEntry keeps the times of the role issuances for the last day
+type rateLimitEntry struct {
+	Issuances []time.Time `json:"issuances"`
+}
+
+// activeCertificatesEntry keeps the expiration times of the certificates issued for a CN
+type activeCertificatesEntry struct {
+	NotAfter []time.Time `json:"not_after"`
+}
+
+func issuancesPath(roleName string) string {
+	return rateLimitPath + roleName + "/issuances"
+}
+
+func activeCertificatesPath(roleName string, commonName string) string {
+	hash := sha256.Sum256([]byte(strings.ToLower(commonName)))
+	return rateLimitPath + roleName + "/cn/" + hex.EncodeToString(hash[:])
+}
+
+func hasRateLimits(role *roleEntry) bool {
+	return role.MaxIssuancesPerMinute > 0 || role.MaxIssuancesPerDay > 0 || role.MaxActivePerCN > 0
+}
+
+// requestCommonName returns CN of the request, for the user provided CSR it's taken from the CSR
+func requestCommonName(certReq *certificate.Request) string {
+	if certReq.Subject.CommonName != "" || certReq.CsrOrigin != certificate.UserProvidedCSR {
+		return certReq.Subject.CommonName
+	}
+	block, _ := pem.Decode(certReq.GetCSR())
+	if block == nil {
+		return ""
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return ""
+	}
+	return csr.Subject.CommonName
+}
+
+// isRateLimited is true for the error of a request refused by the rate limits of the role
+func isRateLimited(err error) bool {
+	var classified *venafiError
+	return errors.As(err, &classified) && classified.code == errorCodeRateLimited
+}
+
+// rateLimitError returns 429 error with the time when the request can be retried
+func rateLimitError(retryAt time.Time, format string, args ...interface{}) error {
+	retry := fmt.Sprintf("%s (in %s)", retryAt.UTC().Format(time.RFC3339), time.Until(retryAt).Round(time.Second))
+	return venafiErrorf(errorCodeRateLimited, http.StatusTooManyRequests, format, append(args, retry)...)
+}
+
+// reserveIssuance checks the role limits and records the issuance when it's allowed. The returned time of the
+// reservation is zero when the role has no limits.
+func (b *backend) reserveIssuance(ctx context.Context, s logical.Storage, roleName string, role *roleEntry,
+	commonName string) (time.Time, error) {
+
+	if !hasRateLimits(role) {
+		return time.Time{}, nil
+	}
+
+	b.rateLimitLock.Lock()
+	defer b.rateLimitLock.Unlock()
+
+	now := time.Now()
+
+	if role.MaxActivePerCN > 0 && commonName != "" {
+		active, err := b.getActiveCertificates(ctx, s, roleName, commonName, now)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if len(active.NotAfter) >= role.MaxActivePerCN {
+			// the certificates are sorted by the expiration time
+			retryAt := active.NotAfter[len(active.NotAfter)-role.MaxActivePerCN]
+			return time.Time{}, rateLimitError(retryAt, errorTextRateLimitActive, roleName, role.MaxActivePerCN, commonName)
+		}
+	}
+
+	var limits rateLimitEntry
+	entry, err := s.Get(ctx, issuancesPath(roleName))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if entry != nil {
+		if err := entry.DecodeJSON(&limits); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	var lastDay, lastMinute []time.Time
+	for _, issued := range limits.Issuances {
+		if now.Sub(issued) < 24*time.Hour {
+			lastDay = append(lastDay, issued)
+		}
+		if now.Sub(issued) < time.Minute {
+			lastMinute = append(lastMinute, issued)
+		}
+	}
+
+	if role.MaxIssuancesPerMinute > 0 && len(lastMinute) >= role.MaxIssuancesPerMinute {
+		retryAt := lastMinute[len(lastMinute)-role.MaxIssuancesPerMinute].Add(time.Minute)
+		return time.Time{}, rateLimitError(retryAt, errorTextRateLimitPerMinute, roleName, role.MaxIssuancesPerMinute)
+	}
+	if role.MaxIssuancesPerDay > 0 && len(lastDay) >= role.MaxIssuancesPerDay {
+		retryAt := lastDay[len(lastDay)-role.MaxIssuancesPerDay].Add(24 * time.Hour)
+		return time.Time{}, rateLimitError(retryAt, errorTextRateLimitPerDay, roleName, role.MaxIssuancesPerDay)
+	}
+
+	limits.Issuances = append(lastDay, now)
+	entry, err = logical.StorageEntryJSON(issuancesPath(roleName), &limits)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now, s.Put(ctx, entry)
+}
+
+// releaseIssuance removes the reservation of the request which was rejected, so it doesn't count for the limits
+func (b *backend) releaseIssuance(ctx context.Context, s logical.Storage, roleName string, reserved time.Time) error {
+	if reserved.IsZero() {
+		return nil
+	}
+
+	b.rateLimitLock.Lock()
+	defer b.rateLimitLock.Unlock()
+
+	var limits rateLimitEntry
+	entry, err := s.Get(ctx, issuancesPath(roleName))
+	if err != nil || entry == nil {
+		return err
+	}
+	if err := entry.DecodeJSON(&limits); err != nil {
+		return err
+	}
+	for i, issued := range limits.Issuances {
+		if issued.Equal(reserved) {
+			limits.Issuances = append(limits.Issuances[:i], limits.Issuances[i+1:]...)
+			break
+		}
+	}
+
+	entry, err = logical.StorageEntryJSON(issuancesPath(roleName), &limits)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+func (b *backend) getActiveCertificates(ctx context.Context, s logical.Storage, roleName string, commonName string,
+	now time.Time) (*activeCertificatesEntry, error) {
+
+	var stored activeCertificatesEntry
+	entry, err := s.Get(ctx, activeCertificatesPath(roleName, commonName))
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		if err := entry.DecodeJSON(&stored); err != nil {
+			return nil, err
+		}
+	}
+
+	active := &activeCertificatesEntry{}
+	for _, notAfter := range stored.NotAfter {
+		if notAfter.After(now) {
+			active.NotAfter = append(active.NotAfter, notAfter)
+		}
+	}
+	return active, nil
+}
+
+// recordActiveCertificate counts the issued certificate for the max_active_per_cn limit
+func (b *backend) recordActiveCertificate(ctx context.Context, s logical.Storage, roleName string, role *roleEntry,
+	cert *x509.Certificate) error {
+
+	if role.MaxActivePerCN == 0 {
+		return nil
+	}
+
+	b.rateLimitLock.Lock()
+	defer b.rateLimitLock.Unlock()
+
+	active, err := b.getActiveCertificates(ctx, s, roleName, cert.Subject.CommonName, time.Now())
+	if err != nil {
+		return err
+	}
+
+	i := len(active.NotAfter)
+	for i > 0 && active.NotAfter[i-1].After(cert.NotAfter) {
+		i--
+	}
+	active.NotAfter = append(active.NotAfter[:i], append([]time.Time{cert.NotAfter}, active.NotAfter[i:]...)...)
+
+	entry, err := logical.StorageEntryJSON(activeCertificatesPath(roleName, cert.Subject.CommonName), active)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// releaseActiveCertificate stops counting the certificate for the max_active_per_cn limit
+func (b *backend) releaseActiveCertificate(ctx context.Context, s logical.Storage, roleName string,
+	cert *x509.Certificate) error {
+
+	b.rateLimitLock.Lock()
+	defer b.rateLimitLock.Unlock()
+
+	active, err := b.getActiveCertificates(ctx, s, roleName, cert.Subject.CommonName, time.Now())
+	if err != nil {
+		return err
+	}
+	for i, notAfter := range active.NotAfter {
+		if notAfter.Equal(cert.NotAfter) {
+			active.NotAfter = append(active.NotAfter[:i], active.NotAfter[i+1:]...)
+			break
+		}
+	}
+
+	path := activeCertificatesPath(roleName, cert.Subject.CommonName)
+	if len(active.NotAfter) == 0 {
+		return s.Delete(ctx, path)
+	}
+	entry, err := logical.StorageEntryJSON(path, active)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
@@ -0,0 +1,180 @@
+package pki
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestIssuanceRateLimits(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+
+	issue := func(roleName string, commonName string) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "issue/" + roleName,
+			Storage:   storage,
+			Data:      map[string]interface{}{"common_name": commonName},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	issued := func(resp *logical.Response) {
+		t.Helper()
+		if data := failedResponseData(resp); data != nil {
+			t.Fatalf("failed to issue certificate: %#v", data)
+		}
+	}
+
+	expectLimited := func(resp *logical.Response, message string) {
+		t.Helper()
+		data := failedResponseData(resp)
+		if resp.Data[logical.HTTPStatusCode] != http.StatusTooManyRequests || data["error_code"] != errorCodeRateLimited {
+			t.Fatalf("expected 429 error, got %#v", resp.Data)
+		}
+		msg := data["error"].(string)
+		if !strings.Contains(msg, message) || !strings.Contains(msg, "retry after") {
+			t.Fatalf("unexpected error message: %s", msg)
+		}
+	}
+
+	createFakeRole(t, b, storage, "per-minute", map[string]interface{}{"max_issuances_per_minute": 2})
+	for i := 0; i < 2; i++ {
+		issued(issue("per-minute", "minute.example.com"))
+	}
+	expectLimited(issue("per-minute", "other.example.com"), "2 issuances per minute")
+
+	createFakeRole(t, b, storage, "per-day", map[string]interface{}{"max_issuances_per_day": 1})
+	issued(issue("per-day", "day.example.com"))
+	expectLimited(issue("per-day", "day.example.com"), "1 issuances per day")
+
+	createFakeRole(t, b, storage, "per-cn", map[string]interface{}{"max_active_per_cn": 1, "no_store": true})
+	issued(issue("per-cn", "cn.example.com"))
+	issued(issue("per-cn", "other.example.com"))
+	expectLimited(issue("per-cn", "CN.example.com"), "1 active certificates for CN.example.com")
+
+	// limits are kept in the storage, so they hold for a new backend instance
+	restarted, err := Factory(context.Background(), &logical.BackendConfig{
+		Logger:      b.Logger(),
+		System:      logical.TestSystemView(),
+		StorageView: storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := restarted.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "issue/per-day",
+		Storage:   storage,
+		Data:      map[string]interface{}{"common_name": "day.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLimited(resp, "1 issuances per day")
+}
+
+func TestDeleteReleasesActiveCertificate(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	createFakeRole(t, b, storage, "delete", map[string]interface{}{
+		"max_active_per_cn": 1,
+		"store_by":          "serial",
+		"store_pkey":        true,
+	})
+
+	issue := func() (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "issue/delete",
+			Storage:   storage,
+			Data:      map[string]interface{}{"common_name": "delete.example.com"},
+		})
+	}
+	resp, err := issue()
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to issue certificate: err: %v resp: %#v", err, resp)
+	}
+	if resp, err := issue(); !codedErrorResponse(t, resp, err).IsError() {
+		t.Fatal("second certificate of the CN should be limited")
+	}
+
+	serial := normalizeSerial(resp.Data["serial_number"].(string))
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "cert/" + serial,
+		Storage:   storage,
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to delete certificate: err: %v resp: %#v", err, resp)
+	}
+
+	keys, err := storage.List(context.Background(), fingerprintsPath)
+	if err != nil || len(keys) != 0 {
+		t.Fatalf("fingerprint of the deleted certificate should be removed, got %v %v", keys, err)
+	}
+	// the public key stays indexed, deleting the certificate doesn't allow reusing its key
+	for _, prefix := range []string{publicKeysPath, publicKeySerialPath} {
+		keys, err := storage.List(context.Background(), prefix)
+		if err != nil || len(keys) != 1 {
+			t.Fatalf("%s entry of the deleted certificate should be kept, got %v %v", prefix, keys, err)
+		}
+	}
+	if resp, err := issue(); err != nil || resp.IsError() {
+		t.Fatalf("deleted certificate should not count as active: err: %v resp: %#v", err, resp)
+	}
+}
+
+func TestRejectedIssuanceReleased(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	createFakeRole(t, b, storage, "rejected", map[string]interface{}{
+		"max_issuances_per_minute": 1,
+		"max_active_per_cn":        1,
+		"store_by":                 "serial",
+	})
+	tppServer, _ := createRevokingRole(t, b, storage, "tpp")
+	defer tppServer.Close()
+
+	issue := func(commonName string) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "issue/rejected",
+			Storage:   storage,
+			Data:      map[string]interface{}{"common_name": commonName},
+		})
+	}
+
+	// the fake connector rejects venafi.com certificates
+	if resp, err := issue("rejected.venafi.com"); !codedErrorResponse(t, resp, err).IsError() {
+		t.Fatal("request should be rejected")
+	}
+	resp, err := issue("rejected.example.com")
+	if err != nil || resp.IsError() {
+		t.Fatalf("rejected request should not count for the limits: err: %v resp: %#v", err, resp)
+	}
+
+	// the revoked certificate isn't active anymore
+	serial := normalizeSerial(resp.Data["serial_number"].(string))
+	routeStoredCertificate(t, b, storage, serial, "tpp")
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "revoke/rejected",
+		Storage:   storage,
+		Data:      map[string]interface{}{"certificate_uid": serial},
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to revoke certificate: err: %v resp: %#v", err, resp)
+	}
+	active, err := b.getActiveCertificates(context.Background(), storage, "rejected", "rejected.example.com", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active.NotAfter) != 0 {
+		t.Fatalf("revoked certificate should not count as active, got %v", active.NotAfter)
+	}
+}
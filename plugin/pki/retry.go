@@ -0,0 +1,181 @@
+package pki
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Venafi/vcert/pkg/verror"
+	"github.com/hashicorp/vault/sdk/logical"
+	"math/rand"
+	"regexp"
+	"time"
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+
+	errorTextCircuitOpen = "%w: %d consecutive requests with venafi secret %s failed, " +
+		"last error: %s. Retry after %s"
+)
+
+// retry and circuit breaker settings, variables so tests can shorten them
+var (
+	venafiRetryAttempts     = 3
+	venafiRetryBaseDelay    = 500 * time.Millisecond
+	venafiRetryMaxDelay     = 5 * time.Second
+	circuitFailureThreshold = 5
+	circuitOpenDuration     = 30 * time.Second
+)
+
+// statusCodeRegex finds HTTP status in vcert errors like "Unexpected status code on TPP Certificate Retrieval. Status: 503 Service Unavailable"
+var statusCodeRegex = regexp.MustCompile(`(?is)status\D{0,10}(\d{3})`)
+
+// circuitBreaker counts consecutive transient failures of the Venafi endpoint of a venafi secret
+type circuitBreaker struct {
+	failures  int
+	lastError string
+	openUntil time.Time
+}
+
+// isTransientVenafiError returns true for errors which may go away on retry: connection problems,
+// temporary unavailability of the server and 429, 502, 503, 504 responses
+func isTransientVenafiError(err error) bool {
+	if err == nil || isTLSTrustError(err) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if isConnectionError(err) || errors.Is(err, verror.ServerUnavailableError) {
+		return true
+	}
+	match := statusCodeRegex.FindStringSubmatch(err.Error())
+	if match == nil {
+		return false
+	}
+	switch match[1] {
+	case "429", "502", "503", "504":
+		return true
+	}
+	return false
+}
+
+// retryDelay is exponential backoff with full jitter
+func retryDelay(attempt int) time.Duration {
+	delay := venafiRetryBaseDelay << uint(attempt-1)
+	if delay > venafiRetryMaxDelay || delay <= 0 {
+		delay = venafiRetryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
+
+// callVenafi runs the call to the Venafi endpoint of the secret through the circuit breaker.
+// Idempotent calls are retried on transient errors.
+func (b *backend) callVenafi(ctx context.Context, secretName string, operation string, idempotent bool, call func() error) error {
+	attempts := 1
+	if idempotent {
+		attempts = venafiRetryAttempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := b.checkCircuit(secretName); err != nil {
+			return err
+		}
+
+		err := call()
+		if errors.Is(err, logical.ErrReadOnly) {
+			// the request is forwarded to the primary, Venafi wasn't called
+			return err
+		}
+		b.recordVenafiResult(secretName, err)
+		b.recordSecretHealth(secretName, err)
+		if err == nil || attempt >= attempts || !isTransientVenafiError(err) {
+			return err
+		}
+
+		delay := retryDelay(attempt)
+		b.Logger().Warn(fmt.Sprintf("%s failed (attempt %d of %d), retrying in %s: %s", operation, attempt, attempts, delay, err))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (b *backend) checkCircuit(secretName string) error {
+	b.circuitLock.Lock()
+	defer b.circuitLock.Unlock()
+
+	breaker, ok := b.circuits[secretName]
+	if ok && time.Now().Before(breaker.openUntil) {
+		return fmt.Errorf(errorTextCircuitOpen, errVenafiUnavailable, breaker.failures, secretName, breaker.lastError,
+			breaker.openUntil.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (b *backend) recordVenafiResult(secretName string, err error) {
+	b.circuitLock.Lock()
+	defer b.circuitLock.Unlock()
+
+	if !isTransientVenafiError(err) {
+		// any answer of the server means the endpoint is available
+		delete(b.circuits, secretName)
+		return
+	}
+
+	if b.circuits == nil {
+		b.circuits = make(map[string]*circuitBreaker)
+	}
+	breaker, ok := b.circuits[secretName]
+	if !ok {
+		breaker = &circuitBreaker{}
+		b.circuits[secretName] = breaker
+	}
+	breaker.failures++
+	breaker.lastError = err.Error()
+	if breaker.failures >= circuitFailureThreshold {
+		breaker.openUntil = time.Now().Add(circuitOpenDuration)
+		b.Logger().Error(fmt.Sprintf("Venafi endpoint of venafi secret %s is unavailable, failing requests until %s",
+			secretName, breaker.openUntil.UTC().Format(time.RFC3339)))
+	}
+}
+
+// resetCircuit forgets the failures, e.g. when the venafi secret is changed
+func (b *backend) resetCircuit(secretName string) {
+	b.circuitLock.Lock()
+	defer b.circuitLock.Unlock()
+	delete(b.circuits, secretName)
+}
+
+// circuitStatus is the circuit breaker state shown on the venafi secret read
+func (b *backend) circuitStatus(secretName string) map[string]interface{} {
+	b.circuitLock.Lock()
+	defer b.circuitLock.Unlock()
+
+	breaker, ok := b.circuits[secretName]
+	if !ok {
+		return map[string]interface{}{
+			"state":                circuitClosed,
+			"consecutive_failures": 0,
+		}
+	}
+
+	status := map[string]interface{}{
+		"state":                circuitClosed,
+		"consecutive_failures": breaker.failures,
+		"last_error":           breaker.lastError,
+	}
+	if breaker.failures >= circuitFailureThreshold {
+		if time.Now().Before(breaker.openUntil) {
+			status["state"] = circuitOpen
+			status["open_until"] = breaker.openUntil.UTC().Format(time.RFC3339)
+		} else {
+			status["state"] = circuitHalfOpen
+		}
+	}
+	return status
+}
@@ -0,0 +1,118 @@
+package pki
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Venafi/vcert/pkg/endpoint"
+	"github.com/Venafi/vcert/pkg/verror"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestIsTransientVenafiError(t *testing.T) {
+	cases := []struct {
+		err       error
+		transient bool
+	}{
+		{nil, false},
+		{&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, true},
+		{fmt.Errorf("%w: unexpected response status 500", verror.ServerTemporaryUnavailableError), true},
+		{errors.New("Unexpected status code on TPP Certificate Retrieval. Status: 503 Service Unavailable"), true},
+		{errors.New("Unexpected status code on TPP Certificate Request.\n Status:\n 502 Bad Gateway. \n Body:\n \n"), true},
+		{errors.New("Unexpected status code on TPP Certificate Request.\n Status:\n 400 Bad Request. \n Body:\n \n"), false},
+		{fmt.Errorf("%w: wrong password", verror.AuthError), false},
+		{endpoint.ErrCertificatePending{CertificateID: "id"}, false},
+		{context.Canceled, false},
+	}
+	for _, c := range cases {
+		if isTransientVenafiError(c.err) != c.transient {
+			t.Errorf("expected transient %v for error %v", c.transient, c.err)
+		}
+	}
+}
+
+func TestCallVenafiRetryAndCircuitBreaker(t *testing.T) {
+	venafiRetryBaseDelay = time.Millisecond
+	defer func() { venafiRetryBaseDelay = 500 * time.Millisecond }()
+
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+	unavailable := errors.New("Unexpected status code on TPP Certificate Retrieval. Status: 503 Service Unavailable")
+
+	calls := 0
+	err := b.callVenafi(ctx, "secret", "retrieve certificate", true, func() error {
+		calls++
+		if calls < venafiRetryAttempts {
+			return unavailable
+		}
+		return nil
+	})
+	if err != nil || calls != venafiRetryAttempts {
+		t.Fatalf("transient error should be retried, got %d calls and error %v", calls, err)
+	}
+
+	calls = 0
+	err = b.callVenafi(ctx, "secret", "request certificate", false, func() error {
+		calls++
+		return unavailable
+	})
+	if err != unavailable || calls != 1 {
+		t.Fatalf("not idempotent call should not be retried, got %d calls", calls)
+	}
+
+	calls = 0
+	err = b.callVenafi(ctx, "secret", "retrieve certificate", true, func() error {
+		calls++
+		return fmt.Errorf("%w: wrong password", verror.AuthError)
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("permanent error should not be retried, got %d calls", calls)
+	}
+
+	for i := 0; i < circuitFailureThreshold; i++ {
+		_ = b.callVenafi(ctx, "secret", "request certificate", false, func() error {
+			return unavailable
+		})
+	}
+
+	calls = 0
+	err = b.callVenafi(ctx, "secret", "retrieve certificate", true, func() error {
+		calls++
+		return nil
+	})
+	if err == nil || calls != 0 || !strings.Contains(err.Error(), "Venafi endpoint unavailable") {
+		t.Fatalf("open circuit should fail fast, got %d calls and error %v", calls, err)
+	}
+
+	readStatus := func() map[string]interface{} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "venafi/secret",
+			Storage:   storage,
+		})
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("failed to read venafi secret: err: %v resp: %#v", err, resp)
+		}
+		return resp.Data["circuit_breaker"].(map[string]interface{})
+	}
+
+	createFakeRole(t, b, storage, "secret", nil)
+	b.recordVenafiResult("secret", unavailable)
+	status := readStatus()
+	if status["state"] != circuitClosed || status["consecutive_failures"] != 1 {
+		t.Fatalf("circuit breaker should be reset when the secret is written, got %#v", status)
+	}
+
+	for i := 1; i < circuitFailureThreshold; i++ {
+		b.recordVenafiResult("secret", unavailable)
+	}
+	status = readStatus()
+	if status["state"] != circuitOpen || status["last_error"] != unavailable.Error() || status["open_until"] == nil {
+		t.Fatalf("circuit breaker should be open, got %#v", status)
+	}
+}
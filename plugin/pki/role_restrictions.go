@@ -0,0 +1,197 @@
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// nameAllowed tells whether the DNS name or the domain of the email address is allowed by allowed_domains of the
+// role. Any name is allowed when allowed_domains is empty.
+func nameAllowed(role *roleEntry, name string) bool {
+	if len(role.AllowedDomains) == 0 {
+		return true
+	}
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	for _, domain := range role.AllowedDomains {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if name == domain {
+			return true
+		}
+		if role.AllowSubdomains && strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+		if role.AllowGlobDomains && strings.Contains(domain, "*") {
+			if matched, _ := path.Match(domain, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkAllowedNames verifies the common name and DNS and email SANs against allowed_domains of the role. IP
+// addresses aren't restricted.
+func checkAllowedNames(role *roleEntry, names ...string) error {
+	for _, name := range names {
+		if name == "" || net.ParseIP(name) != nil {
+			continue
+		}
+		if !nameAllowed(role, name) {
+			return fmt.Errorf(errorTextNameNotAllowed, name)
+		}
+	}
+	return nil
+}
+
+func subjectValuesAllowed(allowed []string, values []string) (string, bool) {
+	if len(allowed) == 0 {
+		return "", true
+	}
+	for _, v := range values {
+		if !sliceContains(allowed, v) {
+			return v, false
+		}
+	}
+	return "", true
+}
+
+// checkCSRRestrictions applies the domain and subject restrictions of the role to the CSR submitted to sign
+func checkCSRRestrictions(csr *x509.CertificateRequest, role *roleEntry) error {
+	names := append([]string{csr.Subject.CommonName}, csr.DNSNames...)
+	names = append(names, csr.EmailAddresses...)
+	if err := checkAllowedNames(role, names...); err != nil {
+		return err
+	}
+
+	if v, ok := subjectValuesAllowed(role.AllowedOrganizations, csr.Subject.Organization); !ok {
+		return fmt.Errorf(errorTextSubjectNotAllowed, "organization", v)
+	}
+	if v, ok := subjectValuesAllowed(role.AllowedOUs, csr.Subject.OrganizationalUnit); !ok {
+		return fmt.Errorf(errorTextSubjectNotAllowed, "organizational unit", v)
+	}
+	return nil
+}
+
+// csrKeyType is the key type of the CSR public key in the terms of key_type of the role
+func csrKeyType(csr *x509.CertificateRequest) string {
+	switch csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "rsa"
+	case *ecdsa.PublicKey:
+		return "ec"
+	case ed25519.PublicKey:
+		return "ed25519"
+	}
+	return "unknown"
+}
+
+// checkCSRKeyType verifies that the key of the CSR is of key_type of the role, any type is allowed with "any"
+func checkCSRKeyType(csr *x509.CertificateRequest, role *roleEntry) error {
+	if role.KeyType == "any" {
+		return nil
+	}
+	if keyType := csrKeyType(csr); keyType != role.KeyType {
+		return fmt.Errorf(errorTextCSRKeyType, keyType, role.KeyType)
+	}
+	return nil
+}
+
+// defaultKeyCurves are the curves allowed in CSRs when allowed_key_curves of the role is empty
+var defaultKeyCurves = []string{"P256", "P384", "P521"}
+
+// curveName is the name of the curve in the terms of key_curve of the role, e.g. "P256"
+func curveName(curve elliptic.Curve) string {
+	return strings.Replace(curve.Params().Name, "-", "", 1)
+}
+
+// checkCSRKeyParams verifies the key size of RSA keys against key_bits of the role and the curve of EC keys against
+// allowed_key_curves. It applies to the role key type "any" too.
+func checkCSRKeyParams(csr *x509.CertificateRequest, role *roleEntry) error {
+	switch key := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if bits := key.N.BitLen(); bits < role.KeyBits {
+			return fmt.Errorf(errorTextCSRKeyBits, bits, role.KeyBits)
+		}
+	case *ecdsa.PublicKey:
+		curves := role.AllowedKeyCurves
+		if len(curves) == 0 {
+			curves = defaultKeyCurves
+		}
+		if curve := curveName(key.Curve); !sliceContains(curves, curve) {
+			return fmt.Errorf(errorTextCSRKeyCurve, curve, strings.Join(curves, ", "))
+		}
+	}
+	return nil
+}
+
+// checkCSRSignature verifies the signature of the CSR and, if required by the role, that it's made with SHA-256 or a
+// stronger hash
+func checkCSRSignature(csr *x509.CertificateRequest, role *roleEntry) error {
+	if err := csr.CheckSignature(); err != nil {
+		return fmt.Errorf(errorTextCSRSignature, err)
+	}
+	if !role.RequireSHA256CSR {
+		return nil
+	}
+	switch csr.SignatureAlgorithm {
+	case x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA,
+		x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS,
+		x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512, x509.PureEd25519:
+		return nil
+	}
+	return fmt.Errorf(errorTextCSRSignatureHash, csr.SignatureAlgorithm)
+}
+
+func validateKeyCurves(curves []string) error {
+	for _, curve := range curves {
+		if !sliceContains(defaultKeyCurves, curve) {
+			return fmt.Errorf(errorTextInvalidKeyCurve, curve)
+		}
+	}
+	return nil
+}
+
+// containsCATemplate checks if the CA template is in the list, DNs of TPP are case insensitive
+func containsCATemplate(caTemplates []string, caTemplate string) bool {
+	for _, t := range caTemplates {
+		if strings.EqualFold(caTemplate, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectCATemplate returns the CA template of the request, ca_template of the role if none is requested
+func selectCATemplate(role *roleEntry, requested string) (string, error) {
+	if requested == "" {
+		return role.CATemplate, nil
+	}
+	if !strings.EqualFold(requested, role.CATemplate) && !containsCATemplate(role.AllowedCATemplates, requested) {
+		return "", fmt.Errorf(errorTextCATemplateNotAllowed, requested)
+	}
+	return requested, nil
+}
+
+const (
+	errorTextNameNotAllowed    = "name %s is not allowed by allowed_domains of the role"
+	errorTextSubjectNotAllowed = "%s %s of the CSR is not allowed by the role"
+	errorTextCSRKeyType        = "key type %s of the CSR doesn't match key_type %s of the role"
+	errorTextCSRKeyBits        = "RSA key of the CSR has %d bits, key_bits of the role requires at least %d"
+	errorTextCSRKeyCurve       = "curve %s of the CSR key is not allowed, allowed curves are %s"
+	errorTextCSRSignature      = "invalid CSR signature: %v"
+	errorTextCSRSignatureHash  = "CSR signature algorithm %s is not allowed, SHA-256 or stronger is required"
+	errorTextInvalidKeyCurve   = `invalid curve %q in allowed_key_curves, valid values are "P256", "P384" and "P521"`
+
+	errorTextCATemplateNotAllowed = "CA template %s is not allowed by allowed_ca_templates of the role"
+)
@@ -0,0 +1,240 @@
+package pki
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRoleRestrictions(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+	createFakeRole(t, b, storage, "restricted", map[string]interface{}{
+		"allowed_domains":       "example.com",
+		"allow_subdomains":      true,
+		"allowed_organizations": "Example Inc",
+	})
+	createFakeRole(t, b, storage, "glob", map[string]interface{}{
+		"allowed_domains":    "web-*.example.com",
+		"allow_glob_domains": true,
+	})
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		return codedErrorResponse(t, resp, err)
+	}
+
+	for _, c := range []struct {
+		path    string
+		cn      string
+		allowed bool
+	}{
+		{"issue/restricted", "example.com", true},
+		{"issue/restricted", "www.example.com", true},
+		{"issue/restricted", "*.example.com", true},
+		{"issue/restricted", "www.example.org", false},
+		{"issue/restricted", "badexample.com", false},
+		{"issue/glob", "web-1.example.com", true},
+		{"issue/glob", "api.example.com", false},
+	} {
+		resp := request(c.path, map[string]interface{}{"common_name": c.cn})
+		if resp.IsError() == c.allowed {
+			t.Fatalf("%s of %s: expected allowed %t, got %#v", c.path, c.cn, c.allowed, resp)
+		}
+	}
+
+	if resp := request("issue/restricted", map[string]interface{}{
+		"common_name": "www.example.com",
+		"alt_names":   "www.example.org",
+	}); !resp.IsError() {
+		t.Fatalf("SAN outside of allowed domains should be refused, got %#v", resp)
+	}
+
+	foreign := createTestCSR(t, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "www.example.org", Organization: []string{"Example Inc"}},
+		DNSNames: []string{"www.example.org"},
+	})
+	if resp := request("sign/restricted", map[string]interface{}{"csr": foreign}); !resp.IsError() {
+		t.Fatalf("CSR outside of allowed domains should be refused, got %#v", resp)
+	}
+	if resp := request("sign-verbatim/restricted", map[string]interface{}{"csr": foreign}); resp.IsError() {
+		t.Fatalf("sign-verbatim shouldn't apply allowed domains, got %#v", resp)
+	}
+
+	otherOrg := createTestCSR(t, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "www.example.com", Organization: []string{"Other Inc"}},
+		DNSNames: []string{"www.example.com"},
+	})
+	if resp := request("sign/restricted", map[string]interface{}{"csr": otherOrg}); !resp.IsError() {
+		t.Fatalf("organization which isn't allowed should be refused, got %#v", resp)
+	}
+
+	// the key type of the role is checked by sign-verbatim too
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "www.example.com"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecCSR := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+	if resp := request("sign-verbatim/restricted", map[string]interface{}{"csr": ecCSR}); !resp.IsError() {
+		t.Fatalf("EC key should be refused by rsa role, got %#v", resp)
+	}
+	createFakeRole(t, b, storage, "any", map[string]interface{}{"key_type": "any"})
+	if resp := request("sign-verbatim/any", map[string]interface{}{"csr": ecCSR}); resp.IsError() {
+		t.Fatalf("any key type should be accepted, got %#v", resp)
+	}
+}
+
+func TestCSRKeyParams(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+	createFakeRole(t, b, storage, "any", map[string]interface{}{"key_type": "any"})
+	createFakeRole(t, b, storage, "p384", map[string]interface{}{"key_type": "ec", "allowed_key_curves": "P384"})
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/invalid",
+		Storage:   storage,
+		Data:      map[string]interface{}{"venafi_secret": "any", "allowed_key_curves": "P224"},
+	})
+	if err != nil || !resp.IsError() {
+		t.Fatalf("P224 should be refused in allowed_key_curves: err: %v resp: %#v", err, resp)
+	}
+
+	csrDER := func(key interface{}) []byte {
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: "keys.example.com"},
+		}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+	sign := func(role string, der []byte) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "sign/" + role,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"csr": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})),
+			},
+		})
+		return codedErrorResponse(t, resp, err)
+	}
+
+	weakRSA, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := sign("any", csrDER(weakRSA)); !resp.IsError() {
+		t.Fatalf("RSA key shorter than key_bits should be refused, got %#v", resp)
+	}
+
+	for _, c := range []struct {
+		role    string
+		curve   elliptic.Curve
+		allowed bool
+	}{
+		{"any", elliptic.P224(), false},
+		{"any", elliptic.P256(), true},
+		{"p384", elliptic.P256(), false},
+		{"p384", elliptic.P384(), true},
+	} {
+		key, err := ecdsa.GenerateKey(c.curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp := sign(c.role, csrDER(key)); resp.IsError() == c.allowed {
+			t.Fatalf("role %s, curve %s: expected allowed %t, got %#v", c.role, c.curve.Params().Name, c.allowed, resp)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der := csrDER(key)
+	der[len(der)-1] ^= 0xff
+	if resp := sign("any", der); !resp.IsError() {
+		t.Fatalf("CSR with invalid signature should be refused, got %#v", resp)
+	}
+}
+
+func TestCATemplate(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+	defaultCA := `\VED\Policy\Certificate Authorities\Issuing CA`
+	otherCA := `\VED\Policy\Certificate Authorities\Client CA`
+	createFakeRole(t, b, storage, "ca", map[string]interface{}{
+		"ca_template":          defaultCA,
+		"allowed_ca_templates": otherCA,
+	})
+
+	request := func(operation logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: operation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		return codedErrorResponse(t, resp, err)
+	}
+
+	resp := request(logical.ReadOperation, "roles/ca", nil)
+	if resp.Data["ca_template"] != defaultCA {
+		t.Fatalf("expected ca_template %s in the role, got %v", defaultCA, resp.Data["ca_template"])
+	}
+
+	issued := func(data map[string]interface{}) string {
+		resp := request(logical.UpdateOperation, "issue/ca", data)
+		if resp.IsError() {
+			t.Fatalf("failed to issue certificate: %#v", resp)
+		}
+		resp = request(logical.ReadOperation, "cert/"+normalizeSerial(resp.Data["serial_number"].(string)), nil)
+		return resp.Data["ca_template"].(string)
+	}
+	if ca := issued(map[string]interface{}{"common_name": "default.example.com"}); ca != defaultCA {
+		t.Fatalf("expected CA template %s, got %s", defaultCA, ca)
+	}
+	if ca := issued(map[string]interface{}{"common_name": "other.example.com", "ca_template": otherCA}); ca != otherCA {
+		t.Fatalf("expected CA template %s, got %s", otherCA, ca)
+	}
+
+	resp = request(logical.UpdateOperation, "issue/ca", map[string]interface{}{
+		"common_name": "denied.example.com",
+		"ca_template": `\VED\Policy\Certificate Authorities\Other CA`,
+	})
+	if !resp.IsError() {
+		t.Fatalf("CA template which isn't allowed should be refused, got %#v", resp)
+	}
+
+	role, err := b.getRole(ctx, storage, "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certReq, err := formRequest(requestData{commonName: "other.example.com", caTemplate: otherCA}, role, false, b.Logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certReq.CADN != otherCA {
+		t.Fatalf("expected CADN %s, got %s", otherCA, certReq.CADN)
+	}
+}
@@ -0,0 +1,143 @@
+package pki
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Modes of checking the names requested with sign against the names of the CSR. Venafi issues the certificate with
+// the names of the CSR as it was submitted: vcert sends only the PKCS#10 of a user provided CSR, and the CSR can't be
+// changed without the key of the requester. So requested names can't be added to the CSR or replace its names, and
+// roles with the "override" mode are refused instead of ignoring the requested names.
+const (
+	signCSRNamesEnforce  = "enforce"
+	signCSRNamesStrict   = "strict"
+	signCSRNamesCSR      = "csr"
+	signCSRNamesOverride = "override"
+)
+
+// csrNames are the names of a CSR, DNS names and email addresses are lowercase
+type csrNames struct {
+	commonName string
+	dns        map[string]bool
+	emails     map[string]bool
+	ips        map[string]bool
+	uris       map[string]bool
+}
+
+func newCSRNames(csr *x509.CertificateRequest) *csrNames {
+	names := &csrNames{
+		commonName: strings.ToLower(csr.Subject.CommonName),
+		dns:        make(map[string]bool),
+		emails:     make(map[string]bool),
+		ips:        make(map[string]bool),
+		uris:       make(map[string]bool),
+	}
+	for _, v := range csr.DNSNames {
+		names.dns[strings.ToLower(v)] = true
+	}
+	for _, v := range csr.EmailAddresses {
+		names.emails[strings.ToLower(v)] = true
+	}
+	for _, v := range csr.IPAddresses {
+		names.ips[v.String()] = true
+	}
+	for _, v := range csr.URIs {
+		names.uris[v.String()] = true
+	}
+	return names
+}
+
+// set returns the SAN set an alt name belongs to and its normalized form
+func (n *csrNames) set(altName string) (map[string]bool, string) {
+	if ip := net.ParseIP(altName); ip != nil {
+		return n.ips, ip.String()
+	}
+	if strings.Contains(altName, "@") {
+		return n.emails, strings.ToLower(altName)
+	}
+	return n.dns, strings.ToLower(altName)
+}
+
+// checkCSRNames verifies that the names requested with sign are in the CSR. In strict mode the CSR can't contain
+// names which weren't requested, the common name is allowed in the SANs unless exclude_cn_from_sans is set.
+func checkCSRNames(csr *x509.CertificateRequest, reqData requestData, mode string) error {
+	if mode == signCSRNamesCSR {
+		return nil
+	}
+
+	names := newCSRNames(csr)
+	requested := newCSRNames(&x509.CertificateRequest{})
+
+	commonName := strings.ToLower(reqData.commonName)
+	if commonName != "" {
+		set, name := names.set(commonName)
+		if commonName != names.commonName && (names.commonName != "" || !set[name]) {
+			return fmt.Errorf(errorTextCSRNameMissing, "common name", reqData.commonName)
+		}
+		if !reqData.excludeCNFromSANs {
+			set, name := requested.set(commonName)
+			set[name] = true
+		}
+	}
+	for _, v := range reqData.altNames {
+		set, name := names.set(v)
+		if !set[name] {
+			return fmt.Errorf(errorTextCSRNameMissing, "alt name", v)
+		}
+		set, name = requested.set(v)
+		set[name] = true
+	}
+	for _, v := range reqData.ipSANs {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return fmt.Errorf(errorTextInvalidIPSAN, v)
+		}
+		if !names.ips[ip.String()] {
+			return fmt.Errorf(errorTextCSRNameMissing, "IP SAN", v)
+		}
+		requested.ips[ip.String()] = true
+	}
+	for _, v := range reqData.uriSANs {
+		if !names.uris[v] {
+			return fmt.Errorf(errorTextCSRNameMissing, "URI SAN", v)
+		}
+		requested.uris[v] = true
+	}
+
+	if mode != signCSRNamesStrict {
+		return nil
+	}
+	if names.commonName != commonName {
+		return fmt.Errorf(errorTextCSRNameNotRequested, "common name", names.commonName)
+	}
+	for _, set := range []struct {
+		kind      string
+		csr       map[string]bool
+		requested map[string]bool
+	}{
+		{"DNS SAN", names.dns, requested.dns},
+		{"email SAN", names.emails, requested.emails},
+		{"IP SAN", names.ips, requested.ips},
+		{"URI SAN", names.uris, requested.uris},
+	} {
+		for name := range set.csr {
+			if !set.requested[name] {
+				return fmt.Errorf(errorTextCSRNameNotRequested, set.kind, name)
+			}
+		}
+	}
+	return nil
+}
+
+const (
+	errorTextCSRNameMissing      = "requested %s %s is not in the CSR, names of the CSR can't be changed"
+	errorTextCSRNameNotRequested = "%s %s of the CSR is not requested"
+	errorTextInvalidIPSAN        = "invalid IP SAN %s"
+	errorTextInvalidSignCSRNames = `invalid sign_csr_names %q, valid values are "enforce", "strict" and "csr"`
+
+	errorTextSignCSRNamesOverride = `sign_csr_names "override" is not supported, the certificate is issued with the ` +
+		`names of the CSR and they can't be changed without the key of the requester`
+)
@@ -0,0 +1,119 @@
+package pki
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func createTestCSR(t *testing.T, template *x509.CertificateRequest) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}))
+}
+
+func TestSignCSRNames(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+	createFakeRole(t, b, storage, "enforce", map[string]interface{}{"generate_lease": true})
+	createFakeRole(t, b, storage, "strict", map[string]interface{}{"sign_csr_names": signCSRNamesStrict})
+	createFakeRole(t, b, storage, "csr", map[string]interface{}{"sign_csr_names": signCSRNamesCSR})
+
+	// the names of the CSR can't be changed, so the override mode is refused instead of ignoring the requested names
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/override",
+		Storage:   storage,
+		Data:      map[string]interface{}{"venafi_secret": "override", "sign_csr_names": signCSRNamesOverride},
+	})
+	if err != nil || resp == nil || !resp.IsError() || resp.Data["error"] != errorTextSignCSRNamesOverride {
+		t.Fatalf("override mode should be refused: err: %v resp: %#v", err, resp)
+	}
+
+	spiffe, _ := url.Parse("spiffe://cluster.local/ns/default/sa/app")
+	csr := createTestCSR(t, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: "app.example.com"},
+		DNSNames:    []string{"app.example.com", "app.default.svc"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+		URIs:        []*url.URL{spiffe},
+	})
+
+	sign := func(role string, data map[string]interface{}) *logical.Response {
+		data["csr"] = csr
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "sign/" + role,
+			Storage:   storage,
+			Data:      data,
+		})
+		return codedErrorResponse(t, resp, err)
+	}
+
+	// parameters sent by cert-manager
+	certManager := func() map[string]interface{} {
+		return map[string]interface{}{
+			"common_name":          "app.example.com",
+			"alt_names":            "app.example.com,app.default.svc",
+			"ip_sans":              "10.0.0.1",
+			"uri_sans":             spiffe.String(),
+			"ttl":                  "1h",
+			"exclude_cn_from_sans": "true",
+		}
+	}
+
+	resp = sign("enforce", certManager())
+	if resp.IsError() {
+		t.Fatalf("failed to sign certificate: %#v", resp)
+	}
+	caCerts := resp.Data["ca_chain"].([]string)
+	if resp.Data["certificate"] == "" || len(caCerts) == 0 || resp.Data["issuing_ca"] != caCerts[0] {
+		t.Fatalf("expected certificate, ca_chain and issuing_ca, got %#v", resp.Data)
+	}
+	if resp.Secret == nil || resp.Secret.TTL != time.Hour {
+		t.Fatalf("expected lease of one hour, got %#v", resp.Secret)
+	}
+
+	data := certManager()
+	data["alt_names"] = "other.example.com"
+	if resp := sign("enforce", data); !resp.IsError() {
+		t.Fatalf("name missing in the CSR should be refused, got %#v", resp)
+	}
+	data = certManager()
+	data["common_name"] = "other.example.com"
+	if resp := sign("enforce", data); !resp.IsError() {
+		t.Fatalf("common name different from the CSR should be refused, got %#v", resp)
+	}
+
+	if resp := sign("strict", certManager()); resp.IsError() {
+		t.Fatalf("failed to sign certificate: %#v", resp)
+	}
+	data = certManager()
+	data["ip_sans"] = ""
+	if resp := sign("strict", data); !resp.IsError() {
+		t.Fatalf("IP SAN of the CSR which isn't requested should be refused, got %#v", resp)
+	}
+	if resp := sign("enforce", data); resp.IsError() {
+		t.Fatalf("subset of the CSR names should be accepted, got %#v", resp)
+	}
+
+	data = certManager()
+	data["alt_names"] = "other.example.com"
+	if resp := sign("csr", data); resp.IsError() {
+		t.Fatalf("requested names should be ignored, got %#v", resp)
+	}
+}
@@ -5,13 +5,16 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"github.com/Venafi/vcert"
 	"github.com/Venafi/vcert/pkg/endpoint"
 	"github.com/Venafi/vcert/pkg/venafi/tpp"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/logical"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"sort"
 	"strconv"
@@ -206,24 +209,36 @@ func getTppConnector(cfg *vcert.Config) (*tpp.Connector, error) {
 	return tppConnector, nil
 }
 
-func updateAccessToken(cfg *vcert.Config, b *backend, ctx context.Context, req *logical.Request, roleName string) error {
+func updateAccessToken(cfg *vcert.Config, b *backend, ctx context.Context, req *logical.Request, secretName string) error {
 	tppConnector, _ := getTppConnector(cfg)
 
-	httpClient, err := getHTTPClient(cfg.ConnectionTrust)
-	if err != nil {
-		return err
+	httpClient := cfg.Client
+	if httpClient == nil {
+		var err error
+		httpClient, err = getHTTPClient(httpClientSettings{trustBundlePEM: cfg.ConnectionTrust})
+		if err != nil {
+			return err
+		}
 	}
 
 	tppConnector.SetHTTPClient(httpClient)
 
-	resp, err := tppConnector.RefreshAccessToken(&endpoint.Authentication{
-		RefreshToken: cfg.Credentials.RefreshToken,
-		ClientId:     "hashicorp-vault-by-venafi",
-		Scope:        "certificate:manage,revoke",
-	})
+	var resp tpp.OauthRefreshAccessTokenResponse
+	var err error
+	if cfg.Credentials.RefreshToken != "" {
+		resp, err = tppConnector.RefreshAccessToken(&endpoint.Authentication{
+			RefreshToken: cfg.Credentials.RefreshToken,
+			ClientId:     "hashicorp-vault-by-venafi",
+			Scope:        "certificate:manage,revoke",
+		})
+	}
+	if resp.Access_token == "" && cfg.Credentials.ClientPKCS12 {
+		//refresh token is missing or no longer valid, request a new token pair using the client certificate
+		resp, err = getAccessTokenByCertificate(tppConnector)
+	}
 	if resp.Access_token != "" && resp.Refresh_token != "" {
 
-		err := storeAccessData(b, ctx, req, roleName, resp)
+		err := storeVenafiSecretAccessData(b, ctx, req, secretName, resp)
 		if err != nil {
 			return err
 		}
@@ -234,27 +249,45 @@ func updateAccessToken(cfg *vcert.Config, b *backend, ctx context.Context, req *
 	return nil
 }
 
-func storeAccessData(b *backend, ctx context.Context, req *logical.Request, roleName string, resp tpp.OauthRefreshAccessTokenResponse) error {
-	entry, err := b.getRole(ctx, req.Storage, roleName)
-
+func getAccessTokenByCertificate(tppConnector *tpp.Connector) (resp tpp.OauthRefreshAccessTokenResponse, err error) {
+	tokenResp, err := tppConnector.GetRefreshToken(&endpoint.Authentication{
+		ClientPKCS12: true,
+		ClientId:     "hashicorp-vault-by-venafi",
+		Scope:        "certificate:manage,revoke",
+	})
 	if err != nil {
-		return err
+		return resp, err
 	}
 
-	if entry.VenafiSecret == "" {
-		return fmt.Errorf("Role " + roleName + " does not have any Venafi secret associated")
+	resp = tpp.OauthRefreshAccessTokenResponse{
+		Access_token:  tokenResp.Access_token,
+		Expires:       tokenResp.Expires,
+		Identity:      tokenResp.Identity,
+		Refresh_token: tokenResp.Refresh_token,
+		Token_type:    tokenResp.Token_type,
 	}
+	return resp, nil
+}
 
-	venafiEntry, err := b.getVenafiSecret(ctx, req.Storage, entry.VenafiSecret)
+func storeVenafiSecretAccessData(b *backend, ctx context.Context, req *logical.Request, secretName string, resp tpp.OauthRefreshAccessTokenResponse) error {
+	venafiEntry, err := b.getVenafiSecret(ctx, req.Storage, secretName)
 	if err != nil {
 		return err
 	}
 
-	venafiEntry.AccessToken = resp.Access_token
-	venafiEntry.RefreshToken = resp.Refresh_token
+	venafiEntry.setAccessData(resp)
+	return b.storeVenafiSecret(ctx, req, secretName, venafiEntry)
+}
+
+// storeVenafiSecret writes the venafi secret with new tokens. Performance standbys and secondaries can't write the
+// storage, so the request is forwarded to the primary.
+func (b *backend) storeVenafiSecret(ctx context.Context, req *logical.Request, secretName string, venafiEntry *venafiSecretEntry) error {
+	if isReadOnlyReplica(b) {
+		return logical.ErrReadOnly
+	}
 
 	// Store it
-	jsonEntry, err := logical.StorageEntryJSON(CredentialsRootPath+entry.VenafiSecret, venafiEntry)
+	jsonEntry, err := logical.StorageEntryJSON(CredentialsRootPath+secretName, venafiEntry)
 	if err != nil {
 		return err
 	}
@@ -264,12 +297,57 @@ func storeAccessData(b *backend, ctx context.Context, req *logical.Request, role
 	return nil
 }
 
-func getHTTPClient(trustBundlePem string) (*http.Client, error) {
+// isReadOnlyReplica is true on performance standbys and secondaries, they forward the requests which write the storage
+func isReadOnlyReplica(b *backend) bool {
+	return b.System().ReplicationState().HasState(consts.ReplicationPerformanceStandby | consts.ReplicationPerformanceSecondary)
+}
+
+// httpClientSettings holds the connection options of a venafi secret applied to the HTTP client
+type httpClientSettings struct {
+	trustBundlePEM string
+	clientCert     *tls.Certificate
+	proxyURL       string
+	connectTimeout time.Duration
+	requestTimeout time.Duration
+	minTLSVersion  uint16
+	serverName     string
+}
+
+const (
+	defaultConnectTimeout = 30 * time.Second
+	defaultRequestTimeout = 30 * time.Second
+)
+
+var tlsVersions = map[string]uint16{
+	"tls10": tls.VersionTLS10,
+	"tls11": tls.VersionTLS11,
+	"tls12": tls.VersionTLS12,
+	"tls13": tls.VersionTLS13,
+}
+
+func getHTTPClient(settings httpClientSettings) (*http.Client, error) {
+	connectTimeout := settings.connectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+	requestTimeout := settings.requestTimeout
+	if requestTimeout == 0 {
+		requestTimeout = defaultRequestTimeout
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if settings.proxyURL != "" {
+		proxyURL, err := url.Parse(settings.proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse proxy URL: %s", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
 
 	var netTransport = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
+		Proxy: proxy,
 		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
+			Timeout:   connectTimeout,
 			KeepAlive: 30 * time.Second,
 			DualStack: true,
 		}).DialContext,
@@ -280,25 +358,37 @@ func getHTTPClient(trustBundlePem string) (*http.Client, error) {
 	}
 	tlsConfig := http.DefaultTransport.(*http.Transport).TLSClientConfig
 	/* #nosec */
-	if trustBundlePem != "" {
-		trustBundle, err := parseTrustBundlePEM(trustBundlePem)
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+
+	if settings.trustBundlePEM != "" {
+		trustBundle, err := parseTrustBundlePEM(settings.trustBundlePEM)
 		if err != nil {
 			return nil, err
 		}
-
-		if tlsConfig == nil {
-			tlsConfig = &tls.Config{}
-		} else {
-			tlsConfig = tlsConfig.Clone()
-		}
 		tlsConfig.RootCAs = trustBundle
 	}
 
+	if settings.clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*settings.clientCert}
+	}
+
+	if settings.minTLSVersion != 0 {
+		tlsConfig.MinVersion = settings.minTLSVersion
+	}
+
+	if settings.serverName != "" {
+		tlsConfig.ServerName = settings.serverName
+	}
+
 	tlsConfig.Renegotiation = tls.RenegotiateFreelyAsClient
 	netTransport.TLSClientConfig = tlsConfig
 
 	client := &http.Client{
-		Timeout:   time.Second * 30,
+		Timeout:   requestTimeout,
 		Transport: netTransport,
 	}
 	return client, nil
@@ -318,3 +408,51 @@ func parseTrustBundlePEM(trustBundlePem string) (*x509.CertPool, error) {
 
 	return connectionTrustBundle, nil
 }
+
+// getTrustBundleInfo returns the subject and expiration of every certificate in the trust bundle
+func getTrustBundleInfo(trustBundlePem string) []map[string]interface{} {
+	certs := parseCertificatesPEM(trustBundlePem)
+
+	info := make([]map[string]interface{}, 0, len(certs))
+	for _, cert := range certs {
+		info = append(info, map[string]interface{}{
+			"subject":   cert.Subject.String(),
+			"not_after": cert.NotAfter.UTC().Format(time.RFC3339),
+		})
+	}
+	return info
+}
+
+func parseCertificatesPEM(certsPem string) []*x509.Certificate {
+	var certs []*x509.Certificate
+
+	rest := []byte(certsPem)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		certs = append(certs, cert)
+	}
+	return certs
+}
+
+// redactURLPassword hides the password of the user info of the URL
+func redactURLPassword(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
@@ -2,12 +2,20 @@ package pki
 
 import (
 	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"github.com/Venafi/vcert"
 	"github.com/Venafi/vcert/pkg/endpoint"
+	"github.com/Venafi/vcert/pkg/venafi/cloud"
+	"github.com/Venafi/vcert/pkg/venafi/fake"
+	"github.com/Venafi/vcert/pkg/venafi/tpp"
+	"github.com/Venafi/vcert/pkg/verror"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
-	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
 	"time"
 )
 
@@ -26,22 +34,35 @@ func (b *backend) ClientVenafi(ctx context.Context, s logical.Storage, data *fra
 		return nil, 0, fmt.Errorf("unknown role %v", role)
 	}
 
-	cfg, err := b.getConfig(ctx, req, roleName, false)
+	return b.roleClientVenafi(ctx, req, role)
+}
+
+// roleClientVenafi creates the Venafi client for the venafi secret and zone of the role, which can be a copy routed
+// by zone_routes
+func (b *backend) roleClientVenafi(ctx context.Context, req *logical.Request, role *roleEntry) (endpoint.Connector,
+	time.Duration, error) {
+
+	cfg, err := b.getRoleConfig(ctx, req, role, false)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	client, err := vcert.NewClient(cfg)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to get Venafi issuer client: %s", err)
+		return nil, 0, fmt.Errorf("failed to get Venafi issuer client: %w", err)
 	}
 
-	return client, role.ServerTimeout, nil
+	// roles written before server_timeout was limited can have a longer one, the WAL rollback must not run while the
+	// certificate is still awaited
+	timeout := role.ServerTimeout
+	if timeout > maxServerTimeout {
+		timeout = maxServerTimeout
+	}
+	return client, timeout, nil
 
 }
 
 func (b *backend) getConfig(ctx context.Context, req *logical.Request, roleName string, includeRefreshToken bool) (*vcert.Config, error) {
-	var cfg *vcert.Config
 	b.Logger().Debug(fmt.Sprintf("Using role: %s", roleName))
 	if roleName == "" {
 		return nil, fmt.Errorf("missing role name")
@@ -55,6 +76,14 @@ func (b *backend) getConfig(ctx context.Context, req *logical.Request, roleName
 		return nil, fmt.Errorf("unknown role %v", role)
 	}
 
+	return b.getRoleConfig(ctx, req, role, includeRefreshToken)
+}
+
+// getRoleConfig builds the vcert configuration for the venafi secret of the role, the zone of the secret is
+// overridden by the zone of the role
+func (b *backend) getRoleConfig(ctx context.Context, req *logical.Request, role *roleEntry, includeRefreshToken bool) (
+	*vcert.Config, error) {
+
 	venafiSecret, err := b.getVenafiSecret(ctx, req.Storage, role.VenafiSecret)
 	if err != nil {
 		return nil, err
@@ -62,43 +91,64 @@ func (b *backend) getConfig(ctx context.Context, req *logical.Request, roleName
 	if venafiSecret == nil {
 		return nil, fmt.Errorf("unknown venafi secret %v", role.VenafiSecret)
 	}
-
-	var trustBundlePEM string
-	if venafiSecret.TrustBundleFile != "" {
-		b.Logger().Debug(fmt.Sprintf("Reading trust bundle from file: " + venafiSecret.TrustBundleFile))
-		trustBundle, err := ioutil.ReadFile(venafiSecret.TrustBundleFile)
-		if err != nil {
-			return cfg, err
-		}
-		trustBundlePEM = string(trustBundle)
+	// the secret can be changed after the role is written
+	if role.Zone != "" && !venafiSecret.zoneAllowed(role.Zone) {
+		return nil, fmt.Errorf(errorTextZoneNotAllowed, role.Zone, role.VenafiSecret)
 	}
 
-	cfg = &vcert.Config{}
-	cfg.BaseUrl = venafiSecret.URL
-	cfg.Zone = venafiSecret.Zone
-	cfg.LogVerbose = true
-	if trustBundlePEM != "" {
-		cfg.ConnectionTrust = trustBundlePEM
+	cfg, err := b.getConnectionConfig(venafiSecret)
+	if err != nil {
+		return nil, err
+	}
+	if role.Zone != "" && !venafiSecret.Fakemode {
+		cfg.Zone = role.Zone
 	}
 
-	if venafiSecret.Fakemode {
+	switch {
+	case venafiSecret.Fakemode:
 		b.Logger().Debug("Using fakemode to issue certificate")
-		cfg = &vcert.Config{
-			ConnectorType: endpoint.ConnectorTypeFake,
-			LogVerbose:    true,
-		}
 
-	} else if venafiSecret.URL != "" && venafiSecret.TppUser != "" && venafiSecret.TppPassword != "" {
+	case cfg.ConnectorType == endpoint.ConnectorTypeTPP && venafiSecret.TppUser != "" && venafiSecret.TppPassword != "":
 		b.Logger().Debug(fmt.Sprintf("Using Venafi Platform with URL %s to issue certificate", venafiSecret.URL))
-		cfg.ConnectorType = endpoint.ConnectorTypeTPP
 		cfg.Credentials = &endpoint.Authentication{
 			User:     venafiSecret.TppUser,
 			Password: venafiSecret.TppPassword,
 		}
 
-	} else if venafiSecret.URL != "" && venafiSecret.AccessToken != "" {
+	case cfg.ConnectorType == endpoint.ConnectorTypeTPP && venafiSecret.needsClientCertificateToken():
+		// the token pair is obtained once and stored, it's obtained again only when the access token expired
+		b.Logger().Debug(fmt.Sprintf("Using Venafi Platform with URL %s and client certificate to issue certificate", venafiSecret.URL))
+		if isReadOnlyReplica(b) {
+			return nil, logical.ErrReadOnly
+		}
+		tppConnector, err := getTppConnector(cfg)
+		if err != nil {
+			return nil, err
+		}
+		tppConnector.SetHTTPClient(cfg.Client)
+
+		resp, err := getAccessTokenByCertificate(tppConnector)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get access token with client certificate: %s", err)
+		}
+
+		err = storeVenafiSecretAccessData(b, ctx, req, role.VenafiSecret, resp)
+		if err != nil {
+			return nil, err
+		}
+
+		var refreshToken string
+		if includeRefreshToken {
+			refreshToken = resp.Refresh_token
+		}
+		cfg.Credentials = &endpoint.Authentication{
+			AccessToken:  resp.Access_token,
+			RefreshToken: refreshToken,
+			ClientPKCS12: true,
+		}
+
+	case cfg.ConnectorType == endpoint.ConnectorTypeTPP && venafiSecret.AccessToken != "":
 		b.Logger().Debug(fmt.Sprintf("Using Venafi Platform with URL %s to issue certificate", venafiSecret.URL))
-		cfg.ConnectorType = endpoint.ConnectorTypeTPP
 		var refreshToken string
 		if includeRefreshToken {
 			refreshToken = venafiSecret.RefreshToken
@@ -106,23 +156,212 @@ func (b *backend) getConfig(ctx context.Context, req *logical.Request, roleName
 		cfg.Credentials = &endpoint.Authentication{
 			AccessToken:  venafiSecret.AccessToken,
 			RefreshToken: refreshToken,
+			ClientPKCS12: venafiSecret.hasClientCertificate(),
 		}
 
-	} else if venafiSecret.Apikey != "" {
+	case cfg.ConnectorType == endpoint.ConnectorTypeCloud:
 		b.Logger().Debug("Using Venafi Cloud to issue certificate")
-		cfg.ConnectorType = endpoint.ConnectorTypeCloud
 		cfg.Credentials = &endpoint.Authentication{
 			APIKey: venafiSecret.Apikey,
 		}
 
-	} else {
+	default:
 		return nil, fmt.Errorf("failed to build config for Venafi issuer")
 	}
 
+	return cfg, nil
+
+}
+
+// getConnectionConfig builds the connection part of the vcert configuration (connector type, URL, zone and TLS
+// settings) for the venafi secret. Credentials are not set.
+func (b *backend) getConnectionConfig(venafiSecret *venafiSecretEntry) (*vcert.Config, error) {
+	if venafiSecret.Fakemode {
+		return &vcert.Config{
+			ConnectorType: endpoint.ConnectorTypeFake,
+			LogVerbose:    true,
+		}, nil
+	}
+
+	if venafiSecret.TrustBundle == "" && venafiSecret.TrustBundleFile != "" {
+		b.Logger().Debug(fmt.Sprintf("Reading trust bundle from file: " + venafiSecret.TrustBundleFile))
+	}
+	trustBundlePEM, err := venafiSecret.getTrustBundlePEM()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get Venafi issuer client: %s", err)
+		return nil, err
+	}
+
+	cfg := &vcert.Config{}
+	cfg.BaseUrl = venafiSecret.URL
+	cfg.Zone = venafiSecret.Zone
+	cfg.LogVerbose = true
+	if trustBundlePEM != "" {
+		cfg.ConnectionTrust = trustBundlePEM
+	}
+
+	settings, err := venafiSecret.getHTTPClientSettings()
+	if err != nil {
+		return nil, err
+	}
+	settings.trustBundlePEM = trustBundlePEM
+
+	cfg.Client, err = getHTTPClient(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ConnectorType = venafiSecret.connectorType()
+	if cfg.ConnectorType == endpoint.ConnectorTypeUndefined {
+		return nil, fmt.Errorf("failed to build config for Venafi issuer")
 	}
 
 	return cfg, nil
+}
+
+// newConnector creates a connector for the configuration without authenticating it
+func newConnector(cfg *vcert.Config) (endpoint.Connector, error) {
+	var connectionTrustBundle *x509.CertPool
+	var err error
+	if cfg.ConnectionTrust != "" {
+		connectionTrustBundle, err = parseTrustBundlePEM(cfg.ConnectionTrust)
+		if err != nil {
+			return nil, err
+		}
+	}
 
+	var connector endpoint.Connector
+	switch cfg.ConnectorType {
+	case endpoint.ConnectorTypeTPP:
+		connector, err = tpp.NewConnector(cfg.BaseUrl, cfg.Zone, cfg.LogVerbose, connectionTrustBundle)
+	case endpoint.ConnectorTypeCloud:
+		connector, err = cloud.NewConnector(cfg.BaseUrl, cfg.Zone, cfg.LogVerbose, connectionTrustBundle)
+	case endpoint.ConnectorTypeFake:
+		connector = fake.NewConnector(cfg.LogVerbose, connectionTrustBundle)
+	default:
+		err = fmt.Errorf("connector type is not defined")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	connector.SetZone(cfg.Zone)
+	connector.SetHTTPClient(cfg.Client)
+	return connector, nil
+}
+
+// verifyVenafiSecret checks that the endpoint of the venafi secret is reachable, that the credentials are accepted
+// and that the zone exists. The returned error explains which of the checks failed. The access token of the secret
+// is verified as it is, a new token pair is obtained with the client certificate only when the secret has no valid
+// access token, and it's kept in the entry to be stored with it.
+func (b *backend) verifyVenafiSecret(venafiSecret *venafiSecretEntry) (endpoint.ConnectorType, error) {
+	cfg, err := b.getConnectionConfig(venafiSecret)
+	if err != nil {
+		return endpoint.ConnectorTypeUndefined, err
+	}
+
+	connector, err := newConnector(cfg)
+	if err != nil {
+		return cfg.ConnectorType, err
+	}
+
+	b.Logger().Debug(fmt.Sprintf("Verifying connection to %s", cfg.BaseUrl))
+	err = connector.Ping()
+	if err != nil {
+		return cfg.ConnectorType, connectionError(cfg.BaseUrl, err)
+	}
+
+	var auth *endpoint.Authentication
+	switch {
+	case cfg.ConnectorType == endpoint.ConnectorTypeCloud:
+		auth = &endpoint.Authentication{APIKey: venafiSecret.Apikey}
+	case venafiSecret.TppUser != "":
+		auth = &endpoint.Authentication{User: venafiSecret.TppUser, Password: venafiSecret.TppPassword}
+	case venafiSecret.needsClientCertificateToken():
+		tppConnector, ok := connector.(*tpp.Connector)
+		if !ok {
+			return cfg.ConnectorType, fmt.Errorf(errorTextVerifyClientCertNotTPP)
+		}
+		var resp tpp.OauthRefreshAccessTokenResponse
+		resp, err = getAccessTokenByCertificate(tppConnector)
+		if err == nil {
+			venafiSecret.setAccessData(resp)
+		}
+		auth = &endpoint.Authentication{AccessToken: resp.Access_token}
+	case venafiSecret.AccessToken != "":
+		auth = &endpoint.Authentication{AccessToken: venafiSecret.AccessToken}
+	default:
+		auth = &endpoint.Authentication{}
+	}
+	if err == nil {
+		err = connector.Authenticate(auth)
+	}
+	// the TPP connector only keeps the access token, so it's checked with a call to the server
+	if err == nil && cfg.ConnectorType == endpoint.ConnectorTypeTPP && auth.AccessToken != "" {
+		err = verifyAccessToken(cfg, auth.AccessToken)
+	}
+	if err != nil {
+		if isConnectionError(err) {
+			return cfg.ConnectorType, connectionError(cfg.BaseUrl, err)
+		}
+		return cfg.ConnectorType, fmt.Errorf(errorTextVerifyAuth, cfg.BaseUrl, err)
+	}
+
+	_, err = connector.ReadZoneConfiguration()
+	if err != nil {
+		if errors.Is(err, verror.ZoneNotFoundError) {
+			return cfg.ConnectorType, fmt.Errorf(errorTextVerifyZoneNotFound, cfg.Zone)
+		}
+		return cfg.ConnectorType, fmt.Errorf(errorTextVerifyZone, cfg.Zone, err)
+	}
+
+	return cfg.ConnectorType, nil
+}
+
+// verifyAccessToken checks the access token with the token verification endpoint of TPP
+func verifyAccessToken(cfg *vcert.Config, accessToken string) error {
+	baseURL := strings.TrimSuffix(cfg.BaseUrl, "/")
+	baseURL = strings.TrimSuffix(baseURL, "/vedsdk")
+	if !strings.HasPrefix(strings.ToLower(baseURL), "https://") && !strings.HasPrefix(strings.ToLower(baseURL), "http://") {
+		baseURL = "https://" + baseURL
+	}
+
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/vedauth/authorize/verify", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: access token verification failed. Status: %s", verror.AuthError, resp.Status)
+	}
+	return nil
+}
+
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return isTLSTrustError(err) || errors.As(err, &netErr)
+}
+
+func isTLSTrustError(err error) bool {
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certInvalidErr x509.CertificateInvalidError
+	return errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &certInvalidErr)
+}
+
+func connectionError(url string, err error) error {
+	if isTLSTrustError(err) {
+		return fmt.Errorf(errorTextVerifyTLS, url, err)
+	}
+	return fmt.Errorf(errorTextVerifyUnreachable, url, err)
 }
@@ -10,10 +10,14 @@ import (
 	"github.com/Venafi/vcert"
 	"github.com/Venafi/vcert/pkg/certificate"
 	"github.com/Venafi/vcert/pkg/endpoint"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/logical"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestPKIVcertIsWorking(t *testing.T) {
@@ -114,3 +118,84 @@ func createBackendWithStorage(t *testing.T) (*backend, logical.Storage) {
 	}
 	return b, config.StorageView
 }
+
+func TestClientCertificateToken(t *testing.T) {
+	var authorized int
+	tppServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.URL.Path, "/vedauth/authorize/certificate") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		authorized++
+		_, _ = fmt.Fprintf(w, `{"access_token":"new%d==","refresh_token":"refresh==","expires":%d}`, authorized,
+			time.Now().Add(time.Hour).Unix())
+	}))
+	defer tppServer.Close()
+
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+	req := &logical.Request{Storage: storage}
+	certPEM, keyPEM := generateSelfSignedPair(t, "vault-client.venafi.example")
+	secret := &venafiSecretEntry{
+		URL:                tppServer.URL,
+		Zone:               "devops\\vcert",
+		TrustBundle:        string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tppServer.Certificate().Raw})),
+		ClientCertificate:  certPEM,
+		ClientPrivateKey:   keyPEM,
+		AccessToken:        "stored==",
+		AccessTokenExpires: time.Now().Add(time.Hour).UTC(),
+	}
+	entry, err := logical.StorageEntryJSON(CredentialsRootPath+"tpp", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+	role := &roleEntry{VenafiSecret: "tpp"}
+
+	// the stored token is used while it's valid
+	cfg, err := b.getRoleConfig(ctx, req, role, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Credentials.AccessToken != "stored==" || authorized != 0 {
+		t.Fatalf("stored access token should be used, got %s after %d authorizations", cfg.Credentials.AccessToken,
+			authorized)
+	}
+
+	// the expired token is replaced once, the new one is stored
+	secret.AccessTokenExpires = time.Now().Add(-time.Minute).UTC()
+	entry, err = logical.StorageEntryJSON(CredentialsRootPath+"tpp", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		cfg, err = b.getRoleConfig(ctx, req, role, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Credentials.AccessToken != "new1==" || authorized != 1 {
+			t.Fatalf("expired access token should be replaced once, got %s after %d authorizations",
+				cfg.Credentials.AccessToken, authorized)
+		}
+	}
+
+	// performance standbys forward the request to the primary instead of writing the new token
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+	b.System().(*logical.StaticSystemView).ReplicationStateVal = consts.ReplicationPerformanceStandby
+	if _, err := b.getRoleConfig(ctx, req, role, false); err != logical.ErrReadOnly {
+		t.Fatalf("expecting %s, got %v", logical.ErrReadOnly, err)
+	}
+	if resp, err := venafiErrorResponse(req, logical.ErrReadOnly); resp != nil || err != logical.ErrReadOnly {
+		t.Fatalf("read only error should be returned to be forwarded, got %#v %v", resp, err)
+	}
+	if authorized != 1 {
+		t.Fatalf("token should not be requested by the standby, got %d authorizations", authorized)
+	}
+}
@@ -0,0 +1,101 @@
+package pki
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"time"
+)
+
+const walIssuanceKind = "issuance"
+
+// maxServerTimeout limits server_timeout of roles, so that the rollback never runs for an issuance which is still
+// waiting for the certificate
+const maxServerTimeout = 30 * time.Minute
+
+// walRollbackMinAge is the age of WAL entries of interrupted issuances to be rolled back
+const walRollbackMinAge = maxServerTimeout + 5*time.Minute
+
+func (b *backend) walRollback(ctx context.Context, req *logical.Request, kind string, data interface{}) error {
+	switch kind {
+	case walIssuanceKind:
+		return b.issuanceRollback(ctx, req, data)
+	default:
+		return fmt.Errorf("unknown WAL entry kind %q", kind)
+	}
+}
+
+// issuanceRollback completes an issuance which was interrupted after the request was sent to Venafi.
+// The certificate is stored if it's already issued, otherwise the request is saved as pending so it can be picked up
+// later. Requests which can't be recovered are recorded as orphans.
+func (b *backend) issuanceRollback(ctx context.Context, req *logical.Request, data interface{}) error {
+	// WAL data is decoded from JSON into a map, so encode it back to get the typed entry
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	var pending pendingRequest
+	if err := json.Unmarshal(raw, &pending); err != nil {
+		return err
+	}
+
+	b.Logger().Warn(fmt.Sprintf("Rolling back interrupted issuance of %s for role %s", pending.CommonName, pending.Role))
+
+	if pending.PickupID == "" {
+		return b.storeOrphan(ctx, req.Storage, &pending,
+			"issuance was interrupted before Venafi returned the request ID, the certificate may have been requested")
+	}
+
+	role, err := b.getRole(ctx, req.Storage, pending.Role)
+	if err != nil {
+		return err
+	}
+	if role == nil {
+		return b.storeOrphan(ctx, req.Storage, &pending, "role was deleted before the certificate was stored")
+	}
+	role = pending.routedRole(role)
+
+	cl, _, err := b.clientVenafiWithRetry(ctx, req, nil, pending.Role, role)
+	if err != nil {
+		b.Logger().Warn(fmt.Sprintf("Can't create Venafi client for role %s: %s", pending.Role, err))
+		return b.storePendingRequest(ctx, req.Storage, &pending)
+	}
+
+	pcc, status, err := b.retrievePending(ctx, cl, role, &pending)
+	if err != nil || pcc == nil {
+		b.Logger().Warn(fmt.Sprintf("Certificate %s is not retrieved (status %q, error %v), saving it with pickup ID %s",
+			pending.PickupID, status, err, pending.ID))
+		return b.storePendingRequest(ctx, req.Storage, &pending)
+	}
+
+	// the certificate may be already stored when the WAL entry of the completed issuance couldn't be deleted
+	pcc.PrivateKey = pending.PrivateKey
+	_, err = b.storeCertificate(ctx, req, role, &pending, pcc)
+	return err
+}
+
+// updateWAL replaces the WAL entry with the new data. The new entry is written first so the data is never lost.
+func (b *backend) updateWAL(ctx context.Context, s logical.Storage, id string, kind string, data interface{}) (string, error) {
+	if id == "" {
+		return "", nil
+	}
+	newID, err := framework.PutWAL(ctx, s, kind, data)
+	if err != nil {
+		return "", err
+	}
+	b.deleteWAL(ctx, s, id)
+	return newID, nil
+}
+
+// deleteWAL removes the WAL entry when the operation is completed. A failure is only logged: the rollback of a
+// completed issuance retrieves the certificate again, but storeCertificate finds it already stored and skips it.
+func (b *backend) deleteWAL(ctx context.Context, s logical.Storage, id string) {
+	if id == "" {
+		return
+	}
+	if err := framework.DeleteWAL(ctx, s, id); err != nil {
+		b.Logger().Warn(fmt.Sprintf("Can't delete WAL entry %s: %s", id, err))
+	}
+}
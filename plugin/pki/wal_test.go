@@ -0,0 +1,196 @@
+package pki
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Venafi/vcert/pkg/certificate"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestIssuanceRollback(t *testing.T) {
+	ctx := context.Background()
+	b, storage := createBackendWithStorage(t)
+	createFakeRole(t, b, storage, "wal", map[string]interface{}{
+		"store_by":          "cn",
+		"store_pkey":        true,
+		"max_active_per_cn": 5,
+	})
+
+	req := &logical.Request{Storage: storage}
+	cl, _, err := b.ClientVenafi(ctx, storage, nil, req, "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// request is sent to Venafi but Vault goes down before the certificate is stored
+	certReq, err := formRequest(requestData{commonName: "wal.example.com"}, &roleEntry{KeyType: "rsa", KeyBits: 2048, ChainOption: "last"}, false, b.Logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.GenerateRequest(nil, certReq); err != nil {
+		t.Fatal(err)
+	}
+	issued, err := newPendingRequest("wal", "wal.example.com", false, certReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued.PickupID, err = cl.RequestCertificate(certReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := framework.PutWAL(ctx, storage, walIssuanceKind, issued); err != nil {
+		t.Fatal(err)
+	}
+
+	// Vault goes down before the request is sent
+	unknown, err := newPendingRequest("wal", "unknown.example.com", false, certReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := framework.PutWAL(ctx, storage, walIssuanceKind, unknown); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.RollbackOperation,
+		Path:      "",
+		Storage:   storage,
+		Data:      map[string]interface{}{"immediate": true},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("rollback failed: err: %v resp: %#v", err, resp)
+	}
+
+	wals, err := framework.ListWAL(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wals) != 0 {
+		t.Fatalf("WAL entries should be removed after rollback, got %v", wals)
+	}
+
+	var cert VenafiCert
+	entry, err := storage.Get(ctx, "certs/wal.example.com")
+	if err != nil || entry == nil {
+		t.Fatalf("certificate should be stored on rollback: %v", err)
+	}
+	if err := entry.DecodeJSON(&cert); err != nil {
+		t.Fatal(err)
+	}
+	if cert.PrivateKey != issued.PrivateKey {
+		t.Fatal("private key from the WAL entry should be stored")
+	}
+	if _, err := certificate.PEMCollectionFromBytes([]byte(cert.Certificate), certificate.ChainOptionRootLast); err != nil {
+		t.Fatal(err)
+	}
+
+	// the WAL entry of the completed issuance couldn't be deleted, so the rollback stores the certificate again. The
+	// fake connector issues a new certificate on every retrieval, so the retrieved certificate is stored directly.
+	role, err := b.getRole(ctx, storage, "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcc := &certificate.PEMCollection{Certificate: cert.Certificate, PrivateKey: issued.PrivateKey}
+	if _, err := b.storeCertificate(ctx, &logical.Request{Storage: storage}, role, issued, pcc); err != nil {
+		t.Fatal(err)
+	}
+	events, _, err := b.queryHistory(ctx, storage, &historyFilter{commonName: "wal.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Event != historyEventIssued {
+		t.Fatalf("stored certificate should be recorded once, got %#v", events)
+	}
+	active, err := b.getActiveCertificates(ctx, storage, "wal", "wal.example.com", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active.NotAfter) != 1 {
+		t.Fatalf("stored certificate should be counted once, got %v", active.NotAfter)
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "orphans/",
+		Storage:   storage,
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("failed to list orphans: err: %v resp: %#v", err, resp)
+	}
+	keys := resp.Data["keys"].([]string)
+	if len(keys) != 1 || keys[0] != unknown.ID {
+		t.Fatalf("expected orphan %s, got %v", unknown.ID, keys)
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "orphans/" + unknown.ID,
+		Storage:   storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("failed to read orphan: err: %v resp: %#v", err, resp)
+	}
+	if resp.Data["common_name"] != "unknown.example.com" {
+		t.Fatalf("unexpected orphan %#v", resp.Data)
+	}
+
+	// the request ID is not known, so the certificate can't be revoked by the plugin
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "orphans/" + unknown.ID,
+		Storage:   storage,
+	})
+	if err != nil || !resp.IsError() {
+		t.Fatalf("revoking orphan without request ID should fail: err: %v resp: %#v", err, resp)
+	}
+}
+
+func TestServerTimeoutLimit(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	createFakeRole(t, b, storage, "timeout", nil)
+
+	// roles written before server_timeout was limited are still read with a longer timeout
+	role, err := b.getRole(context.Background(), storage, "timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	role.ServerTimeout = 2 * time.Hour
+	_, timeout, err := b.roleClientVenafi(context.Background(), &logical.Request{Storage: storage}, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeout != maxServerTimeout || timeout >= walRollbackMinAge {
+		t.Fatalf("server timeout should be limited to %s, got %s", maxServerTimeout, timeout)
+	}
+
+	entry, err := logical.StorageEntryJSON("role/timeout", role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+	update := func(data map[string]interface{}) *logical.Response {
+		data["update_if_exist"] = true
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "roles/timeout",
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := update(map[string]interface{}{"ttl": 3600}); resp != nil && resp.IsError() {
+		t.Fatalf("role with a longer server timeout should be updated, got %#v", resp)
+	}
+	if resp := update(map[string]interface{}{"server_timeout": int(maxServerTimeout.Seconds()) + 1}); resp == nil ||
+		!resp.IsError() {
+		t.Fatalf("server timeout longer than %s should be refused, got %#v", maxServerTimeout, resp)
+	}
+}
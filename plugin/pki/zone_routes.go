@@ -0,0 +1,183 @@
+package pki
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/Venafi/vcert/pkg/certificate"
+	"github.com/hashicorp/vault/sdk/logical"
+	"path"
+	"strings"
+)
+
+// zoneRoute sends requests for the domains to the zone, of the role venafi secret or of another one
+type zoneRoute struct {
+	Domains      []string `json:"domains"`
+	Zone         string   `json:"zone,omitempty"`
+	VenafiSecret string   `json:"venafi_secret,omitempty"`
+}
+
+// parseZoneRoutes decodes zone_routes of the role, a list of objects with domains, zone and venafi_secret
+func parseZoneRoutes(raw []interface{}) ([]zoneRoute, error) {
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(encoded)))
+	decoder.DisallowUnknownFields()
+	var routes []zoneRoute
+	if err := decoder.Decode(&routes); err != nil {
+		return nil, fmt.Errorf(errorTextInvalidZoneRoutes, err)
+	}
+	return routes, nil
+}
+
+func validateZoneRoutes(routes []zoneRoute) error {
+	for i, route := range routes {
+		if len(route.Domains) == 0 {
+			return fmt.Errorf(errorTextZoneRouteNoDomains, i+1)
+		}
+		if route.Zone == "" && route.VenafiSecret == "" {
+			return fmt.Errorf(errorTextZoneRouteNoTarget, i+1)
+		}
+		for _, domain := range route.Domains {
+			if _, err := path.Match(domain, ""); err != nil {
+				return fmt.Errorf(errorTextZoneRoutePattern, domain, err)
+			}
+		}
+	}
+	return nil
+}
+
+// matchZoneRoute returns the first route with a domain pattern matching the name, nil if there is none
+func matchZoneRoute(routes []zoneRoute, name string) *zoneRoute {
+	name = strings.ToLower(name)
+	for i := range routes {
+		for _, domain := range routes[i].Domains {
+			if matched, _ := path.Match(strings.ToLower(domain), name); matched {
+				return &routes[i]
+			}
+		}
+	}
+	return nil
+}
+
+// requestNames are the common name and the DNS names of the request, from the CSR when it's provided by the user
+func requestNames(certReq *certificate.Request) []string {
+	commonName, dnsNames := certReq.Subject.CommonName, certReq.DNSNames
+	if certReq.CsrOrigin == certificate.UserProvidedCSR {
+		block, _ := pem.Decode(certReq.GetCSR())
+		if block == nil {
+			return nil
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			return nil
+		}
+		commonName, dnsNames = csr.Subject.CommonName, csr.DNSNames
+	}
+	var names []string
+	if commonName != "" {
+		names = append(names, commonName)
+	}
+	return append(names, dnsNames...)
+}
+
+// routeRequest returns a copy of the role with the venafi secret and the zone of the route matching the names of the
+// request. Names without a route go to the venafi secret of the role. The request is refused when the names are routed
+// to different zones.
+func (b *backend) routeRequest(ctx context.Context, s logical.Storage, role *roleEntry, names []string) (*roleEntry,
+	error) {
+
+	if len(role.ZoneRoutes) == 0 {
+		return role, nil
+	}
+
+	secretZones := make(map[string]string)
+	effectiveZone := func(secretName string, zone string) (string, error) {
+		if zone != "" {
+			return zone, nil
+		}
+		if zone, ok := secretZones[secretName]; ok {
+			return zone, nil
+		}
+		venafiSecret, err := b.getVenafiSecret(ctx, s, secretName)
+		if err != nil {
+			return "", err
+		}
+		if venafiSecret == nil {
+			return "", fmt.Errorf("unknown venafi secret %v", secretName)
+		}
+		secretZones[secretName] = venafiSecret.Zone
+		return venafiSecret.Zone, nil
+	}
+
+	routed := *role
+	selectedName := ""
+	for _, name := range names {
+		venafiSecret, zone := role.VenafiSecret, role.Zone
+		if route := matchZoneRoute(role.ZoneRoutes, name); route != nil {
+			if route.VenafiSecret != "" {
+				venafiSecret, zone = route.VenafiSecret, ""
+			}
+			if route.Zone != "" {
+				zone = route.Zone
+			}
+		}
+		zone, err := effectiveZone(venafiSecret, zone)
+		if err != nil {
+			return nil, err
+		}
+		if selectedName == "" {
+			selectedName = name
+			routed.VenafiSecret, routed.Zone = venafiSecret, zone
+			continue
+		}
+		if venafiSecret != routed.VenafiSecret || zone != routed.Zone {
+			return nil, fmt.Errorf(errorTextNamesSpanZones, selectedName, name)
+		}
+	}
+	return &routed, nil
+}
+
+// checkRoleZones checks that the zone and the zones of the routes of the role are allowed by their venafi secrets
+func (b *backend) checkRoleZones(ctx context.Context, s logical.Storage, role *roleEntry) error {
+	check := func(secretName string, zone string) error {
+		if zone == "" {
+			return nil
+		}
+		venafiSecret, err := b.getVenafiSecret(ctx, s, secretName)
+		if err != nil || venafiSecret == nil {
+			return err
+		}
+		if !venafiSecret.zoneAllowed(zone) {
+			return fmt.Errorf(errorTextZoneNotAllowed, zone, secretName)
+		}
+		return nil
+	}
+
+	if err := check(role.VenafiSecret, role.Zone); err != nil {
+		return err
+	}
+	for _, route := range role.ZoneRoutes {
+		secretName := route.VenafiSecret
+		if secretName == "" {
+			secretName = role.VenafiSecret
+		}
+		if err := check(secretName, route.Zone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	errorTextInvalidZoneRoutes  = "invalid zone_routes, expected a list of objects with domains, zone and venafi_secret: %v"
+	errorTextZoneRouteNoDomains = "route %d of zone_routes has no domains"
+	errorTextZoneRouteNoTarget  = "route %d of zone_routes has neither zone nor venafi_secret"
+	errorTextZoneRoutePattern   = "invalid domain pattern %q in zone_routes: %v"
+	errorTextNamesSpanZones     = "names %s and %s of the request are routed to different zones"
+	errorTextZoneNotAllowed     = "zone %s is not allowed by allowed_zones of venafi secret %s"
+)
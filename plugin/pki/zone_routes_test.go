@@ -0,0 +1,207 @@
+package pki
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestZoneRoutes(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+	createFakeRole(t, b, storage, "lab", nil)
+	createFakeRole(t, b, storage, "routed", map[string]interface{}{
+		"zone_routes": []interface{}{
+			map[string]interface{}{"domains": []interface{}{"*.eu.example.com", "eu.example.com"}, "zone": `Certificates\EU`},
+			map[string]interface{}{"domains": []interface{}{"*.lab.example.com"}, "venafi_secret": "lab", "zone": "Lab"},
+			map[string]interface{}{"domains": []interface{}{"*.example.com"}, "venafi_secret": "lab"},
+		},
+	})
+
+	request := func(operation logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: operation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		return codedErrorResponse(t, resp, err)
+	}
+	checkRoute := func(resp *logical.Response, venafiSecret string, zone string) {
+		t.Helper()
+		if resp.IsError() {
+			t.Fatalf("request failed: %#v", resp)
+		}
+		if resp.Data["venafi_secret"] != venafiSecret || resp.Data["zone"] != zone {
+			t.Fatalf("expected venafi secret %s and zone %q, got %v and %q", venafiSecret, zone,
+				resp.Data["venafi_secret"], resp.Data["zone"])
+		}
+	}
+
+	checkRoute(request(logical.UpdateOperation, "issue/routed", map[string]interface{}{
+		"common_name": "web.eu.example.com",
+		"alt_names":   "eu.example.com",
+	}), "routed", `Certificates\EU`)
+	checkRoute(request(logical.UpdateOperation, "issue/routed", map[string]interface{}{
+		"common_name": "web.lab.example.com",
+	}), "lab", "Lab")
+	checkRoute(request(logical.UpdateOperation, "issue/routed", map[string]interface{}{
+		"common_name": "web.example.com",
+	}), "lab", "")
+	checkRoute(request(logical.UpdateOperation, "issue/routed", map[string]interface{}{
+		"common_name": "web.example.org",
+	}), "routed", "")
+	checkRoute(request(logical.UpdateOperation, "sign/routed", map[string]interface{}{
+		"csr": createTestCSR(t, &x509.CertificateRequest{
+			Subject:  pkix.Name{CommonName: "csr.eu.example.com"},
+			DNSNames: []string{"csr.eu.example.com"},
+		}),
+	}), "routed", `Certificates\EU`)
+
+	resp := request(logical.UpdateOperation, "issue/routed", map[string]interface{}{
+		"common_name": "web.eu.example.com",
+		"alt_names":   "web.lab.example.com",
+	})
+	if !resp.IsError() {
+		t.Fatalf("names routed to different zones should be refused, got %#v", resp)
+	}
+
+	// the pickup uses the venafi secret and the zone the request was routed to
+	resp = request(logical.UpdateOperation, "issue/routed", map[string]interface{}{
+		"common_name": "async.lab.example.com",
+		"async":       true,
+	})
+	if resp.IsError() {
+		t.Fatalf("failed to request certificate: %#v", resp)
+	}
+	checkRoute(request(logical.UpdateOperation, "pickup/routed/"+resp.Data["pickup_id"].(string), nil), "lab", "Lab")
+
+	for _, routes := range []interface{}{
+		[]interface{}{"*.example.com"},
+		[]interface{}{map[string]interface{}{"domains": []interface{}{"*.example.com"}}},
+		[]interface{}{map[string]interface{}{"domains": []interface{}{}, "zone": "Zone"}},
+		[]interface{}{map[string]interface{}{"domains": []interface{}{"[.example.com"}, "zone": "Zone"}},
+		[]interface{}{map[string]interface{}{"domains": []interface{}{"*.example.com"}, "policy": "Zone"}},
+	} {
+		resp := request(logical.UpdateOperation, "roles/invalid", map[string]interface{}{
+			"venafi_secret": "lab",
+			"zone_routes":   routes,
+		})
+		if !resp.IsError() {
+			t.Fatalf("zone_routes %v should be refused, got %#v", routes, resp)
+		}
+	}
+}
+
+func TestRoleZoneConfig(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+	entry, err := logical.StorageEntryJSON(CredentialsRootPath+"tpp", &venafiSecretEntry{
+		URL:         "https://tpp.example.com/vedsdk",
+		Zone:        `Certificates\Default`,
+		TppUser:     "user",
+		TppPassword: "password",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &logical.Request{Storage: storage}
+	role := &roleEntry{VenafiSecret: "tpp"}
+	cfg, err := b.getRoleConfig(ctx, req, role, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Zone != `Certificates\Default` {
+		t.Fatalf("expected the zone of the venafi secret, got %q", cfg.Zone)
+	}
+
+	role.Zone = `Certificates\EU`
+	cfg, err = b.getRoleConfig(ctx, req, role, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Zone != `Certificates\EU` {
+		t.Fatalf("expected the zone of the role, got %q", cfg.Zone)
+	}
+}
+
+func TestAllowedZones(t *testing.T) {
+	b, storage := createBackendWithStorage(t)
+	ctx := context.Background()
+
+	request := func(operation logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: operation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		return codedErrorResponse(t, resp, err)
+	}
+	writeSecret := func(allowedZones string) {
+		resp := request(logical.UpdateOperation, "venafi/shared", map[string]interface{}{
+			"fakemode":      true,
+			"zone":          `Certificates\Default`,
+			"allowed_zones": allowedZones,
+		})
+		if resp != nil && resp.IsError() {
+			t.Fatalf("failed to write venafi secret: %#v", resp)
+		}
+	}
+	writeSecret(`Certificates\Web,Certificates\Teams\*`)
+
+	for zone, allowed := range map[string]bool{
+		`Certificates\Default`: true,
+		`certificates\web`:     true,
+		`Certificates\Teams\A`: true,
+		`Certificates\Teams`:   false,
+		`Certificates\Other`:   false,
+	} {
+		resp := request(logical.UpdateOperation, "roles/zone", map[string]interface{}{
+			"venafi_secret": "shared",
+			"zone":          zone,
+		})
+		if allowed == (resp != nil && resp.IsError()) {
+			t.Fatalf("zone %s allowed: %v, got %#v", zone, allowed, resp)
+		}
+	}
+	resp := request(logical.UpdateOperation, "roles/routed", map[string]interface{}{
+		"venafi_secret": "shared",
+		"zone_routes": []interface{}{
+			map[string]interface{}{"domains": []interface{}{"*.example.com"}, "zone": `Certificates\Other`},
+		},
+	})
+	if !resp.IsError() {
+		t.Fatalf("route to a zone which isn't allowed should be refused, got %#v", resp)
+	}
+
+	resp = request(logical.UpdateOperation, "roles/web", map[string]interface{}{
+		"venafi_secret": "shared",
+		"zone":          `Certificates\Web`,
+	})
+	if resp != nil && resp.IsError() {
+		t.Fatalf("failed to write role: %#v", resp)
+	}
+	resp = request(logical.ReadOperation, "roles/web", nil)
+	if resp.Data["zone"] != `Certificates\Web` {
+		t.Fatalf("expected zone of the role, got %v", resp.Data["zone"])
+	}
+	resp = request(logical.UpdateOperation, "issue/web", map[string]interface{}{"common_name": "web.example.com"})
+	if resp.IsError() {
+		t.Fatalf("failed to issue certificate: %#v", resp)
+	}
+
+	// the zone is checked again when the secret is changed after the role is written
+	writeSecret(`Certificates\Teams\*`)
+	resp = request(logical.UpdateOperation, "issue/web", map[string]interface{}{"common_name": "web.example.com"})
+	if !resp.IsError() {
+		t.Fatalf("zone which isn't allowed anymore should be refused, got %#v", resp)
+	}
+}